@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/agux/roprox/internal/proxy"
+)
+
+const usage = `usage: roprox [command]
+
+Without command, roprox runs the enabled services per the configuration file.
+
+commands:
+  route <url> [client-ip]   dry-run the routing rules against the target and print the decision
+  har export [flags]        export captured network traffic as HAR 1.2. Run with -h for the filters.
+  har import <file>...      load HAR files into the network_traffic table
+  replay [flags] <id>...    replay captured requests and diff the responses against the recorded ones.
+                            Run with -h for the flags. Exits with 3 if any response changed.
+`
+
+// runCommand runs the subcommand with its arguments.
+func runCommand(cmd string, args []string) {
+	switch cmd {
+	case "route":
+		if len(args) < 1 || len(args) > 2 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		clientIP := ""
+		if len(args) > 1 {
+			clientIP = args[1]
+		}
+		desc, e := proxy.DryRunRoute(args[0], clientIP)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			os.Exit(1)
+		}
+		fmt.Println(desc)
+	case "har":
+		if len(args) < 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if e := runHAR(args[0], args[1:]); e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			os.Exit(1)
+		}
+	case "replay":
+		changed, e := runReplay(args)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			os.Exit(1)
+		}
+		if changed {
+			os.Exit(3)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// runReplay replays network traffic records or HAR entries and prints the diffs.
+// It returns whether any response changed.
+func runReplay(args []string) (changed bool, e error) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	proxyAddr := fs.String("proxy", "", "backend proxy as scheme://host:port, master or direct. "+
+		"Defaults to a freshly rotated proxy.")
+	harFile := fs.String("har", "", "replay the entries of the HAR file instead of network_traffic IDs")
+	fs.Parse(args)
+
+	var results []*proxy.ReplayResult
+	if *harFile != "" {
+		file, e := os.Open(*harFile)
+		if e != nil {
+			return false, e
+		}
+		defer file.Close()
+		results, e = proxy.ReplayHAR(file, *proxyAddr)
+		if e != nil {
+			return false, e
+		}
+	} else {
+		if fs.NArg() == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		var ids []uint
+		for _, v := range fs.Args() {
+			id, e := strconv.ParseUint(v, 10, 0)
+			if e != nil {
+				return false, fmt.Errorf("invalid id %q", v)
+			}
+			ids = append(ids, uint(id))
+		}
+		if results, e = proxy.ReplayTraffic(ids, *proxyAddr); e != nil {
+			return false, e
+		}
+	}
+	for _, r := range results {
+		fmt.Println(r)
+		changed = changed || r.Changed()
+	}
+	return
+}
+
+// runHAR exports or imports HAR files.
+func runHAR(action string, args []string) error {
+	switch action {
+	case "export":
+		fs := flag.NewFlagSet("har export", flag.ExitOnError)
+		q := url.Values{}
+		for _, name := range []string{"from", "to", "host", "status", "client", "limit"} {
+			name := name
+			fs.Func(name, filterUsage[name], func(v string) error {
+				q.Set(name, v)
+				return nil
+			})
+		}
+		output := fs.String("o", "", "output file. Defaults to stdout.")
+		fs.Parse(args)
+		f, e := proxy.ParseTrafficFilter(q)
+		if e != nil {
+			return e
+		}
+		var w io.Writer = os.Stdout
+		if *output != "" {
+			file, e := os.Create(*output)
+			if e != nil {
+				return e
+			}
+			defer file.Close()
+			w = file
+		}
+		n, e := proxy.ExportHAR(w, f)
+		if e != nil {
+			return e
+		}
+		fmt.Fprintf(os.Stderr, "exported %d entries\n", n)
+	case "import":
+		if len(args) == 0 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		for _, path := range args {
+			file, e := os.Open(path)
+			if e != nil {
+				return e
+			}
+			n, e := proxy.ImportHAR(file, 0)
+			file.Close()
+			if e != nil {
+				return fmt.Errorf("%s: %w", path, e)
+			}
+			fmt.Fprintf(os.Stderr, "imported %d entries from %s\n", n, path)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	return nil
+}
+
+var filterUsage = map[string]string{
+	"from":   "captured at or after the time, in RFC 3339 or yyyy-mm-dd",
+	"to":     "captured before the time, in RFC 3339 or yyyy-mm-dd",
+	"host":   "target host, with or without port",
+	"status": "response status code",
+	"client": "client IP, with or without port",
+	"limit":  "max number of entries",
+}
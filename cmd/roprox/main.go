@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/agux/roprox/internal/checker"
 	"github.com/agux/roprox/internal/conf"
@@ -26,23 +30,52 @@ func main() {
 
 	log.Infof("config file used: %s", conf.ConfigFileUsed())
 
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	// the root context is canceled on SIGINT or SIGTERM. A second signal terminates immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		log.Info("shutting down gracefully, press Ctrl+C again to force")
+		stop()
+	}()
+
 	var wg sync.WaitGroup
 
 	if conf.Args.Scanner.Enabled {
 		log.Infof("starting scanner")
 		wg.Add(1)
-		go scanner.Scan(&wg)
+		go scanner.Scan(ctx, &wg)
 	}
 	if conf.Args.Proxy.Enabled {
+		// client connections are drained once both listeners stop accepting
+		var listeners sync.WaitGroup
 		log.Infof("starting proxy on port %d", conf.Args.Proxy.Port)
+		listeners.Add(1)
+		go proxy.Serve(ctx, &listeners)
+		if conf.Args.Proxy.Socks5Port > 0 {
+			log.Infof("starting SOCKS5 proxy on port %d", conf.Args.Proxy.Socks5Port)
+			listeners.Add(1)
+			go proxy.ServeSocks5(ctx, &listeners)
+		}
 		wg.Add(1)
-		go proxy.Serve(&wg)
+		go func() {
+			defer wg.Done()
+			listeners.Wait()
+			log.Info("draining client connections...")
+			proxy.Shutdown()
+		}()
 	}
 	if conf.Args.Probe.Enabled {
 		log.Infof("starting probe")
 		wg.Add(1)
-		go checker.Check(&wg)
+		go checker.Check(ctx, &wg)
 	}
 
 	wg.Wait()
+	log.Info("roprox stopped")
 }
@@ -6,6 +6,7 @@ toolchain go1.21.6
 
 require (
 	github.com/PuerkitoBio/goquery v1.6.1
+	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/chromedp/cdproto v0.0.0-20240202021202-6d0b6a386732
 	github.com/chromedp/chromedp v0.9.5
 	github.com/glebarez/go-sqlite v1.22.0
@@ -15,6 +16,7 @@ require (
 	github.com/spf13/viper v1.18.2
 	github.com/ssgreg/repeat v1.5.1
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
+	golang.org/x/crypto v0.18.0
 	golang.org/x/net v0.20.0
 	golang.org/x/text v0.14.0
 	gopkg.in/gorp.v2 v2.2.0
@@ -24,7 +26,6 @@ require (
 
 require (
 	github.com/andybalholm/cascadia v1.1.0 // indirect
-	github.com/avast/retry-go v3.0.0+incompatible // indirect
 	github.com/chromedp/sysutil v1.0.0 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
@@ -61,7 +62,6 @@ require (
 	github.com/subosito/gotenv v1.6.0 // indirect
 	github.com/ziutek/mymysql v1.5.4 // indirect
 	go.uber.org/multierr v1.11.0 // indirect
-	golang.org/x/crypto v0.18.0 // indirect
 	golang.org/x/exp v0.0.0-20240205201215-2c58cdc269a3 // indirect
 	golang.org/x/sys v0.16.0 // indirect
 	golang.org/x/term v0.16.0 // indirect
@@ -1,6 +1,7 @@
 package checker
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -14,12 +15,17 @@ import (
 
 var log = logging.Logger
 
-func Check(wg *sync.WaitGroup) {
+// Check probes proxy servers periodically until the context is done.
+// In-flight probes are completed before it returns.
+func Check(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	lch := make(chan *types.ProxyServer, 8192)
-	probe(lch)
-	Tick(lch)
+	var wgp sync.WaitGroup
+	probe(ctx, &wgp, lch)
+	Tick(ctx, lch)
+	log.Info("stopping probe...")
+	wgp.Wait()
 }
 
 func evictBrokenServers() {
@@ -41,20 +47,19 @@ func evictBrokenServers() {
 	log.Infof("%d broken servers evicted", ra)
 }
 
-func Tick(lch chan<- *types.ProxyServer) {
+func Tick(ctx context.Context, lch chan<- *types.ProxyServer) {
 	//kickoff at once and repeatedly
 	evictBrokenServers()
-	queryServers(lch)
+	queryServers(ctx, lch)
 	probeTk := time.NewTicker(time.Duration(conf.Args.Probe.Interval) * time.Second)
 	evictTk := time.NewTicker(time.Duration(conf.Args.Proxy.EvictionInterval) * time.Second)
-	quit := make(chan struct{})
 	for {
 		select {
 		case <-probeTk.C:
-			queryServers(lch)
+			queryServers(ctx, lch)
 		case <-evictTk.C:
 			evictBrokenServers()
-		case <-quit:
+		case <-ctx.Done():
 			probeTk.Stop()
 			evictTk.Stop()
 			return
@@ -62,7 +67,7 @@ func Tick(lch chan<- *types.ProxyServer) {
 	}
 }
 
-func queryServers(ch chan<- *types.ProxyServer) {
+func queryServers(ctx context.Context, ch chan<- *types.ProxyServer) {
 	log.Debug("collecting servers for local probe...")
 	var list []*types.ProxyServer
 	query := `SELECT 
@@ -82,15 +87,31 @@ func queryServers(ch chan<- *types.ProxyServer) {
 	}
 	log.Debugf("%d stale servers pending for health check (local)", len(list))
 	for _, p := range list {
-		ch <- p
+		select {
+		case ch <- p:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func probe(chjobs <-chan *types.ProxyServer) {
+func probe(ctx context.Context, wgp *sync.WaitGroup, chjobs <-chan *types.ProxyServer) {
 	for i := 0; i < conf.Args.Probe.Size; i++ {
-		time.Sleep(time.Millisecond * 3500)
+		select {
+		case <-time.After(time.Millisecond * 3500):
+		case <-ctx.Done():
+			return
+		}
+		wgp.Add(1)
 		go func() {
-			for ps := range chjobs {
+			defer wgp.Done()
+			for {
+				var ps *types.ProxyServer
+				select {
+				case ps = <-chjobs:
+				case <-ctx.Done():
+					return
+				}
 				var e error
 				now := util.Now()
 				if network.ValidateProxy(ps, conf.Args.Probe.Timeout) {
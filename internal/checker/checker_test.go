@@ -1,6 +1,7 @@
 package checker
 
 import (
+	"context"
 	"strings"
 	"sync"
 	"testing"
@@ -13,7 +14,7 @@ func Test_main(t *testing.T) {
 }
 
 func Test_Check(t *testing.T) {
-	Check(&sync.WaitGroup{})
+	Check(context.Background(), &sync.WaitGroup{})
 }
 
 func Test_ProbeLocal(t *testing.T) {
@@ -21,7 +22,7 @@ func Test_ProbeLocal(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
 	ch <- types.NewProxyServer("GatherProxy", "47.94.220.11", "3128", "http", "")
-	probe(ch)
+	probe(context.Background(), &sync.WaitGroup{}, ch)
 	wg.Wait()
 }
 
@@ -28,6 +28,15 @@ type Arguments struct {
 		HTTPRetry                       int     `mapstructure:"http_retry"`
 		RotateProxyScoreThreshold       float64 `mapstructure:"rotate_proxy_score_threshold"`
 		RotateProxyGlobalScoreThreshold float64 `mapstructure:"rotate_proxy_global_score_threshold"`
+		// TransportCacheSize bounds the number of upstream transports kept for reuse. 0 disables reuse.
+		TransportCacheSize int `mapstructure:"transport_cache_size"`
+		// MaxIdleConns and MaxIdleConnsPerHost limit idle connections kept by each transport.
+		MaxIdleConns        int `mapstructure:"max_idle_conns"`
+		MaxIdleConnsPerHost int `mapstructure:"max_idle_conns_per_host"`
+		// IdleConnTimeout is the seconds an idle connection is kept before closing.
+		IdleConnTimeout int `mapstructure:"idle_conn_timeout"`
+		// ChainViaMaster reaches backend proxies through the master proxy, for proxy servers and checker alike.
+		ChainViaMaster bool `mapstructure:"chain_via_master"`
 	}
 
 	Probe struct {
@@ -59,6 +68,124 @@ type Arguments struct {
 		EvictionTimeout        int     `mapstructure:"eviction_timeout"`
 		EvictionInterval       int     `mapstructure:"eviction_interval"`
 		EvictionScoreThreshold float32 `mapstructure:"eviction_score_threshold"`
+		// SelectionStrategy picks rotated proxies: random, weighted, lru, round_robin, latency or p2c.
+		SelectionStrategy string `mapstructure:"selection_strategy"`
+		// EnableAPI serves the roprox API to requests addressed to the proxy listener itself.
+		// API clients authenticate as proxy users, or must connect from loopback if Auth is disabled.
+		EnableAPI bool `mapstructure:"enable_api"`
+		// MaxClientConns bounds concurrent client connections across listeners. 0 for unlimited.
+		MaxClientConns int `mapstructure:"max_client_conns"`
+		// AdmissionQueueSize bounds connections waiting for a slot when MaxClientConns is reached.
+		AdmissionQueueSize int `mapstructure:"admission_queue_size"`
+		// AdmissionTimeout is the seconds a queued connection waits before being rejected.
+		AdmissionTimeout int `mapstructure:"admission_timeout"`
+		// MaxConnsPerIP bounds concurrent connections from one client IP. 0 for unlimited.
+		MaxConnsPerIP int `mapstructure:"max_conns_per_ip"`
+		// ShutdownTimeout is the seconds to wait for active client connections to finish on shutdown.
+		ShutdownTimeout int `mapstructure:"shutdown_timeout"`
+		// IdleTimeout is the number of seconds to wait for the next request on a persistent client connection.
+		IdleTimeout int `mapstructure:"idle_timeout"`
+		// BodyIdleTimeout is the seconds to wait for each read of an upstream response body. 0 for no limit.
+		BodyIdleTimeout int `mapstructure:"body_idle_timeout"`
+		// InspectionMaxBodySize caps the bytes of each response body captured for inspection. 0 means unlimited.
+		InspectionMaxBodySize int `mapstructure:"inspection_max_body_size"`
+		// Inspection configures how captures are filtered and written.
+		Inspection struct {
+			// QueueSize bounds captures waiting to be written. Captures are dropped while the queue is full.
+			QueueSize int `mapstructure:"queue_size"`
+			// BatchSize is the max captures written in one batch.
+			BatchSize int `mapstructure:"batch_size"`
+			// FlushInterval is the max milliseconds a capture waits for its batch to fill up.
+			FlushInterval int `mapstructure:"flush_interval"`
+			// Include captures only exchanges matching any of the filters. Empty list includes all.
+			Include []CaptureFilterArgs `mapstructure:"include"`
+			// Exclude skips exchanges matching any of the filters.
+			Exclude []CaptureFilterArgs `mapstructure:"exclude"`
+			// MaxAge is the max seconds captures are retained. 0 for unlimited.
+			MaxAge int `mapstructure:"max_age"`
+			// MaxTotalSize is the max bytes of captured bodies retained. Oldest captures are purged beyond it.
+			// 0 for unlimited.
+			MaxTotalSize int64 `mapstructure:"max_total_size"`
+			// MaxRowsPerHost is the max captures retained per target host. 0 for unlimited.
+			MaxRowsPerHost int `mapstructure:"max_rows_per_host"`
+			// PurgeInterval is the seconds between purges of captures beyond the retention limits.
+			PurgeInterval int `mapstructure:"purge_interval"`
+			// BodyStoreDir stores captured bodies in files under the directory, once per distinct content,
+			// instead of the database. Empty to store bodies in the database.
+			BodyStoreDir string `mapstructure:"body_store_dir"`
+			// Redaction masks secrets in captures before they're persisted.
+			Redaction RedactionArgs `mapstructure:"redaction"`
+		} `mapstructure:"inspection"`
+		// RecordWebSocketFrames saves relayed websocket frames along with the inspected handshake.
+		RecordWebSocketFrames bool `mapstructure:"record_websocket_frames"`
+		// ConnectMode determines how CONNECT requests are handled:
+		// "intercept" decrypts every tunnel with per-host certificates (MITM),
+		// "tunnel" relays the raw bytes through the backend proxy except for MITMHosts.
+		ConnectMode string   `mapstructure:"connect_mode"`
+		MITMHosts   []string `mapstructure:"mitm_hosts"`
+		// Socks5Port enables the SOCKS5 listener if greater than 0.
+		// Username/password authentication is required if Socks5User is not empty.
+		Socks5Port     int    `mapstructure:"socks5_port"`
+		Socks5User     string `mapstructure:"socks5_user"`
+		Socks5Password string `mapstructure:"socks5_password"`
+
+		// Auth requires clients to authenticate with one of the users defined here or in the database.
+		Auth struct {
+			Enabled bool            `mapstructure:"enabled"`
+			Users   []ProxyUserArgs `mapstructure:"users"`
+		} `mapstructure:"auth"`
+
+		// Session pins client sessions to one backend proxy until it fails or the session expires.
+		Session struct {
+			Enabled bool `mapstructure:"enabled"`
+			// TTL is the number of idle seconds before a session expires.
+			TTL int `mapstructure:"ttl"`
+			// ClientIP keys sessions by client IP when neither session header nor user suffix is given.
+			ClientIP bool `mapstructure:"client_ip"`
+		} `mapstructure:"session"`
+
+		// Rules route requests by the first matching rule, evaluated in order before routing headers.
+		Rules []RuleArgs `mapstructure:"rules"`
+
+		// PAC configures the proxy auto-config file served at /proxy.pac and /wpad.dat.
+		PAC struct {
+			// Enabled serves the file, regardless of EnableAPI.
+			Enabled bool `mapstructure:"enabled"`
+			// ProxyAddr is the host:port of roprox advertised to clients. Defaults to the address the file is fetched from.
+			ProxyAddr string `mapstructure:"proxy_addr"`
+			// BypassDomains are connected directly by clients without going through roprox.
+			BypassDomains []string `mapstructure:"bypass_domains"`
+		} `mapstructure:"pac"`
+
+		// Rewrites modify matching requests before forwarding and responses before writing back, in order.
+		Rewrites []RewriteArgs `mapstructure:"rewrites"`
+		// RewriteMaxBodySize is the max bytes of a response body substituted by rewrite rules.
+		RewriteMaxBodySize int `mapstructure:"rewrite_max_body_size"`
+
+		// Cache stores responses to GET requests per RFC 9111 in a cache shared by all clients.
+		Cache struct {
+			Enabled bool `mapstructure:"enabled"`
+			// MaxSize bounds the total bytes of cached bodies. Least recently used responses are evicted beyond it.
+			MaxSize int64 `mapstructure:"max_size"`
+			// MaxEntrySize is the max bytes of a cached body. Larger responses are relayed without caching.
+			MaxEntrySize int `mapstructure:"max_entry_size"`
+			// Rules force or disable caching per domain, evaluated in order.
+			Rules []CacheRuleArgs `mapstructure:"rules"`
+		} `mapstructure:"cache"`
+
+		// RateLimits throttle requests per target domain with token buckets. The first limit matching the target applies.
+		RateLimits []RateLimitArgs `mapstructure:"rate_limits"`
+		// RateLimitTimeout is the max seconds a request waits for its rate limit. Requests waiting longer fail with 503.
+		RateLimitTimeout int `mapstructure:"rate_limit_timeout"`
+
+		// Classifiers detect responses denoting the backend proxy is blocked by the target site.
+		Classifiers []ClassifierArgs `mapstructure:"classifiers"`
+		// ClassifierPeekSize is the max bytes of response body examined by body patterns.
+		ClassifierPeekSize int `mapstructure:"classifier_peek_size"`
+		// BanDuration is the seconds a proxy blocked by a domain is not selected for that domain.
+		BanDuration int `mapstructure:"ban_duration"`
+		// DomainCooldown is the seconds a proxy failed on a domain is not selected for that domain. 0 disables cooldown.
+		DomainCooldown int `mapstructure:"domain_cooldown"`
 	}
 
 	WebDriver struct {
@@ -101,6 +228,123 @@ type Arguments struct {
 	}
 }
 
+// ProxyUserArgs defines the credential and policy of an inbound proxy user.
+type ProxyUserArgs struct {
+	Name string `mapstructure:"name"`
+	// Password is either plaintext or a bcrypt hash, e.g. generated by htpasswd -nbB.
+	Password string `mapstructure:"password"`
+	// Modes lists allowed proxy modes (direct, master, rotate). Empty list allows all modes.
+	Modes    []string `mapstructure:"modes"`
+	MaxConns int      `mapstructure:"max_conns"`
+	// Inspection overrides Proxy.EnableInspection for this user if specified.
+	Inspection *bool `mapstructure:"inspection"`
+	// Admin grants access to the API endpoints exporting or replaying captured traffic.
+	Admin bool `mapstructure:"admin"`
+}
+
+// RuleArgs defines a routing rule. The rule matches if the target matches any of the values.
+type RuleArgs struct {
+	// Match is one of domain_suffix, domain_keyword, domain_regex, ip_cidr, dst_port or src_ip.
+	Match  string   `mapstructure:"match"`
+	Values []string `mapstructure:"values"`
+	// Action is one of direct, master, rotate or reject.
+	Action string `mapstructure:"action"`
+	// Countries, Type and MinScore filter rotated proxies.
+	Countries []string `mapstructure:"countries"`
+	Type      string   `mapstructure:"type"`
+	MinScore  float64  `mapstructure:"min_score"`
+}
+
+// CaptureFilterArgs matches exchanges satisfying all of its non-empty criteria.
+type CaptureFilterArgs struct {
+	// Hosts matches the domains and their subdomains.
+	Hosts       []string `mapstructure:"hosts"`
+	Methods     []string `mapstructure:"methods"`
+	StatusCodes []int    `mapstructure:"status_codes"`
+	// MIMETypes matches response media types by prefix, e.g. "text/" or "application/json".
+	MIMETypes []string `mapstructure:"mime_types"`
+	// MaxBodySize overrides InspectionMaxBodySize for exchanges included by the filter.
+	MaxBodySize int `mapstructure:"max_body_size"`
+}
+
+// RedactionArgs defines what's masked in captures. Names match case-insensitively,
+// or by regular expression if enclosed in slashes, e.g. "/(?i)token/".
+type RedactionArgs struct {
+	// Defaults applies the built-in rules for common credentials along with the configured ones.
+	Defaults bool `mapstructure:"defaults"`
+	// Headers of requests and responses.
+	Headers []string `mapstructure:"headers"`
+	// QueryParams of request URLs and URL-encoded form bodies.
+	QueryParams []string `mapstructure:"query_params"`
+	// JSONFields of request and response bodies. Names match fields at any depth, while dotted paths
+	// like "user.password" or "items.*.token" match from the root, with "*" matching any key or index.
+	JSONFields []string `mapstructure:"json_fields"`
+	// Replacement replaces the masked values.
+	Replacement string `mapstructure:"replacement"`
+}
+
+// RewriteArgs defines a rewrite rule applied to requests matching all of its conditions.
+type RewriteArgs struct {
+	// Hosts restricts the rule to the domains and their subdomains. Empty list applies to all.
+	Hosts []string `mapstructure:"hosts"`
+	// Path is a regular expression matched against the URL path. Empty matches all.
+	Path string `mapstructure:"path"`
+	// Methods restricts the rule to the HTTP methods. Empty list applies to all.
+	Methods []string `mapstructure:"methods"`
+	// Phase is either request, applied before forwarding, or response, applied before writing back to the client.
+	Phase string `mapstructure:"phase"`
+	// SetHeaders lists headers to set in "Name: value" form.
+	SetHeaders    []string `mapstructure:"set_headers"`
+	RemoveHeaders []string `mapstructure:"remove_headers"`
+	// ReplaceHeaders substitutes regular expressions in header values.
+	ReplaceHeaders []SubstitutionArgs `mapstructure:"replace_headers"`
+	// URL substitutes a regular expression in the absolute request URL. Request phase only.
+	URL SubstitutionArgs `mapstructure:"url"`
+	// Body substitutes regular expressions in uncompressed text response bodies. Response phase only.
+	Body []SubstitutionArgs `mapstructure:"body"`
+}
+
+// SubstitutionArgs replaces matches of the regular expression Pattern with Replacement,
+// which may refer to submatches as $1. Header names the header to substitute in, if applicable.
+type SubstitutionArgs struct {
+	Header      string `mapstructure:"header"`
+	Pattern     string `mapstructure:"pattern"`
+	Replacement string `mapstructure:"replacement"`
+}
+
+// CacheRuleArgs overrides the caching of responses from the domains and their subdomains.
+type CacheRuleArgs struct {
+	Domains []string `mapstructure:"domains"`
+	// Policy is either force, caching responses for TTL seconds regardless of their cache directives,
+	// or never, bypassing the cache.
+	Policy string `mapstructure:"policy"`
+	TTL    int    `mapstructure:"ttl"`
+}
+
+// RateLimitArgs limits the rate of requests to the domains and their subdomains, which share the buckets.
+type RateLimitArgs struct {
+	// Domains restricts the limit to the domains. Empty list applies to all targets, with buckets per host.
+	Domains []string `mapstructure:"domains"`
+	// Rate is the requests per second to the domain across all backend proxies. 0 for unlimited.
+	Rate float64 `mapstructure:"rate"`
+	// Burst is the requests allowed at once. A burst of 1 spaces requests by 1/Rate seconds.
+	Burst int `mapstructure:"burst"`
+	// ProxyRate and ProxyBurst limit requests to the domain through each backend proxy.
+	ProxyRate  float64 `mapstructure:"proxy_rate"`
+	ProxyBurst int     `mapstructure:"proxy_burst"`
+}
+
+// ClassifierArgs defines markers of a blocked response. Any matching marker classifies the response as blocked.
+type ClassifierArgs struct {
+	// Domains restricts the classifier to the domains and their subdomains. Empty list applies to all.
+	Domains     []string `mapstructure:"domains"`
+	StatusCodes []int    `mapstructure:"status_codes"`
+	// Headers lists header markers, either "Name" for presence or "Name: regex" to match the value.
+	Headers []string `mapstructure:"headers"`
+	// BodyPatterns lists regular expressions matched against the beginning of the response body.
+	BodyPatterns []string `mapstructure:"body_patterns"`
+}
+
 func init() {
 	vp = viper.New()
 	setDefaults()
@@ -135,6 +379,34 @@ func checkConfig() {
 
 func setDefaults() {
 	vp.SetDefault("log_level", "info")
+	vp.SetDefault("Network.transport_cache_size", 256)
+	vp.SetDefault("Network.max_idle_conns", 16)
+	vp.SetDefault("Network.max_idle_conns_per_host", 4)
+	vp.SetDefault("Network.idle_conn_timeout", 90)
+	vp.SetDefault("Proxy.connect_mode", "intercept")
+	vp.SetDefault("Proxy.idle_timeout", 60)
+	vp.SetDefault("Proxy.body_idle_timeout", 60)
+	vp.SetDefault("Proxy.shutdown_timeout", 30)
+	vp.SetDefault("Proxy.admission_queue_size", 128)
+	vp.SetDefault("Proxy.admission_timeout", 10)
+	vp.SetDefault("Proxy.enable_api", false)
+	vp.SetDefault("Proxy.PAC.enabled", true)
+	vp.SetDefault("Proxy.selection_strategy", "random")
+	vp.SetDefault("Proxy.Session.ttl", 600)
+	vp.SetDefault("Proxy.inspection_max_body_size", 1<<20)
+	vp.SetDefault("Proxy.classifier_peek_size", 64<<10)
+	vp.SetDefault("Proxy.rate_limit_timeout", 30)
+	vp.SetDefault("Proxy.rewrite_max_body_size", 4<<20)
+	vp.SetDefault("Proxy.Inspection.queue_size", 1024)
+	vp.SetDefault("Proxy.Inspection.batch_size", 64)
+	vp.SetDefault("Proxy.Inspection.flush_interval", 1000)
+	vp.SetDefault("Proxy.Inspection.purge_interval", 600)
+	vp.SetDefault("Proxy.Inspection.Redaction.defaults", true)
+	vp.SetDefault("Proxy.Inspection.Redaction.replacement", "[REDACTED]")
+	vp.SetDefault("Proxy.Cache.max_size", 256<<20)
+	vp.SetDefault("Proxy.Cache.max_entry_size", 8<<20)
+	vp.SetDefault("Proxy.ban_duration", 3600)
+	vp.SetDefault("Proxy.domain_cooldown", 30)
 	vp.SetDefault("DataSource.SpysOne.proxy_mode", "master")
 	vp.SetDefault("DataSource.SpysOne.headless", true)
 	vp.SetDefault("DataSource.SpysOne.refresh_interval", 60)
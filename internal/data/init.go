@@ -81,6 +81,10 @@ func initSQLite() {
 		&types.ProxyServer{},
 		&types.UserAgent{},
 		&types.NetworkTraffic{},
+		&types.ProxyUser{},
+		&types.WebSocketFrame{},
+		&types.ProxyDomainStat{},
+		&types.CachedResponse{},
 	); err != nil {
 		log.Panicln("GORM auto migrate failure", err)
 	}
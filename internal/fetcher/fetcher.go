@@ -1,16 +1,21 @@
 package fetcher
 
 import (
+	"context"
+
 	"github.com/agux/roprox/internal/fetcher/targets"
 	t "github.com/agux/roprox/internal/types"
 	//shorten type reference
 )
 
 // Fetch proxy server information using the specified fetcher specification,
-// and output to the channel.
-func Fetch(chpx chan<- *t.ProxyServer, fspec t.FetcherSpec) {
+// and output to the channel. Remaining urls are skipped once the context is done.
+func Fetch(ctx context.Context, chpx chan<- *t.ProxyServer, fspec t.FetcherSpec) {
 	urls := fspec.Urls()
 	for i, url := range urls {
-		targets.FetchFor(i, url, chpx, fspec)
+		if ctx.Err() != nil {
+			return
+		}
+		targets.FetchForContext(ctx, i, url, chpx, fspec)
 	}
 }
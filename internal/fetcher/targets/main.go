@@ -27,7 +27,7 @@ import (
 
 var log = logging.Logger
 
-func fetchDynamicHTML(urlIdx int, url string, chpx chan<- *t.ProxyServer, fspec t.FetcherSpec) (c int) {
+func fetchDynamicHTML(parent context.Context, urlIdx int, url string, chpx chan<- *t.ProxyServer, fspec t.FetcherSpec) (c int) {
 	df := fspec.(t.DynamicHTMLFetcher)
 	psmap := make(map[string]*t.ProxyServer)
 
@@ -40,7 +40,7 @@ func fetchDynamicHTML(urlIdx int, url string, chpx chan<- *t.ProxyServer, fspec
 		// create parent context
 		o, rpx := allocatorOptions(fspec)
 		ctx, c := chromedp.NewExecAllocator(
-			context.Background(),
+			parent,
 			o...)
 		defer c()
 		ctx, c = chromedp.NewContext(ctx)
@@ -85,7 +85,7 @@ func fetchDynamicHTML(urlIdx int, url string, chpx chan<- *t.ProxyServer, fspec
 		return
 	}
 
-	e := repeat.Repeat(
+	e := repeat.WithContext(parent).Repeat(
 		repeat.FnWithCounter(op),
 		repeat.StopOnSuccess(),
 		repeat.LimitMaxTries(fspec.Retry()),
@@ -202,14 +202,20 @@ func fetchPlainText(urlIdx int, url string, chpx chan<- *t.ProxyServer, fspec t.
 	return
 }
 
+// FetchFor fetches proxy servers from the url per the fetcher specification and outputs to the channel.
 func FetchFor(urlIdx int, url string, chpx chan<- *t.ProxyServer, fspec t.FetcherSpec) {
+	FetchForContext(context.Background(), urlIdx, url, chpx, fspec)
+}
+
+// FetchForContext works like FetchFor. Browser sessions of dynamic HTML fetchers are canceled once the context is done.
+func FetchForContext(ctx context.Context, urlIdx int, url string, chpx chan<- *t.ProxyServer, fspec t.FetcherSpec) {
 	log.Debugf("fetching proxy server from %s", url)
 	c := 0
 	switch fspec.(type) {
 	case t.StaticHTMLFetcher:
 		c = fetchStaticHTML(urlIdx, url, chpx, fspec)
 	case t.DynamicHTMLFetcher:
-		c = fetchDynamicHTML(urlIdx, url, chpx, fspec)
+		c = fetchDynamicHTML(ctx, urlIdx, url, chpx, fspec)
 	case t.JSONFetcher:
 		c = fetchJSON(urlIdx, url, chpx, fspec)
 	case t.PlainTextFetcher:
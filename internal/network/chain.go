@@ -0,0 +1,50 @@
+package network
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+	"github.com/agux/roprox/internal/util"
+)
+
+// chainFor returns the proxy through which the backend proxy is reached,
+// or nil if the backend proxy is dialed directly.
+func chainFor(ps *types.ProxyServer) *types.ProxyServer {
+	if ps == nil || !conf.Args.Network.ChainViaMaster {
+		return nil
+	}
+	master := util.GetMasterProxy()
+	if master == nil || (master.Host == ps.Host && master.Port == ps.Port) {
+		return nil
+	}
+	return master
+}
+
+// hopDialer dials the next hop of a proxy chain: directly if via is nil, otherwise through via.
+type hopDialer struct {
+	via     *types.ProxyServer
+	timeout time.Duration
+}
+
+func (d hopDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d hopDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.via == nil {
+		return (&net.Dialer{Timeout: d.timeout}).DialContext(ctx, network, addr)
+	}
+	timeout := d.timeout
+	if deadline, ok := ctx.Deadline(); ok && (timeout <= 0 || time.Until(deadline) < timeout) {
+		timeout = time.Until(deadline)
+	}
+	return DialThrough(d.via, addr, timeout)
+}
+
+// dialProxy connects to the backend proxy itself, through the master proxy if chaining is enabled.
+func dialProxy(ps *types.ProxyServer, timeout time.Duration) (net.Conn, error) {
+	return hopDialer{chainFor(ps), timeout}.Dial("tcp", net.JoinHostPort(ps.Host, ps.Port))
+}
@@ -0,0 +1,134 @@
+package network
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+// fakeProxy is an HTTP proxy recording the targets it's asked for.
+type fakeProxy struct {
+	sync.Mutex
+	targets []string
+}
+
+func (p *fakeProxy) record(target string) {
+	p.Lock()
+	defer p.Unlock()
+	p.targets = append(p.targets, target)
+}
+
+func (p *fakeProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		p.record(r.URL.String())
+		res, e := http.DefaultTransport.RoundTrip(r)
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		for k, v := range res.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+		return
+	}
+	p.record(r.Host)
+	upstream, e := net.Dial("tcp", r.Host)
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadGateway)
+		return
+	}
+	client, _, e := w.(http.Hijacker).Hijack()
+	if e != nil {
+		upstream.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go func() {
+		io.Copy(upstream, client)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+func proxyServerOf(t *testing.T, rawURL string) *types.ProxyServer {
+	u, e := url.Parse(rawURL)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return &types.ProxyServer{Type: "http", Host: u.Hostname(), Port: u.Port()}
+}
+
+func TestChainViaMaster(t *testing.T) {
+	network := conf.Args.Network
+	defer func() { conf.Args.Network = network }()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer origin.Close()
+	master, backend := &fakeProxy{}, &fakeProxy{}
+	masterSrv := httptest.NewServer(master)
+	defer masterSrv.Close()
+	backendSrv := httptest.NewServer(backend)
+	defer backendSrv.Close()
+
+	conf.Args.Network.MasterProxyAddr = masterSrv.URL
+	conf.Args.Network.ChainViaMaster = true
+	conf.Args.Network.TransportCacheSize = 0
+	ps := proxyServerOf(t, backendSrv.URL)
+	originAddr := origin.Listener.Addr().String()
+	backendAddr := backendSrv.Listener.Addr().String()
+
+	conn, e := DialThrough(ps, originAddr, 5*time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	conn.Close()
+	if len(master.targets) != 1 || master.targets[0] != backendAddr {
+		t.Errorf("master proxy targets = %v, want [%s]", master.targets, backendAddr)
+	}
+	if len(backend.targets) != 1 || backend.targets[0] != originAddr {
+		t.Errorf("backend proxy targets = %v, want [%s]", backend.targets, originAddr)
+	}
+
+	transport, e := GetTransport(ps, true)
+	if e != nil {
+		t.Fatal(e)
+	}
+	res, e := (&http.Client{Transport: transport}).Get(origin.URL)
+	if e != nil {
+		t.Fatal(e)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want hello", body)
+	}
+	if len(master.targets) != 2 || master.targets[1] != backendAddr {
+		t.Errorf("master proxy targets = %v, want the backend proxy twice", master.targets)
+	}
+	if len(backend.targets) != 2 || backend.targets[1] != origin.URL+"/" {
+		t.Errorf("backend proxy targets = %v, want %s/ last", backend.targets, origin.URL)
+	}
+
+	// the master proxy itself is dialed directly
+	if via := chainFor(proxyServerOf(t, masterSrv.URL)); via != nil {
+		t.Errorf("chainFor(master) = %+v, want nil", via)
+	}
+	conf.Args.Network.ChainViaMaster = false
+	if via := chainFor(ps); via != nil {
+		t.Errorf("chainFor() with chaining disabled = %+v, want nil", via)
+	}
+}
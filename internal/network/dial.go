@@ -0,0 +1,92 @@
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+// DialThrough opens a raw TCP stream to addr (host:port) via the specified backend proxy.
+// HTTP(S) proxies are asked to open a tunnel with the CONNECT method,
+// while SOCKS5 proxies are dialed with remote name resolution.
+// The backend proxy is reached through the master proxy if chaining is enabled.
+// If ps is nil, addr is dialed directly.
+func DialThrough(ps *types.ProxyServer, addr string, timeout time.Duration) (conn net.Conn, e error) {
+	if ps == nil {
+		if conn, e = net.DialTimeout("tcp", addr, timeout); e != nil {
+			e = errors.Wrapf(e, "failed to dial %s directly", addr)
+		}
+		return
+	}
+	proxyAddr := net.JoinHostPort(ps.Host, ps.Port)
+	if strings.HasPrefix(ps.Type, "http") {
+		if conn, e = dialProxy(ps, timeout); e != nil {
+			e = errors.Wrapf(e, "failed to connect proxy [%s]", ps.UrlString())
+			return
+		}
+		var tunnel net.Conn
+		if tunnel, e = connectTunnel(conn, addr, timeout); e != nil {
+			conn.Close()
+			return nil, errors.Wrapf(e, "failed to open tunnel to %s via proxy [%s]", addr, ps.UrlString())
+		}
+		return tunnel, nil
+	}
+	var dialer proxy.Dialer
+	if dialer, e = proxy.SOCKS5("tcp", proxyAddr, nil, hopDialer{chainFor(ps), timeout}); e != nil {
+		e = errors.Wrapf(e, "Error creating SOCKS5 dialer")
+		return
+	}
+	if conn, e = dialer.Dial("tcp", addr); e != nil {
+		e = errors.Wrapf(e, "failed to dial %s via proxy [%s]", addr, ps.UrlString())
+	}
+	return
+}
+
+// connectTunnel issues an HTTP CONNECT request for addr over an established connection
+// to an HTTP proxy and waits for a successful response. It returns the tunneled connection.
+func connectTunnel(conn net.Conn, addr string, timeout time.Duration) (tunnel net.Conn, e error) {
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	if _, e = conn.Write([]byte(req)); e != nil {
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	res, e := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if e != nil {
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.Errorf("proxy responded to CONNECT with %s", res.Status)
+	}
+	// the target may speak first, e.g. SSH or SMTP banners, whose bytes may be buffered already
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads the bytes buffered by r before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
@@ -0,0 +1,43 @@
+package network
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestDialThroughKeepsServerFirstBytes(t *testing.T) {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer l.Close()
+	// the proxy acknowledges CONNECT and relays the banner of the target in the same segment
+	go func() {
+		conn, e := l.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+		if _, e = http.ReadRequest(bufio.NewReader(conn)); e != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\nSSH-2.0-OpenSSH_9.6\r\n"))
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, e := DialThrough(&types.ProxyServer{Type: "http", Host: host, Port: port}, "ssh.test:22", time.Second)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	banner, e := io.ReadAll(conn)
+	if e != nil || string(banner) != "SSH-2.0-OpenSSH_9.6\r\n" {
+		t.Errorf("read %q, %v, want the banner", banner, e)
+	}
+}
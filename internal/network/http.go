@@ -205,14 +205,20 @@ func HTTPGetResponse(link string, headers map[string]string, useMasterProxy, rot
 	return
 }
 
-func GetTransport(ps *types.ProxyServer, insecureSkipVerify bool) (transport *http.Transport, e error) {
+// newTransport creates a transport relaying requests through the proxy. nil proxy denotes direct connection.
+// The proxy is reached through the master proxy if chaining is enabled.
+func newTransport(ps *types.ProxyServer, insecureSkipVerify bool) (transport *http.Transport, e error) {
 	transport = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		MaxIdleConns:        conf.Args.Network.MaxIdleConns,
+		MaxIdleConnsPerHost: conf.Args.Network.MaxIdleConnsPerHost,
+		IdleConnTimeout:     time.Duration(conf.Args.Network.IdleConnTimeout) * time.Second,
 	}
 	if ps == nil {
 		transport.Proxy = nil
 		return
 	}
+	forward := hopDialer{chainFor(ps), time.Duration(conf.Args.Network.HTTPTimeout) * time.Second}
 	if strings.HasPrefix(ps.Type, "http") {
 		var proxyURL *url.URL
 		if proxyURL, e = url.Parse(ps.UrlString()); e != nil {
@@ -220,9 +226,12 @@ func GetTransport(ps *types.ProxyServer, insecureSkipVerify bool) (transport *ht
 			return
 		}
 		transport.Proxy = http.ProxyURL(proxyURL)
+		if forward.via != nil {
+			transport.DialContext = forward.DialContext
+		}
 	} else {
 		var dialer proxy.Dialer
-		if dialer, e = proxy.SOCKS5("tcp", fmt.Sprintf("%s:%s", ps.Host, ps.Port), nil, proxy.Direct); e != nil {
+		if dialer, e = proxy.SOCKS5("tcp", fmt.Sprintf("%s:%s", ps.Host, ps.Port), nil, forward); e != nil {
 			e = errors.Wrapf(e, "Error creating SOCKS5 dialer")
 			return
 		}
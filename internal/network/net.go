@@ -46,7 +46,7 @@ func ValidateProxy(ps *types.ProxyServer, probeTimeout int) bool {
 	port := ps.Port
 	timeout := time.Second * time.Duration(probeTimeout)
 	addr := net.JoinHostPort(host, port)
-	conn, err := net.DialTimeout("tcp", addr, timeout)
+	conn, err := dialProxy(ps, timeout)
 	defer func() {
 		if conn != nil {
 			conn.Close()
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+// transportCache keeps transports per backend proxy so that upstream connections are reused.
+// The least recently used transport is evicted once the cache is full.
+type transportCache struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type transportEntry struct {
+	key       string
+	transport *http.Transport
+}
+
+var transports = &transportCache{
+	entries: make(map[string]*list.Element),
+	lru:     list.New(),
+}
+
+func transportKey(ps *types.ProxyServer, insecureSkipVerify bool) string {
+	key := "direct"
+	if ps != nil {
+		key = ps.UrlString()
+	}
+	return key + "|" + strconv.FormatBool(insecureSkipVerify)
+}
+
+// GetTransport returns the transport relaying requests through the proxy, reusing the cached one if any.
+// nil proxy denotes direct connection.
+func GetTransport(ps *types.ProxyServer, insecureSkipVerify bool) (transport *http.Transport, e error) {
+	size := conf.Args.Network.TransportCacheSize
+	if size <= 0 {
+		if transport, e = newTransport(ps, insecureSkipVerify); e == nil {
+			// nobody would close idle connections of a throwaway transport
+			transport.DisableKeepAlives = true
+		}
+		return
+	}
+	key := transportKey(ps, insecureSkipVerify)
+	if transport = transports.get(key); transport != nil {
+		return
+	}
+	if transport, e = newTransport(ps, insecureSkipVerify); e != nil {
+		return
+	}
+	return transports.put(key, transport, size), nil
+}
+
+// DropTransport removes the transports of the proxy from the cache and closes their idle connections.
+// In-flight requests are not affected.
+func DropTransport(ps *types.ProxyServer) {
+	if ps == nil {
+		return
+	}
+	for _, insecure := range []bool{true, false} {
+		transports.remove(transportKey(ps, insecure))
+	}
+}
+
+func (c *transportCache) get(key string) *http.Transport {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*transportEntry).transport
+	}
+	return nil
+}
+
+// put caches the transport unless another one was cached for the key concurrently, which is returned instead.
+func (c *transportCache) put(key string, transport *http.Transport, size int) *http.Transport {
+	c.Lock()
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.Unlock()
+		return el.Value.(*transportEntry).transport
+	}
+	c.entries[key] = c.lru.PushFront(&transportEntry{key, transport})
+	var evicted []*http.Transport
+	for c.lru.Len() > size {
+		entry := c.lru.Remove(c.lru.Back()).(*transportEntry)
+		delete(c.entries, entry.key)
+		evicted = append(evicted, entry.transport)
+	}
+	c.Unlock()
+	for _, t := range evicted {
+		t.CloseIdleConnections()
+	}
+	return transport
+}
+
+func (c *transportCache) remove(key string) {
+	c.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.Unlock()
+	if ok {
+		el.Value.(*transportEntry).transport.CloseIdleConnections()
+	}
+}
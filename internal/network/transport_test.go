@@ -0,0 +1,38 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestGetTransportReuse(t *testing.T) {
+	size := conf.Args.Network.TransportCacheSize
+	conf.Args.Network.TransportCacheSize = 2
+	defer func() { conf.Args.Network.TransportCacheSize = size }()
+
+	a := &types.ProxyServer{Type: "http", Host: "10.0.0.1", Port: "8080"}
+	b := &types.ProxyServer{Type: "socks5", Host: "10.0.0.2", Port: "1080"}
+	c := &types.ProxyServer{Type: "http", Host: "10.0.0.3", Port: "3128"}
+
+	ta, _ := GetTransport(a, true)
+	if again, _ := GetTransport(a, true); again != ta {
+		t.Error("transport of the same proxy shall be reused")
+	}
+	if other, _ := GetTransport(a, false); other == ta {
+		t.Error("transports with different TLS settings shall not be shared")
+	}
+	// a is evicted as the least recently used
+	GetTransport(b, true)
+	GetTransport(c, true)
+	if again, _ := GetTransport(a, true); again == ta {
+		t.Error("evicted transport shall not be reused")
+	}
+
+	tc, _ := GetTransport(c, true)
+	DropTransport(c)
+	if again, _ := GetTransport(c, true); again == tc {
+		t.Error("dropped transport shall not be reused")
+	}
+}
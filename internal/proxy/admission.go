@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/pkg/errors"
+)
+
+var (
+	errSaturated = errors.New("server is saturated")
+	errIPLimit   = errors.New("too many connections from the client IP")
+)
+
+// admission bounds concurrent client connections across all listeners.
+// Connections beyond the limit wait in a bounded queue for a free slot until timeout.
+type admission struct {
+	// slots is nil if concurrent connections are unlimited.
+	slots    chan struct{}
+	maxQueue int32
+	queued   atomic.Int32
+	timeout  time.Duration
+	maxPerIP int
+	sync.Mutex
+	perIP map[string]int
+}
+
+var admissions = newAdmission(
+	conf.Args.Proxy.MaxClientConns,
+	conf.Args.Proxy.AdmissionQueueSize,
+	time.Duration(conf.Args.Proxy.AdmissionTimeout)*time.Second,
+	conf.Args.Proxy.MaxConnsPerIP,
+)
+
+func newAdmission(maxConns, maxQueue int, timeout time.Duration, maxPerIP int) *admission {
+	a := &admission{
+		maxQueue: int32(maxQueue),
+		timeout:  timeout,
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+	if maxConns > 0 {
+		a.slots = make(chan struct{}, maxConns)
+	}
+	return a
+}
+
+// admit reserves a connection slot for the client IP, waiting in the queue if necessary.
+// The returned function releases the slot.
+func (a *admission) admit(ip string) (release func(), e error) {
+	if a.maxPerIP > 0 {
+		a.Lock()
+		if a.perIP[ip] >= a.maxPerIP {
+			a.Unlock()
+			return nil, errIPLimit
+		}
+		a.perIP[ip]++
+		a.Unlock()
+	}
+	releaseIP := func() {
+		if a.maxPerIP <= 0 {
+			return
+		}
+		a.Lock()
+		defer a.Unlock()
+		if a.perIP[ip]--; a.perIP[ip] <= 0 {
+			delete(a.perIP, ip)
+		}
+	}
+	if a.slots == nil {
+		return releaseIP, nil
+	}
+
+	releaseSlot := func() {
+		<-a.slots
+		releaseIP()
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return releaseSlot, nil
+	default:
+	}
+	if a.queued.Add(1) > a.maxQueue {
+		a.queued.Add(-1)
+		releaseIP()
+		return nil, errSaturated
+	}
+	defer a.queued.Add(-1)
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return releaseSlot, nil
+	case <-timer.C:
+		releaseIP()
+		return nil, errSaturated
+	}
+}
+
+// serveAdmitted handles the client connection once admitted, or rejects it.
+func serveAdmitted(client net.Conn, handle func(net.Conn), reject func(net.Conn, error)) {
+	ip, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+	release, e := admissions.admit(ip)
+	if e != nil {
+		log.Warnf("rejected connection from %s: %+v", client.RemoteAddr(), e)
+		reject(client, e)
+		client.Close()
+		return
+	}
+	defer release()
+	if !clients.add(client) {
+		client.Close()
+		return
+	}
+	defer clients.remove(client)
+	handle(client)
+}
+
+// rejectHTTP responds 503 Service Unavailable if the server is saturated, or 429 Too Many Requests
+// if the client IP exceeds its limit.
+func rejectHTTP(client net.Conn, e error) {
+	status := http.StatusServiceUnavailable
+	if e == errIPLimit {
+		status = http.StatusTooManyRequests
+	}
+	cw := NewConnResponseWriter(client)
+	cw.close = true
+	cw.Header().Set("Retry-After", "1")
+	http.Error(cw, e.Error(), status)
+}
+
+// acceptLoop accepts connections until the listener is closed, handling each in a new goroutine.
+// Accept errors are retried with exponential backoff.
+func acceptLoop(listener net.Listener, handle func(net.Conn)) {
+	const maxDelay = time.Second
+	var delay time.Duration
+	for {
+		client, e := listener.Accept()
+		if e != nil {
+			if errors.Is(e, net.ErrClosed) {
+				return
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+			log.Errorf("Error accepting connection on %s, retrying in %v: %v", listener.Addr(), delay, e)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go handle(client)
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(1, 1, 50*time.Millisecond, 0)
+
+	release, e := a.admit("10.0.0.1")
+	if e != nil {
+		t.Fatalf("admit() unexpected error: %v", e)
+	}
+
+	// the queued connection gets the slot once it's released
+	admitted := make(chan error, 1)
+	go func() {
+		r, e := a.admit("10.0.0.2")
+		if e == nil {
+			defer r()
+		}
+		admitted <- e
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, e := a.admit("10.0.0.3"); e != errSaturated {
+		t.Errorf("admit() beyond queue size error = %v, want %v", e, errSaturated)
+	}
+	release()
+	if e := <-admitted; e != nil {
+		t.Errorf("queued admit() error = %v, want nil", e)
+	}
+
+	// the queued connection times out if the slot isn't released
+	release, _ = a.admit("10.0.0.1")
+	defer release()
+	start := time.Now()
+	if _, e := a.admit("10.0.0.2"); e != errSaturated || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("admit() error = %v after %v, want %v after timeout", e, time.Since(start), errSaturated)
+	}
+}
+
+func TestAdmissionPerIP(t *testing.T) {
+	a := newAdmission(0, 0, 0, 2)
+	r1, _ := a.admit("10.0.0.1")
+	r2, _ := a.admit("10.0.0.1")
+	if _, e := a.admit("10.0.0.1"); e != errIPLimit {
+		t.Errorf("admit() error = %v, want %v", e, errIPLimit)
+	}
+	if r, e := a.admit("10.0.0.2"); e != nil {
+		t.Errorf("admit() from another IP error = %v", e)
+	} else {
+		r()
+	}
+	r1()
+	r2()
+	if len(a.perIP) != 0 {
+		t.Errorf("per-IP counts %v not released", a.perIP)
+	}
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+const (
+	// maxAPIBodySize bounds the request bodies posted to the API, e.g. HAR documents.
+	maxAPIBodySize = 32 << 20
+	// maxAPIHAREntries bounds the entries of HAR documents posted to the API for import or replay.
+	maxAPIHAREntries = 5000
+)
+
+// apiUserKey is the request context key of the authenticated API user.
+type apiUserKey struct{}
+
+// apiMux serves requests addressed to roprox itself rather than relayed to the targets.
+var apiMux = http.NewServeMux()
+
+func init() {
+	apiMux.HandleFunc("/roprox/sessions", handleSessions)
+	apiMux.HandleFunc("/roprox/blocks", handleBlocks)
+	apiMux.HandleFunc("/roprox/inspection", handleInspection)
+	apiMux.HandleFunc("/roprox/har", handleHAR)
+	apiMux.HandleFunc("/roprox/replay", handleReplay)
+	apiMux.HandleFunc("/proxy.pac", handlePAC)
+	apiMux.HandleFunc("/wpad.dat", handlePAC)
+}
+
+// isLocalRequest returns whether the request is addressed to roprox itself.
+// Proxy clients always send absolute URIs in the request line, except for CONNECT.
+func isLocalRequest(req *http.Request) bool {
+	return req.Method != http.MethodConnect && !req.URL.IsAbs()
+}
+
+// publicPaths are served without authentication, as clients fetch them before being configured with credentials.
+var publicPaths = map[string]bool{
+	"/proxy.pac": true,
+	"/wpad.dat":  true,
+}
+
+// servesLocally returns whether the request is served by roprox itself: the proxy auto-config file
+// if it's enabled, and the API if it's enabled.
+func servesLocally(req *http.Request) bool {
+	if !isLocalRequest(req) {
+		return false
+	}
+	if publicPaths[req.URL.Path] {
+		return conf.Args.Proxy.PAC.Enabled
+	}
+	return conf.Args.Proxy.EnableAPI
+}
+
+// serveLocal serves the local request with the API handlers once the client is authenticated.
+// The connection is closed afterwards.
+func serveLocal(conn net.Conn, req *http.Request) {
+	cw := NewConnResponseWriter(conn)
+	cw.close = true
+	defer cw.finish()
+	if !publicPaths[req.URL.Path] {
+		u, ok := authenticateAPI(req)
+		if !ok {
+			cw.Header().Set("WWW-Authenticate", `Basic realm="roprox"`)
+			http.Error(cw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), apiUserKey{}, u))
+	}
+	apiMux.ServeHTTP(cw, req)
+}
+
+// requireAdmin responds with 403 Forbidden unless the API user is an admin. Without proxy authentication,
+// loopback clients are admins.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !authRequired() {
+		return true
+	}
+	if u := apiUser(r); u != nil && u.admin {
+		return true
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
+// apiUser returns the authenticated user of the API request, nil if authentication is disabled.
+func apiUser(r *http.Request) *proxyUser {
+	u, _ := r.Context().Value(apiUserKey{}).(*proxyUser)
+	return u
+}
+
+// writeJSON responds with v encoded in JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if e := json.NewEncoder(w).Encode(v); e != nil {
+		log.Warn("failed to write API response: ", e)
+	}
+}
+
+// handleSessions lists the active sticky sessions and their backend proxies.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, sessions.list())
+}
+
+// handleBlocks lists the backend proxies currently banned per domain.
+func handleBlocks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	infos, e := reputation.blocks()
+	if e != nil {
+		log.Errorln("failed to list proxy bans", e)
+		http.Error(w, e.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, infos)
+}
+
+// handleInspection reports the traffic inspection queue, including captures dropped while it was full.
+func handleInspection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, inspections.stats())
+}
+
+// handleHAR exports the captured network traffic selected by the query parameters as HAR on GET,
+// and imports the HAR document in the request body on POST. It's restricted to admins.
+func handleHAR(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		f, e := ParseTrafficFilter(r.URL.Query())
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="roprox.har"`)
+		w.WriteHeader(http.StatusOK)
+		if _, e = ExportHAR(w, f); e != nil {
+			log.Warn("failed to export HAR: ", e)
+		}
+	case http.MethodPost:
+		n, e := ImportHAR(http.MaxBytesReader(w, r.Body, maxAPIBodySize), maxAPIHAREntries)
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]int{"imported": n})
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReplay replays the network_traffic records of the id query parameters, or the HAR document
+// in the request body, through the proxy query parameter if specified, and lists the response diffs.
+// It's restricted to admins, whose allowed proxy modes apply.
+func handleReplay(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	var nts []*types.NetworkTraffic
+	var e error
+	if ids := q["id"]; len(ids) > 0 {
+		var parsed []uint
+		for _, v := range ids {
+			id, e := strconv.ParseUint(v, 10, 0)
+			if e != nil {
+				http.Error(w, "invalid id "+strconv.Quote(v), http.StatusBadRequest)
+				return
+			}
+			parsed = append(parsed, uint(id))
+		}
+		nts, e = loadTraffic(parsed)
+	} else {
+		nts, e = readHAR(http.MaxBytesReader(w, r.Body, maxAPIBodySize), maxAPIHAREntries)
+	}
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	results, e := replayAs(apiUser(r), nts, q.Get("proxy"))
+	if e != nil {
+		http.Error(w, e.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, results)
+}
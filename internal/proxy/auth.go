@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// proxyUser is the in-memory representation of an inbound proxy user and its policy.
+type proxyUser struct {
+	name string
+	// password is a bcrypt hash, or the plaintext password of a user defined in the configuration file.
+	password   string
+	modes      []types.ProxyMode
+	maxConns   int
+	inspection *bool
+	admin      bool
+	// verified is the digest of the password that last matched the hash,
+	// sparing bcrypt on every request of the user.
+	verified atomic.Pointer[[sha256.Size]byte]
+}
+
+// passwordCost is the bcrypt cost of hashed passwords.
+var passwordCost = bcrypt.DefaultCost
+
+// isPasswordHash returns whether the password is a bcrypt hash.
+func isPasswordHash(password string) bool {
+	_, e := bcrypt.Cost([]byte(password))
+	return e == nil
+}
+
+// hashPassword returns the bcrypt hash of the password.
+func hashPassword(password string) (string, error) {
+	hash, e := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(hash), e
+}
+
+// verify returns whether the password matches the user's.
+func (u *proxyUser) verify(password string) bool {
+	if !isPasswordHash(u.password) {
+		return subtle.ConstantTimeCompare([]byte(u.password), []byte(password)) == 1
+	}
+	digest := sha256.Sum256([]byte(u.password + "\x00" + password))
+	if v := u.verified.Load(); v != nil && subtle.ConstantTimeCompare(v[:], digest[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.password), []byte(password)) != nil {
+		return false
+	}
+	u.verified.Store(&digest)
+	return true
+}
+
+// allows returns whether the user is allowed to use the specified proxy mode.
+func (u *proxyUser) allows(mode types.ProxyMode) bool {
+	if u == nil || len(u.modes) == 0 {
+		return true
+	}
+	for _, m := range u.modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// inspect returns whether traffic of this user shall be inspected.
+func (u *proxyUser) inspect() bool {
+	if u == nil || u.inspection == nil {
+		return conf.Args.Proxy.EnableInspection
+	}
+	return *u.inspection
+}
+
+type proxyUserStore struct {
+	sync.RWMutex
+	users      map[string]*proxyUser
+	lastLoaded time.Time
+	// active connection count per user name, kept apart from users to survive reloads.
+	active map[string]int
+}
+
+var userStore = &proxyUserStore{
+	active: make(map[string]int),
+}
+
+// load merges users defined in the configuration file with those in the database.
+// Database records take precedence over configuration entries of the same name.
+// Passwords in the database are bcrypt hashes; plaintext ones left by earlier versions are hashed in place.
+func (s *proxyUserStore) load() {
+	users := make(map[string]*proxyUser)
+	for _, cu := range conf.Args.Proxy.Auth.Users {
+		u := &proxyUser{
+			name:       cu.Name,
+			password:   cu.Password,
+			maxConns:   cu.MaxConns,
+			inspection: cu.Inspection,
+			admin:      cu.Admin,
+		}
+		var ok bool
+		if u.modes, ok = parseModes(u.name, cu.Modes); !ok {
+			continue
+		}
+		users[u.name] = u
+	}
+
+	var records []types.ProxyUser
+	if e := data.GormDB.Find(&records).Error; e != nil {
+		log.Errorln("failed to load proxy users from database", e)
+	}
+	for _, r := range records {
+		if !isPasswordHash(r.Password) {
+			hash, e := hashPassword(r.Password)
+			if e != nil {
+				log.Errorf("failed to hash password of proxy user %s: %+v", r.Name, e)
+				continue
+			}
+			if e = data.GormDB.Model(&r).Update("password", hash).Error; e != nil {
+				log.Errorf("failed to store hashed password of proxy user %s: %+v", r.Name, e)
+			}
+			r.Password = hash
+		}
+		u := &proxyUser{
+			name:       r.Name,
+			password:   r.Password,
+			maxConns:   r.MaxConns,
+			inspection: r.Inspection,
+			admin:      r.Admin,
+		}
+		var ok bool
+		if u.modes, ok = parseModes(u.name, strings.Split(r.Modes, ",")); !ok {
+			continue
+		}
+		users[u.name] = u
+	}
+
+	s.Lock()
+	s.users = users
+	s.lastLoaded = time.Now()
+	s.Unlock()
+}
+
+// parseModes parses the proxy modes allowed to the user. Unknown modes are logged and dropped.
+// The user is rejected if none of the specified modes is valid, lest it be allowed every mode.
+func parseModes(user string, modes []string) (parsed []types.ProxyMode, ok bool) {
+	specified := false
+	for _, m := range modes {
+		if m = strings.ToLower(strings.TrimSpace(m)); m == "" {
+			continue
+		}
+		specified = true
+		switch mode := types.ProxyMode(m); mode {
+		case types.Direct, types.MasterProxy, types.RotateProxy:
+			parsed = append(parsed, mode)
+		default:
+			log.Errorf("proxy user %s: ignoring unknown proxy mode %q", user, m)
+		}
+	}
+	if specified && len(parsed) == 0 {
+		log.Errorf("proxy user %s is disabled: no valid proxy mode", user)
+		return nil, false
+	}
+	return parsed, true
+}
+
+// authenticate returns the user matching the credential, reloading stale user data beforehand.
+func (s *proxyUserStore) authenticate(name, password string) *proxyUser {
+	s.RLock()
+	stale := time.Since(s.lastLoaded) > time.Duration(conf.Args.Proxy.MemCacheLifespan)*time.Second
+	s.RUnlock()
+	if stale {
+		s.load()
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	u, ok := s.users[name]
+	if !ok || !u.verify(password) {
+		return nil
+	}
+	return u
+}
+
+// acquire reserves a connection slot for the user.
+// It returns false if the user has reached its max concurrent connections.
+func (s *proxyUserStore) acquire(u *proxyUser) bool {
+	if u == nil {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	if u.maxConns > 0 && s.active[u.name] >= u.maxConns {
+		return false
+	}
+	s.active[u.name]++
+	return true
+}
+
+// release frees the connection slot reserved by acquire.
+func (s *proxyUserStore) release(u *proxyUser) {
+	if u == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.active[u.name]--; s.active[u.name] <= 0 {
+		delete(s.active, u.name)
+	}
+}
+
+// authRequired returns whether inbound clients must authenticate.
+func authRequired() bool {
+	return conf.Args.Proxy.Auth.Enabled
+}
+
+// authenticateRequest validates the Basic credential in the Proxy-Authorization header.
+// The header is removed from the request so that it's never relayed to backend proxies.
+// The user name may carry a sticky session suffix, which is returned as session.
+func authenticateRequest(req *http.Request) (u *proxyUser, session string, ok bool) {
+	header := req.Header.Get("Proxy-Authorization")
+	req.Header.Del("Proxy-Authorization")
+	if !authRequired() {
+		return nil, "", true
+	}
+	name, password, found := basicCredential(header)
+	if !found {
+		return nil, "", false
+	}
+	name, session = splitSessionUser(name)
+	if u = userStore.authenticate(name, password); u == nil {
+		return nil, "", false
+	}
+	return u, session, true
+}
+
+// authenticateAPI authenticates the client of a request addressed to roprox itself by the Basic credential
+// in the Authorization or Proxy-Authorization header. Without proxy authentication, only loopback clients
+// are allowed.
+func authenticateAPI(req *http.Request) (u *proxyUser, ok bool) {
+	if !authRequired() {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		ip := net.ParseIP(host)
+		return nil, ip != nil && ip.IsLoopback()
+	}
+	header := req.Header.Get("Authorization")
+	if header == "" {
+		header = req.Header.Get("Proxy-Authorization")
+	}
+	req.Header.Del("Proxy-Authorization")
+	name, password, found := basicCredential(header)
+	if !found {
+		return nil, false
+	}
+	name, _ = splitSessionUser(name)
+	if u = userStore.authenticate(name, password); u == nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// basicCredential decodes the user name and password of the Basic authorization header.
+func basicCredential(header string) (name, password string, ok bool) {
+	scheme, credential, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return
+	}
+	decoded, e := base64.StdEncoding.DecodeString(strings.TrimSpace(credential))
+	if e != nil {
+		return
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// requireAuthentication responds with 407 Proxy Authentication Required.
+func requireAuthentication(cw *ConnResponseWriter) {
+	cw.Header().Set("Proxy-Authenticate", `Basic realm="roprox"`)
+	http.Error(cw, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticateRequest(t *testing.T) {
+	auth := conf.Args.Proxy.Auth
+	defer func() {
+		conf.Args.Proxy.Auth = auth
+		userStore.load()
+	}()
+	conf.Args.Proxy.Auth.Enabled = true
+	conf.Args.Proxy.Auth.Users = []conf.ProxyUserArgs{
+		{Name: "crawler", Password: "secret", Modes: []string{"master"}, MaxConns: 1},
+	}
+	userStore.load()
+
+	tests := []struct {
+		name   string
+		header string
+		wantOk bool
+	}{
+		{"valid credential", "Basic Y3Jhd2xlcjpzZWNyZXQ=", true},
+		{"wrong password", "Basic Y3Jhd2xlcjp3cm9uZw==", false},
+		{"unsupported scheme", "Bearer Y3Jhd2xlcjpzZWNyZXQ=", false},
+		{"missing header", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			if tt.header != "" {
+				req.Header.Set("Proxy-Authorization", tt.header)
+			}
+			u, _, ok := authenticateRequest(req)
+			if ok != tt.wantOk {
+				t.Fatalf("authenticateRequest() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if req.Header.Get("Proxy-Authorization") != "" {
+				t.Error("Proxy-Authorization shall be removed from the request")
+			}
+			if !ok {
+				return
+			}
+			if rt := defaultRoute(u); rt.mode != types.MasterProxy {
+				t.Errorf("defaultRoute() mode = %v, want %v", rt.mode, types.MasterProxy)
+			}
+			if !userStore.acquire(u) {
+				t.Fatal("first connection shall be admitted")
+			}
+			if userStore.acquire(u) {
+				t.Error("second connection shall exceed max_conns")
+			}
+			userStore.release(u)
+		})
+	}
+}
+
+func TestServeLocal(t *testing.T) {
+	auth := conf.Args.Proxy.Auth
+	defer func() {
+		conf.Args.Proxy.Auth = auth
+		userStore.load()
+	}()
+	conf.Args.Proxy.Auth.Users = []conf.ProxyUserArgs{
+		{Name: "crawler", Password: "secret"},
+		{Name: "admin", Password: "secret", Admin: true},
+	}
+	userStore.load()
+
+	tests := []struct {
+		name       string
+		auth       bool
+		remoteAddr string
+		path       string
+		header     string
+		want       int
+	}{
+		{"loopback without auth", false, "127.0.0.1:5000", "/roprox/sessions", "", http.StatusOK},
+		{"remote without auth", false, "192.168.1.10:5000", "/roprox/sessions", "", http.StatusUnauthorized},
+		{"missing credential", true, "127.0.0.1:5000", "/roprox/sessions", "", http.StatusUnauthorized},
+		{"wrong password", true, "127.0.0.1:5000", "/roprox/sessions", "Basic Y3Jhd2xlcjp3cm9uZw==", http.StatusUnauthorized},
+		{"valid credential", true, "192.168.1.10:5000", "/roprox/sessions", "Basic Y3Jhd2xlcjpzZWNyZXQ=", http.StatusOK},
+		{"public path", true, "192.168.1.10:5000", "/proxy.pac", "", http.StatusOK},
+		{"admin path", true, "192.168.1.10:5000", "/roprox/har", "Basic Y3Jhd2xlcjpzZWNyZXQ=", http.StatusForbidden},
+		{"admin path as admin", true, "192.168.1.10:5000", "/roprox/har?limit=1", "Basic YWRtaW46c2VjcmV0", http.StatusOK},
+		{"admin path on loopback", false, "127.0.0.1:5000", "/roprox/har?limit=1", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Args.Proxy.Auth.Enabled = tt.auth
+			u, _ := url.Parse(tt.path)
+			req, _ := http.NewRequest(http.MethodGet, tt.path, nil)
+			req.URL = u
+			req.Host = "roprox.test:8080"
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			server, client := net.Pipe()
+			go func() {
+				serveLocal(server, req)
+				server.Close()
+			}()
+			res, e := http.ReadResponse(bufio.NewReader(client), req)
+			if e != nil {
+				t.Fatal(e)
+			}
+			io.Copy(io.Discard, res.Body)
+			client.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	auth := conf.Args.Proxy.Auth
+	defer func() {
+		conf.Args.Proxy.Auth = auth
+		data.GormDB.Unscoped().Where("name = ?", "legacy").Delete(&types.ProxyUser{})
+		userStore.load()
+	}()
+	cost := passwordCost
+	defer func() { passwordCost = cost }()
+	passwordCost = bcrypt.MinCost
+	hash, e := hashPassword("secret")
+	if e != nil {
+		t.Fatal(e)
+	}
+	conf.Args.Proxy.Auth.Users = []conf.ProxyUserArgs{{Name: "hashed", Password: hash}}
+	if e = data.GormDB.Create(&types.ProxyUser{Name: "legacy", Password: "plain"}).Error; e != nil {
+		t.Fatal(e)
+	}
+	userStore.load()
+
+	for _, tt := range []struct{ name, password string }{{"hashed", "secret"}, {"legacy", "plain"}} {
+		// the second time is verified by the cached digest
+		for i := 0; i < 2; i++ {
+			if userStore.authenticate(tt.name, tt.password) == nil {
+				t.Errorf("%s shall authenticate with the right password", tt.name)
+			}
+		}
+		if userStore.authenticate(tt.name, "wrong") != nil {
+			t.Errorf("%s shall not authenticate with a wrong password", tt.name)
+		}
+	}
+	var legacy types.ProxyUser
+	data.GormDB.Where("name = ?", "legacy").First(&legacy)
+	if !isPasswordHash(legacy.Password) {
+		t.Errorf("legacy password = %q, want it hashed in place", legacy.Password)
+	}
+}
+
+func TestLoadUserModes(t *testing.T) {
+	auth := conf.Args.Proxy.Auth
+	defer func() {
+		conf.Args.Proxy.Auth = auth
+		userStore.load()
+	}()
+	conf.Args.Proxy.Auth.Users = []conf.ProxyUserArgs{
+		{Name: "partial", Password: "x", Modes: []string{" Rotate", "bogus"}},
+		{Name: "invalid", Password: "x", Modes: []string{"bogus"}},
+		{Name: "any", Password: "x"},
+	}
+	userStore.load()
+
+	userStore.Lock()
+	defer userStore.Unlock()
+	if u := userStore.users["partial"]; u == nil || len(u.modes) != 1 || u.modes[0] != types.RotateProxy {
+		t.Errorf("partial user = %+v, want only the rotate mode", u)
+	}
+	if u := userStore.users["invalid"]; u != nil {
+		t.Errorf("user without valid modes shall be rejected, got %+v", u)
+	}
+	if u := userStore.users["any"]; u == nil || len(u.modes) != 0 {
+		t.Errorf("user without modes = %+v, want all modes allowed", u)
+	}
+}
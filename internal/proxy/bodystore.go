@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+)
+
+// bodyStoreGrace protects recently written bodies from collection, as the captures referencing them
+// may still be on their way to the database.
+const bodyStoreGrace = 10 * time.Minute
+
+// bodyStore keeps captured bodies in files named by their SHA-256 digest, so that identical bodies
+// are stored once. A nil store keeps bodies in the database.
+type bodyStore struct {
+	dir string
+}
+
+var bodies = newBodyStore(conf.Args.Proxy.Inspection.BodyStoreDir)
+
+func newBodyStore(dir string) *bodyStore {
+	if dir == "" {
+		return nil
+	}
+	return &bodyStore{dir: dir}
+}
+
+// path shards the files by the first byte of the digest.
+func (s *bodyStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// put stores the body unless it's stored already, and returns its digest.
+func (s *bodyStore) put(body []byte) (hash string, e error) {
+	sum := sha256.Sum256(body)
+	hash = hex.EncodeToString(sum[:])
+	p := s.path(hash)
+	// refreshing the modification time of a stored body protects it from collection
+	now := time.Now()
+	if e = os.Chtimes(p, now, now); e == nil || !errors.Is(e, fs.ErrNotExist) {
+		return
+	}
+	if e = os.MkdirAll(filepath.Dir(p), 0o755); e != nil {
+		return "", errors.Wrap(e, "failed to create body store directory")
+	}
+	tmp, e := os.CreateTemp(filepath.Dir(p), ".tmp-")
+	if e != nil {
+		return "", errors.Wrap(e, "failed to create body file")
+	}
+	defer os.Remove(tmp.Name())
+	_, e = tmp.Write(body)
+	if ce := tmp.Close(); e == nil {
+		e = ce
+	}
+	if e != nil {
+		return "", errors.Wrap(e, "failed to write body file")
+	}
+	// the rename is atomic, so that readers never see partial bodies
+	if e = os.Rename(tmp.Name(), p); e != nil {
+		return "", errors.Wrap(e, "failed to write body file")
+	}
+	return
+}
+
+// offload moves the bodies of the capture into the store. Bodies that fail to be stored are kept in the capture.
+func (s *bodyStore) offload(nt *types.NetworkTraffic) (e error) {
+	if s == nil {
+		return
+	}
+	if len(nt.RequestBody) > 0 {
+		if nt.RequestBodyHash, e = s.put(nt.RequestBody); e != nil {
+			return
+		}
+		nt.RequestBody = nil
+	}
+	if len(nt.ResponseBody) > 0 {
+		if nt.ResponseBodyHash, e = s.put(nt.ResponseBody); e != nil {
+			return
+		}
+		nt.ResponseBody = nil
+	}
+	return
+}
+
+// load restores the bodies of the capture offloaded into the store.
+func (s *bodyStore) load(nt *types.NetworkTraffic) (e error) {
+	if nt.RequestBodyHash == "" && nt.ResponseBodyHash == "" {
+		return
+	}
+	if s == nil {
+		return errors.Errorf("bodies of network traffic #%d are offloaded but body_store_dir is not set", nt.ID)
+	}
+	if nt.RequestBodyHash != "" {
+		if nt.RequestBody, e = os.ReadFile(s.path(nt.RequestBodyHash)); e != nil {
+			return errors.Wrapf(e, "failed to load request body of network traffic #%d", nt.ID)
+		}
+	}
+	if nt.ResponseBodyHash != "" {
+		if nt.ResponseBody, e = os.ReadFile(s.path(nt.ResponseBodyHash)); e != nil {
+			return errors.Wrapf(e, "failed to load response body of network traffic #%d", nt.ID)
+		}
+	}
+	return
+}
+
+// collect removes the bodies no longer referenced by any capture, except those written within bodyStoreGrace.
+func (s *bodyStore) collect() (removed int, e error) {
+	if s == nil {
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, column := range []string{"request_body_hash", "response_body_hash"} {
+		var hashes []string
+		if e = data.GormDB.Unscoped().Model(&types.NetworkTraffic{}).Distinct(column).
+			Where(column+" <> ''").Pluck(column, &hashes).Error; e != nil {
+			return 0, errors.Wrap(e, "failed to query referenced bodies")
+		}
+		for _, h := range hashes {
+			referenced[h] = true
+		}
+	}
+	threshold := time.Now().Add(-bodyStoreGrace)
+	e = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, e error) error {
+		if e != nil {
+			if errors.Is(e, fs.ErrNotExist) {
+				return nil
+			}
+			return e
+		}
+		if d.IsDir() || referenced[d.Name()] {
+			return nil
+		}
+		info, e := d.Info()
+		if e != nil || info.ModTime().After(threshold) {
+			return nil
+		}
+		if e = os.Remove(path); e != nil && !errors.Is(e, fs.ErrNotExist) {
+			log.Warnf("failed to remove body file %s: %+v", path, e)
+			return nil
+		}
+		removed++
+		return nil
+	})
+	return removed, errors.Wrap(e, "failed to collect body files")
+}
@@ -0,0 +1,612 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm/clause"
+)
+
+// headerCache tells the client whether the response is served from the cache.
+const headerCache = "X-Roprox-Cache"
+
+// Cache rule policies.
+const (
+	cachePolicyForce = "force"
+	cachePolicyNever = "never"
+)
+
+// maxHeuristicLifetime caps the freshness lifetime derived from Last-Modified.
+const maxHeuristicLifetime = 24 * time.Hour
+
+// cacheableStatus lists the status codes of responses that may be stored, see RFC 9110 section 15.1.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheRule overrides the caching of responses from its domains.
+type cacheRule struct {
+	domains []string
+	policy  string
+	ttl     time.Duration
+}
+
+var (
+	cacheRules     []*cacheRule
+	cacheRulesOnce sync.Once
+	// evictionLock serializes cache evictions.
+	evictionLock sync.Mutex
+	// cachedBytes tracks the total size of cached bodies. It's loaded from the database on first use,
+	// and corrected by every eviction.
+	cachedBytes     atomic.Int64
+	cachedBytesOnce sync.Once
+	// evictions wakes up the background eviction job.
+	evictions     = make(chan struct{}, 1)
+	evictionsOnce sync.Once
+)
+
+// loadCacheRules compiles the cache rules defined in the configuration. Invalid rules are skipped.
+func loadCacheRules() []*cacheRule {
+	cacheRulesOnce.Do(func() {
+		var errs []error
+		cacheRules, errs = compileCacheRules(conf.Args.Proxy.Cache.Rules)
+		for _, e := range errs {
+			log.Error(e)
+		}
+	})
+	return cacheRules
+}
+
+func compileCacheRules(args []conf.CacheRuleArgs) (rs []*cacheRule, errs []error) {
+	for i, ca := range args {
+		r := &cacheRule{
+			domains: ca.Domains,
+			policy:  strings.ToLower(ca.Policy),
+			ttl:     time.Duration(ca.TTL) * time.Second,
+		}
+		switch {
+		case r.policy != cachePolicyForce && r.policy != cachePolicyNever:
+			errs = append(errs, errors.Errorf("invalid cache rule #%d: unknown policy %q", i, ca.Policy))
+			continue
+		case r.policy == cachePolicyForce && r.ttl <= 0:
+			errs = append(errs, errors.Errorf("invalid cache rule #%d: force policy requires a positive ttl", i))
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return
+}
+
+// cacheRuleFor returns the first rule applicable to the host, or nil if none applies.
+func cacheRuleFor(rs []*cacheRule, host string) *cacheRule {
+	for _, r := range rs {
+		if hostMatches(host, r.domains) {
+			return r
+		}
+	}
+	return nil
+}
+
+// cacheControl holds the directives of Cache-Control header fields, keyed by lowercase name.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of the directive.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	arg, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, e := strconv.ParseInt(arg, 10, 64)
+	if e != nil || n < 0 {
+		// invalid arguments are treated as stale, see RFC 9111 section 1.2.2
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheKey returns the absolute URL of the request.
+func cacheKey(req *http.Request) string {
+	u := *req.URL
+	if u.Scheme == "" {
+		u.Scheme = "https"
+	}
+	if req.Host != "" {
+		u.Host = req.Host
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	return u.String()
+}
+
+// freshnessLifetime calculates how long the response stays fresh after it was generated at date,
+// see RFC 9111 section 4.2.1.
+func freshnessLifetime(h http.Header, date time.Time) time.Duration {
+	cc := parseCacheControl(h)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if v := h.Get("Expires"); v != "" {
+		expires, e := http.ParseTime(v)
+		if e != nil || !expires.After(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lm, e := http.ParseTime(h.Get("Last-Modified")); e == nil && date.After(lm) {
+		return min(date.Sub(lm)/10, maxHeuristicLifetime)
+	}
+	return 0
+}
+
+// storable returns whether a shared cache may store the response to the request, see RFC 9111 section 3.
+func storable(req *http.Request, res *http.Response) bool {
+	if req.Method != http.MethodGet || !cacheableStatus[res.StatusCode] {
+		return false
+	}
+	cc := parseCacheControl(res.Header)
+	if cc.has("no-store") || !shareable(req, res) {
+		return false
+	}
+	// cookies are specific to the client
+	if res.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	for _, f := range varyFields(res.Header) {
+		if f == "*" {
+			return false
+		}
+	}
+	// a response that is never fresh is only useful if it can be revalidated
+	return res.Header.Get("ETag") != "" || res.Header.Get("Last-Modified") != "" ||
+		freshnessLifetime(res.Header, responseDate(res.Header, time.Now())) > 0
+}
+
+// shareable returns whether the response may be served to other clients:
+// it's not private, and it's explicitly allowed to be shared if the request was authorized.
+// Forced cache rules don't override this.
+func shareable(req *http.Request, res *http.Response) bool {
+	cc := parseCacheControl(res.Header)
+	if cc.has("private") {
+		return false
+	}
+	return req.Header.Get("Authorization") == "" ||
+		cc.has("public") || cc.has("s-maxage") || cc.has("must-revalidate")
+}
+
+// responseDate returns the Date header of the response, or now if it's missing or invalid.
+func responseDate(h http.Header, now time.Time) time.Time {
+	if date, e := http.ParseTime(h.Get("Date")); e == nil {
+		return date
+	}
+	return now
+}
+
+// varyFields returns the canonical header names listed by the Vary header of the response.
+func varyFields(h http.Header) (fields []string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				fields = append(fields, http.CanonicalHeaderKey(f))
+			}
+		}
+	}
+	return
+}
+
+// varyValues returns the values of the request header fields selected by the Vary fields.
+func varyValues(fields []string, reqHeader http.Header) map[string]string {
+	values := make(map[string]string, len(fields))
+	for _, f := range fields {
+		values[f] = strings.Join(reqHeader.Values(f), ",")
+	}
+	return values
+}
+
+// cacheExchange carries the cache state of a client request to an idempotent method.
+// A nil cacheExchange denotes the request bypasses the cache; all its methods are no-op then.
+type cacheExchange struct {
+	key  string
+	host string
+	rule *cacheRule
+	// reqHeader is the header from the client before any modification for upstream.
+	reqHeader http.Header
+	// entry is the stored response matching the request, if any.
+	entry *types.CachedResponse
+	// revalidating denotes conditional headers were added to the request to validate the stale entry.
+	revalidating bool
+	// storedSize is the body size of the response stored for the URL, which may not match the request.
+	storedSize int64
+}
+
+// newCacheExchange looks up the cache for the request. It returns nil if the request bypasses the cache.
+// Requests with unsafe methods invalidate the stored response of the URL, see RFC 9111 section 4.4.
+func newCacheExchange(req *http.Request) *cacheExchange {
+	if !conf.Args.Proxy.Cache.Enabled {
+		return nil
+	}
+	key := cacheKey(req)
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions, http.MethodTrace:
+		return nil
+	default:
+		if e := data.GormDB.Unscoped().Where("url = ?", key).Delete(&types.CachedResponse{}).Error; e != nil {
+			log.Warnf("failed to invalidate cached response of %s: %+v", key, e)
+		}
+		return nil
+	}
+	host := targetHost(req)
+	rule := cacheRuleFor(loadCacheRules(), host)
+	if rule != nil && rule.policy == cachePolicyNever {
+		return nil
+	}
+	if rule == nil && parseCacheControl(req.Header).has("no-store") {
+		return nil
+	}
+	cx := &cacheExchange{key: key, host: host, rule: rule, reqHeader: req.Header.Clone()}
+
+	var entry types.CachedResponse
+	if e := data.GormDB.Where("url = ?", key).Limit(1).Find(&entry).Error; e != nil {
+		log.Warnf("failed to query cached response of %s: %+v", key, e)
+		return cx
+	}
+	if entry.ID == 0 {
+		return cx
+	}
+	cx.storedSize = entry.Size
+	var stored map[string]string
+	if e := json.Unmarshal([]byte(entry.Vary), &stored); e != nil && entry.Vary != "" {
+		log.Warnf("invalid vary values of cached response of %s: %+v", key, e)
+		return cx
+	}
+	for f, v := range stored {
+		if strings.Join(req.Header.Values(f), ",") != v {
+			return cx
+		}
+	}
+	cx.entry = &entry
+	return cx
+}
+
+// header decodes the header of the stored response.
+func (cx *cacheExchange) header() http.Header {
+	h := make(http.Header)
+	if e := json.Unmarshal([]byte(cx.entry.Header), &h); e != nil {
+		log.Warnf("invalid header of cached response of %s: %+v", cx.key, e)
+	}
+	return h
+}
+
+// fresh returns whether the stored response can be served without revalidation per the request directives.
+func (cx *cacheExchange) fresh(now time.Time) bool {
+	if cx.rule != nil {
+		// forced caching ignores the directives
+		return now.Before(cx.entry.FreshUntil)
+	}
+	cc := parseCacheControl(cx.reqHeader)
+	if cc.has("no-cache") || (len(cc) == 0 && strings.Contains(strings.ToLower(cx.reqHeader.Get("Pragma")), "no-cache")) {
+		return false
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok && now.Sub(cx.entry.StoredAt) > maxAge {
+		return false
+	}
+	return now.Before(cx.entry.FreshUntil)
+}
+
+// conditional returns whether the client request carries preconditions.
+func conditional(h http.Header) bool {
+	for _, f := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		if h.Get(f) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates the If-None-Match or If-Modified-Since precondition of the client
+// against the stored response header, see RFC 9110 section 13.2.2.
+func notModified(reqHeader, h http.Header) bool {
+	if inm := reqHeader.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(h.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, t := range strings.Split(inm, ",") {
+			if t = strings.TrimSpace(t); t == "*" || strings.TrimPrefix(t, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, e := http.ParseTime(reqHeader.Get("If-Modified-Since"))
+	if e != nil {
+		return false
+	}
+	lm, e := http.ParseTime(h.Get("Last-Modified"))
+	return e == nil && !lm.After(ims)
+}
+
+// serveStored serves the request from the cache if the stored response is fresh.
+// It also answers 504 Gateway Timeout to only-if-cached requests that can't be served from the cache.
+// It returns false if the request shall be forwarded.
+func (cx *cacheExchange) serveStored(cw *ConnResponseWriter, req *http.Request) bool {
+	if cx == nil {
+		return false
+	}
+	now := time.Now()
+	if cx.entry != nil && cx.fresh(now) {
+		h := cx.header()
+		status := cx.entry.StatusCode
+		if conditional(cx.reqHeader) {
+			if cx.reqHeader.Get("If-None-Match") == "" && cx.reqHeader.Get("If-Modified-Since") == "" {
+				// other preconditions are left to the origin server
+				return false
+			}
+			if notModified(cx.reqHeader, h) {
+				status = http.StatusNotModified
+			}
+		}
+		if e := cx.write(cw, req, h, status); e != nil {
+			log.Warnf("failed to serve cached response of %s: %+v", cx.key, e)
+		}
+		if e := data.GormDB.Model(cx.entry).UpdateColumn("last_access", now).Error; e != nil {
+			log.Warnf("failed to update cached response of %s: %+v", cx.key, e)
+		}
+		return true
+	}
+	if parseCacheControl(cx.reqHeader).has("only-if-cached") {
+		cw.Header().Set(headerCache, "MISS")
+		http.Error(cw, "response is not cached", http.StatusGatewayTimeout)
+		return true
+	}
+	return false
+}
+
+// write sends the stored response with the header and status to the client.
+func (cx *cacheExchange) write(cw *ConnResponseWriter, req *http.Request, h http.Header, status int) error {
+	copyHeader(cw.Header(), h)
+	cw.Header().Set("Age", strconv.FormatInt(int64(max(time.Since(cx.entry.StoredAt), 0)/time.Second), 10))
+	cw.Header().Set(headerCache, "HIT")
+	cw.noBody = !bodyAllowed(req.Method, status)
+	if status != http.StatusNotModified && cw.Header().Get("Content-Length") == "" {
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cx.entry.Body)))
+	}
+	cw.WriteHeader(status)
+	if !cw.noBody {
+		if _, e := cw.Write(cx.entry.Body); e != nil {
+			return e
+		}
+	}
+	return cw.finish()
+}
+
+// prepare adds conditional headers to the request to validate the stale entry with the origin server,
+// unless the client sent its own preconditions.
+func (cx *cacheExchange) prepare(req *http.Request) {
+	if cx == nil || cx.entry == nil || conditional(cx.reqHeader) {
+		return
+	}
+	h := cx.header()
+	if etag := h.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+		cx.revalidating = true
+	}
+	if lm := h.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+		cx.revalidating = true
+	}
+}
+
+// revalidated serves the stored response if the origin server validated it with 304 Not Modified,
+// updating the stored header with the one of the 304 response, see RFC 9111 section 4.3.4.
+func (cx *cacheExchange) revalidated(cw *ConnResponseWriter, req *http.Request, res *http.Response) (bool, error) {
+	if cx == nil || !cx.revalidating || res.StatusCode != http.StatusNotModified {
+		return false, nil
+	}
+	h := cx.header()
+	for name, values := range res.Header {
+		if isHopHeader(name, res.Header) || name == "Content-Length" {
+			continue
+		}
+		h[name] = values
+	}
+	if e := cx.save(h, cx.entry.StatusCode, cx.entry.Body, time.Now()); e != nil {
+		log.Warnf("failed to update cached response of %s: %+v", cx.key, e)
+	}
+	return true, cx.write(cw, req, h, cx.entry.StatusCode)
+}
+
+// capture marks the response forwarded from the origin server as a cache miss. It returns the buffer
+// to capture the body of a storable response, or nil if the response shall not be stored.
+func (cx *cacheExchange) capture(cw *ConnResponseWriter, req *http.Request, res *http.Response) *cappedBuffer {
+	if cx == nil {
+		return nil
+	}
+	cw.Header().Set(headerCache, "MISS")
+	if cx.rule == nil && !storable(req, res) {
+		return nil
+	}
+	if cx.rule != nil && (req.Method != http.MethodGet || !cacheableStatus[res.StatusCode] || !shareable(req, res)) {
+		return nil
+	}
+	limit := conf.Args.Proxy.Cache.MaxEntrySize
+	if limit > 0 && res.ContentLength > int64(limit) {
+		return nil
+	}
+	return newCappedBuffer(limit)
+}
+
+// store saves the response whose body was captured completely.
+func (cx *cacheExchange) store(res *http.Response, body *cappedBuffer) {
+	if cx == nil || body == nil || body.truncated {
+		return
+	}
+	h := res.Header.Clone()
+	removeHopHeaders(h)
+	h.Del("Set-Cookie")
+	cx.entry = &types.CachedResponse{}
+	if e := cx.save(h, res.StatusCode, body.Bytes(), time.Now()); e != nil {
+		log.Warnf("failed to store response of %s in cache: %+v", cx.key, e)
+		return
+	}
+	trackCacheSize(cx.entry.Size-cx.storedSize, conf.Args.Proxy.Cache.MaxSize)
+}
+
+// save upserts the response received at now.
+func (cx *cacheExchange) save(h http.Header, status int, body []byte, now time.Time) error {
+	header, e := json.Marshal(h)
+	if e != nil {
+		return errors.Wrap(e, "failed to encode header")
+	}
+	vary, e := json.Marshal(varyValues(varyFields(h), cx.reqHeader))
+	if e != nil {
+		return errors.Wrap(e, "failed to encode vary values")
+	}
+	storedAt := now
+	if age, e := strconv.ParseInt(h.Get("Age"), 10, 64); e == nil && age > 0 {
+		storedAt = now.Add(-time.Duration(age) * time.Second)
+	}
+	lifetime := freshnessLifetime(h, responseDate(h, now))
+	if cx.rule != nil {
+		lifetime = cx.rule.ttl
+	}
+	entry := types.CachedResponse{
+		URL:        cx.key,
+		Domain:     cx.host,
+		StatusCode: status,
+		Header:     string(header),
+		Vary:       string(vary),
+		Body:       body,
+		Size:       int64(len(body)),
+		StoredAt:   storedAt,
+		FreshUntil: storedAt.Add(lifetime),
+		LastAccess: now,
+	}
+	if e = data.GormDB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "url"}},
+		DoUpdates: clause.AssignmentColumns([]string{"updated_at", "domain", "status_code", "header", "vary", "body", "size", "stored_at", "fresh_until", "last_access"}),
+	}).Create(&entry).Error; e != nil {
+		return errors.WithStack(e)
+	}
+	*cx.entry = entry
+	return nil
+}
+
+// trackCacheSize adds delta to the tracked total size of cached bodies, and wakes up the background
+// eviction job if it exceeds maxSize.
+func trackCacheSize(delta, maxSize int64) {
+	if maxSize <= 0 {
+		return
+	}
+	cachedBytesOnce.Do(func() {
+		total, e := cacheSize()
+		if e != nil {
+			log.Warnf("failed to query cache size: %+v", e)
+		}
+		// the total includes the delta already
+		cachedBytes.Store(total - delta)
+	})
+	if cachedBytes.Add(delta) <= maxSize {
+		return
+	}
+	evictionsOnce.Do(func() {
+		go func() {
+			for range evictions {
+				evictCache(conf.Args.Proxy.Cache.MaxSize)
+			}
+		}()
+	})
+	select {
+	case evictions <- struct{}{}:
+	default:
+		// an eviction is pending already
+	}
+}
+
+func cacheSize() (total int64, e error) {
+	e = data.GormDB.Model(&types.CachedResponse{}).Select("coalesce(sum(size), 0)").Scan(&total).Error
+	return
+}
+
+// evictCache deletes the least recently used responses until the total size of cached bodies is within
+// 90% of maxSize, leaving room for responses stored until the next eviction.
+func evictCache(maxSize int64) {
+	if maxSize <= 0 {
+		return
+	}
+	evictionLock.Lock()
+	defer evictionLock.Unlock()
+	total, e := cacheSize()
+	if e != nil {
+		log.Warnf("failed to query cache size: %+v", e)
+		return
+	}
+	// the tracked total drifts as responses are invalidated or stored concurrently
+	defer func() { cachedBytes.Store(total) }()
+	target := maxSize / 10 * 9
+	for total > target {
+		var victims []types.CachedResponse
+		if e := data.GormDB.Select("id", "size").Order("last_access").Limit(64).Find(&victims).Error; e != nil {
+			log.Warnf("failed to query least recently used cached responses: %+v", e)
+			return
+		}
+		if len(victims) == 0 {
+			return
+		}
+		ids := make([]uint, 0, len(victims))
+		for _, v := range victims {
+			ids = append(ids, v.ID)
+			if total -= v.Size; total <= target {
+				break
+			}
+		}
+		if e := data.GormDB.Unscoped().Delete(&types.CachedResponse{}, ids).Error; e != nil {
+			log.Warnf("failed to evict cached responses: %+v", e)
+			return
+		}
+		log.Debugf("evicted %d cached responses", len(ids))
+	}
+}
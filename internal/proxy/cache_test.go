@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+	}{
+		{"s-maxage precedes max-age", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 120 * time.Second},
+		{"max-age precedes expires", http.Header{"Cache-Control": {"max-age=60"}, "Expires": {http.TimeFormat}}, time.Minute},
+		{"expires", http.Header{"Expires": {date.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"invalid expires", http.Header{"Expires": {"0"}}, 0},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0},
+		{"heuristic", http.Header{"Last-Modified": {date.Add(-10 * time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"capped heuristic", http.Header{"Last-Modified": {date.AddDate(-1, 0, 0).Format(http.TimeFormat)}}, maxHeuristicLifetime},
+		{"none", http.Header{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := freshnessLifetime(tt.header, date); got != tt.want {
+				t.Errorf("freshnessLifetime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStorable(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		auth   bool
+		status int
+		header http.Header
+		want   bool
+	}{
+		{"max-age", http.MethodGet, false, 200, http.Header{"Cache-Control": {"max-age=60"}}, true},
+		{"validator only", http.MethodGet, false, 200, http.Header{"Etag": {`"v1"`}}, true},
+		{"head", http.MethodHead, false, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"partial content", http.MethodGet, false, 206, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"no-store", http.MethodGet, false, 200, http.Header{"Cache-Control": {"no-store, max-age=60"}}, false},
+		{"private", http.MethodGet, false, 200, http.Header{"Cache-Control": {"private, max-age=60"}}, false},
+		{"authorization", http.MethodGet, true, 200, http.Header{"Cache-Control": {"max-age=60"}}, false},
+		{"public authorization", http.MethodGet, true, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, true},
+		{"set-cookie", http.MethodGet, false, 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, false},
+		{"vary all", http.MethodGet, false, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false},
+		{"never fresh", http.MethodGet, false, 200, http.Header{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://cache.test/", nil)
+			if tt.auth {
+				req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+			}
+			res := &http.Response{StatusCode: tt.status, Header: tt.header}
+			if got := storable(req, res); got != tt.want {
+				t.Errorf("storable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lm := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	h := http.Header{"Etag": {`W/"v1"`}, "Last-Modified": {lm.Format(http.TimeFormat)}}
+	tests := []struct {
+		name   string
+		header http.Header
+		want   bool
+	}{
+		{"matching etag", http.Header{"If-None-Match": {`"v0", "v1"`}}, true},
+		{"other etag", http.Header{"If-None-Match": {`"v0"`}}, false},
+		{"etag precedes date", http.Header{"If-None-Match": {`"v0"`}, "If-Modified-Since": {lm.Format(http.TimeFormat)}}, false},
+		{"not modified since", http.Header{"If-Modified-Since": {lm.Format(http.TimeFormat)}}, true},
+		{"modified since", http.Header{"If-Modified-Since": {lm.Add(-time.Hour).Format(http.TimeFormat)}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notModified(tt.header, h); got != tt.want {
+				t.Errorf("notModified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// cachedGet sends a GET request for the URL through serveRequest and returns the response once served.
+func cachedGet(t *testing.T, url string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	server, client := net.Pipe()
+	defer client.Close()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		serveRequest(NewConnResponseWriter(server), req, nil, route{mode: types.Direct})
+	}()
+	// the response is stored after it is relayed
+	defer func() { <-done }()
+	res, e := http.ReadResponse(bufio.NewReader(client), req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	body, e := io.ReadAll(res.Body)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return res, string(body)
+}
+
+func TestCacheExchange(t *testing.T) {
+	args := conf.Args.Proxy
+	defer func() { conf.Args.Proxy = args }()
+	conf.Args.Proxy.Cache.Enabled = true
+	conf.Args.Proxy.MaxRetryDuration, conf.Args.Proxy.BackendProxyTimeout = 10, 10
+
+	var hits, revalidations atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidations.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/stale":
+			w.Header().Set("Cache-Control", "no-cache")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		fmt.Fprint(w, "content of ", r.URL.Path)
+	}))
+	defer origin.Close()
+	defer data.GormDB.Unscoped().Where("url like ?", origin.URL+"%").Delete(&types.CachedResponse{})
+
+	expect := func(path string, header http.Header, wantCache, wantBody string, wantHits int32) {
+		t.Helper()
+		res, body := cachedGet(t, origin.URL+path, header)
+		if got := res.Header.Get(headerCache); got != wantCache {
+			t.Errorf("GET %s: %s = %q, want %q", path, headerCache, got, wantCache)
+		}
+		if res.StatusCode == http.StatusOK && body != wantBody {
+			t.Errorf("GET %s: body = %q, want %q", path, body, wantBody)
+		}
+		if got := hits.Load(); got != wantHits {
+			t.Errorf("GET %s: origin hits = %d, want %d", path, got, wantHits)
+		}
+	}
+
+	expect("/fresh", nil, "MISS", "content of /fresh", 1)
+	expect("/fresh", nil, "HIT", "content of /fresh", 1)
+	expect("/fresh", http.Header{"Cache-Control": {"no-cache"}}, "HIT", "content of /fresh", 2)
+	if revalidations.Load() != 1 {
+		t.Errorf("revalidations = %d, want 1", revalidations.Load())
+	}
+	res, _ := cachedGet(t, origin.URL+"/fresh", http.Header{"If-None-Match": {`"v1"`}})
+	if res.StatusCode != http.StatusNotModified || res.Header.Get(headerCache) != "HIT" {
+		t.Errorf("conditional GET: status %d %s, want 304 HIT", res.StatusCode, res.Header.Get(headerCache))
+	}
+
+	expect("/stale", nil, "MISS", "content of /stale", 3)
+	expect("/stale", nil, "HIT", "content of /stale", 4)
+	if revalidations.Load() != 2 {
+		t.Errorf("revalidations = %d, want 2", revalidations.Load())
+	}
+
+	expect("/private", nil, "MISS", "content of /private", 5)
+	expect("/private", nil, "MISS", "content of /private", 6)
+	res, _ = cachedGet(t, origin.URL+"/private", http.Header{"Cache-Control": {"only-if-cached"}})
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("only-if-cached: status %d, want 504", res.StatusCode)
+	}
+
+	// unsafe methods invalidate the stored response
+	newCacheExchange(httptest.NewRequest(http.MethodPost, origin.URL+"/fresh", strings.NewReader("x")))
+	expect("/fresh", nil, "MISS", "content of /fresh", 7)
+}
+
+func TestCacheRules(t *testing.T) {
+	rs, errs := compileCacheRules([]conf.CacheRuleArgs{
+		{Domains: []string{"static.test"}, Policy: "force", TTL: 60},
+		{Domains: []string{"test"}, Policy: "Never"},
+		{Domains: []string{"invalid.test"}, Policy: "force"},
+		{Domains: []string{"invalid.test"}, Policy: "sometimes"},
+	})
+	if len(rs) != 2 || len(errs) != 2 {
+		t.Fatalf("compiled %d rules with %d errors, want 2 and 2", len(rs), len(errs))
+	}
+	if r := cacheRuleFor(rs, "cdn.static.test"); r == nil || r.policy != cachePolicyForce || r.ttl != time.Minute {
+		t.Errorf("cacheRuleFor(cdn.static.test) = %+v, want force rule", r)
+	}
+	if r := cacheRuleFor(rs, "api.test"); r == nil || r.policy != cachePolicyNever {
+		t.Errorf("cacheRuleFor(api.test) = %+v, want never rule", r)
+	}
+	if r := cacheRuleFor(rs, "example.com"); r != nil {
+		t.Errorf("cacheRuleFor(example.com) = %+v, want nil", r)
+	}
+}
+
+func TestCaptureForced(t *testing.T) {
+	cx := &cacheExchange{rule: &cacheRule{policy: cachePolicyForce, ttl: time.Minute}}
+	tests := []struct {
+		name         string
+		auth         bool
+		cacheControl string
+		want         bool
+	}{
+		{"no-store", false, "no-store", true},
+		{"private", false, "private, max-age=60", false},
+		{"authorized", true, "max-age=60", false},
+		{"authorized public", true, "public, max-age=60", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://static.test/a.js", nil)
+			if tt.auth {
+				req.Header.Set("Authorization", "Bearer t1")
+			}
+			res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": {tt.cacheControl}}}
+			if got := cx.capture(NewConnResponseWriter(nil), req, res) != nil; got != tt.want {
+				t.Errorf("captured = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	defer data.GormDB.Unscoped().Where("domain = ?", "evict.test").Delete(&types.CachedResponse{})
+	data.GormDB.Unscoped().Where("1 = 1").Delete(&types.CachedResponse{})
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		e := data.GormDB.Create(&types.CachedResponse{
+			URL:        fmt.Sprintf("http://evict.test/%d", i),
+			Domain:     "evict.test",
+			Body:       make([]byte, 100),
+			Size:       100,
+			LastAccess: now.Add(time.Duration(i) * time.Second),
+		}).Error
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	evictCache(250)
+	var urls []string
+	data.GormDB.Model(&types.CachedResponse{}).Order("url").Pluck("url", &urls)
+	if want := "http://evict.test/2,http://evict.test/3"; strings.Join(urls, ",") != want {
+		t.Errorf("remaining = %v, want %s", urls, want)
+	}
+	if n := cachedBytes.Load(); n != 200 {
+		t.Errorf("tracked cache size = %d, want 200", n)
+	}
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import "bytes"
+
+// cappedBuffer keeps at most limit bytes written to it and silently discards the rest,
+// so that it can be used as the capture side of an io.TeeReader without interrupting the stream.
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// newCappedBuffer creates a buffer capped at limit bytes. A non-positive limit means unlimited.
+func newCappedBuffer(limit int) *cappedBuffer {
+	return &cappedBuffer{limit: limit}
+}
+
+// Write always reports the full length of p as written.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 {
+		if remain := b.limit - b.Len(); remain < len(p) {
+			p = p[:max(remain, 0)]
+			b.truncated = true
+		}
+	}
+	b.Buffer.Write(p)
+	return n, nil
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCappedBuffer(t *testing.T) {
+	tests := []struct {
+		name          string
+		limit         int
+		input         string
+		wantCaptured  string
+		wantTruncated bool
+	}{
+		{"unlimited", 0, "hello world", "hello world", false},
+		{"within limit", 16, "hello world", "hello world", false},
+		{"exceeds limit", 5, "hello world", "hello", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capture := newCappedBuffer(tt.limit)
+			var sb strings.Builder
+			// small reads to exercise multiple writes into the capture buffer
+			r := io.TeeReader(io.LimitReader(strings.NewReader(tt.input), int64(len(tt.input))), capture)
+			if _, e := io.CopyBuffer(&sb, struct{ io.Reader }{r}, make([]byte, 3)); e != nil {
+				t.Fatal(e)
+			}
+			if sb.String() != tt.input {
+				t.Errorf("streamed %q, want %q", sb.String(), tt.input)
+			}
+			if capture.String() != tt.wantCaptured {
+				t.Errorf("captured %q, want %q", capture.String(), tt.wantCaptured)
+			}
+			if capture.truncated != tt.wantTruncated {
+				t.Errorf("truncated = %v, want %v", capture.truncated, tt.wantTruncated)
+			}
+		})
+	}
+}
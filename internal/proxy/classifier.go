@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/agux/roprox/internal/conf"
+)
+
+// classifier detects responses denoting the backend proxy is blocked by the target site.
+type classifier struct {
+	domains      []string
+	statusCodes  map[int]bool
+	headers      []headerMarker
+	bodyPatterns []*regexp.Regexp
+}
+
+// headerMarker matches the presence of the header, or its value if value is not nil.
+type headerMarker struct {
+	name  string
+	value *regexp.Regexp
+}
+
+var (
+	classifiers     []*classifier
+	classifiersOnce sync.Once
+)
+
+// loadClassifiers compiles the classifiers defined in the configuration. Invalid patterns are skipped.
+func loadClassifiers() []*classifier {
+	classifiersOnce.Do(func() {
+		classifiers = compileClassifiers(conf.Args.Proxy.Classifiers)
+	})
+	return classifiers
+}
+
+func compileClassifiers(args []conf.ClassifierArgs) (cs []*classifier) {
+	for _, ca := range args {
+		c := &classifier{domains: ca.Domains, statusCodes: make(map[int]bool)}
+		for _, code := range ca.StatusCodes {
+			c.statusCodes[code] = true
+		}
+		for _, h := range ca.Headers {
+			name, value, found := strings.Cut(h, ":")
+			m := headerMarker{name: strings.TrimSpace(name)}
+			if found {
+				re, e := regexp.Compile(strings.TrimSpace(value))
+				if e != nil {
+					log.Errorf("invalid classifier header marker %q: %+v", h, e)
+					continue
+				}
+				m.value = re
+			}
+			c.headers = append(c.headers, m)
+		}
+		for _, p := range ca.BodyPatterns {
+			re, e := regexp.Compile(p)
+			if e != nil {
+				log.Errorf("invalid classifier body pattern %q: %+v", p, e)
+				continue
+			}
+			c.bodyPatterns = append(c.bodyPatterns, re)
+		}
+		cs = append(cs, c)
+	}
+	return
+}
+
+// hostMatches returns whether the host is any of the domains or their subdomains.
+func hostMatches(host string, domains []string) bool {
+	host = strings.ToLower(host)
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxBlockedBodySize caps the body of a blocked response kept for relaying it once retries run out.
+const maxBlockedBodySize = 256 << 10
+
+// blockedError denotes the target site responded that the backend proxy is blocked.
+type blockedError struct {
+	domain string
+	reason string
+	// the blocked response, relayed to the client if no other proxy gets through
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (e *blockedError) Error() string {
+	return fmt.Sprintf("blocked by %s: %s", e.domain, e.reason)
+}
+
+// newBlockedError keeps the blocked response, whose body is dropped if it's larger than maxBlockedBodySize.
+func newBlockedError(domain, reason string, res *http.Response) *blockedError {
+	be := &blockedError{domain: domain, reason: reason, status: res.StatusCode, header: res.Header.Clone()}
+	body, e := io.ReadAll(io.LimitReader(res.Body, maxBlockedBodySize+1))
+	if e != nil || len(body) > maxBlockedBodySize {
+		be.header.Del("Content-Encoding")
+		body = nil
+	}
+	be.body = body
+	return be
+}
+
+// relay writes the blocked response to the client.
+func (e *blockedError) relay(cw *ConnResponseWriter, req *http.Request) error {
+	clear(cw.Header())
+	copyHeader(cw.Header(), e.header)
+	cw.noBody = !bodyAllowed(req.Method, e.status)
+	if !cw.noBody {
+		cw.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+	}
+	cw.WriteHeader(e.status)
+	if !cw.noBody {
+		if _, err := cw.Write(e.body); err != nil {
+			return err
+		}
+	}
+	return cw.finish()
+}
+
+// classifiesBody returns whether body patterns of the classifiers apply to the host.
+func classifiesBody(cs []*classifier, host string) bool {
+	for _, c := range cs {
+		if len(c.bodyPatterns) > 0 && (len(c.domains) == 0 || hostMatches(host, c.domains)) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify examines the response against the classifiers applicable to the host and
+// returns the reason if the response denotes the proxy is blocked.
+// The body examined by body patterns is restored so that the response can still be relayed.
+// Compressed bodies are decompressed for body patterns.
+func classify(cs []*classifier, host string, res *http.Response) (reason string) {
+	var bodyPatterns []*regexp.Regexp
+	for _, c := range cs {
+		if len(c.domains) > 0 && !hostMatches(host, c.domains) {
+			continue
+		}
+		if c.statusCodes[res.StatusCode] {
+			return fmt.Sprintf("status %d", res.StatusCode)
+		}
+		for _, m := range c.headers {
+			values := res.Header.Values(m.name)
+			if len(values) == 0 {
+				continue
+			}
+			if m.value == nil {
+				return "header " + m.name
+			}
+			for _, v := range values {
+				if m.value.MatchString(v) {
+					return fmt.Sprintf("header %s: %s", m.name, v)
+				}
+			}
+		}
+		bodyPatterns = append(bodyPatterns, c.bodyPatterns...)
+	}
+	if len(bodyPatterns) == 0 || res.Body == nil {
+		return
+	}
+
+	peeked, _ := io.ReadAll(io.LimitReader(res.Body, int64(conf.Args.Proxy.ClassifierPeekSize)))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(peeked), res.Body), res.Body}
+	peeked = decodePrefix(peeked, res.Header.Get("Content-Encoding"), conf.Args.Proxy.ClassifierPeekSize)
+	for _, re := range bodyPatterns {
+		if re.Match(peeked) {
+			return "body " + re.String()
+		}
+	}
+	return
+}
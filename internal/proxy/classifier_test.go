@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+)
+
+func TestClassify(t *testing.T) {
+	cs := compileClassifiers([]conf.ClassifierArgs{
+		{StatusCodes: []int{429}, Headers: []string{"cf-mitigated: ^challenge$"}},
+		{
+			Domains:      []string{"example.com"},
+			StatusCodes:  []int{403},
+			Headers:      []string{"X-Blocked"},
+			BodyPatterns: []string{"(?i)captcha", "(invalid"},
+		},
+	})
+
+	tests := []struct {
+		name    string
+		host    string
+		status  int
+		header  http.Header
+		body    string
+		blocked bool
+	}{
+		{"ok", "example.com", 200, nil, "hello", false},
+		{"global status", "other.org", 429, nil, "", true},
+		{"global header value", "other.org", 200, http.Header{"Cf-Mitigated": {"challenge"}}, "", true},
+		{"header value mismatch", "other.org", 200, http.Header{"Cf-Mitigated": {"none"}}, "", false},
+		{"domain status", "www.example.com", 403, nil, "", true},
+		{"status of other domain", "other.org", 403, nil, "", false},
+		{"header presence", "example.com", 200, http.Header{"X-Blocked": {"1"}}, "", true},
+		{"body pattern", "example.com", 200, nil, "<h1>Solve the CAPTCHA</h1>", true},
+		{"body pattern of other domain", "notexample.com", 200, nil, "captcha", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{
+				StatusCode: tt.status,
+				Header:     tt.header,
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+			if res.Header == nil {
+				res.Header = http.Header{}
+			}
+			if got := classify(cs, tt.host, res); (got != "") != tt.blocked {
+				t.Errorf("classify() = %q, want blocked %v", got, tt.blocked)
+			}
+			if body, _ := io.ReadAll(res.Body); string(body) != tt.body {
+				t.Errorf("body = %q after classification, want %q", body, tt.body)
+			}
+		})
+	}
+
+	filler := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(filler)
+	page := append([]byte(strings.Repeat("<p>Solve the CAPTCHA</p>", 1000)), filler...)
+	compressed, _ := encodeContent(page, "gzip")
+	peek := conf.Args.Proxy.ClassifierPeekSize
+	defer func() { conf.Args.Proxy.ClassifierPeekSize = peek }()
+	// the peek ends in the middle of the compressed body
+	conf.Args.Proxy.ClassifierPeekSize = len(compressed) / 2
+	res := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Encoding": {"gzip"}},
+		Body:       io.NopCloser(bytes.NewReader(compressed)),
+	}
+	if got := classify(cs, "example.com", res); got == "" {
+		t.Error("body patterns shall match the decompressed body")
+	}
+	if body, _ := io.ReadAll(res.Body); !bytes.Equal(body, compressed) {
+		t.Error("compressed body shall be restored as is")
+	}
+	if !classifiesBody(cs, "www.example.com") || classifiesBody(cs, "other.org") {
+		t.Error("classifiesBody() shall apply to the domains of body patterns only")
+	}
+}
+
+func TestAcceptDecodable(t *testing.T) {
+	tests := map[string]string{
+		"gzip, deflate, br":   "gzip, deflate",
+		"br;q=1.0, gzip;q=.5": "gzip;q=.5",
+		"br, zstd":            "",
+	}
+	for ae, want := range tests {
+		if got := acceptDecodable(ae); got != want {
+			t.Errorf("acceptDecodable(%q) = %q, want %q", ae, got, want)
+		}
+	}
+}
+
+func TestRelayBlocked(t *testing.T) {
+	res := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"Content-Type": {"text/html"}, "Transfer-Encoding": {"chunked"}},
+		Body:       io.NopCloser(strings.NewReader("access denied")),
+	}
+	be := newBlockedError("example.com", "status 403", res)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	go func() {
+		defer server.Close()
+		cw := NewConnResponseWriter(server)
+		cw.Header().Set("X-Stale", "1")
+		be.relay(cw, req)
+	}()
+	got, e := http.ReadResponse(bufio.NewReader(client), req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	body, _ := io.ReadAll(got.Body)
+	if got.StatusCode != http.StatusForbidden || string(body) != "access denied" ||
+		got.Header.Get("Content-Type") != "text/html" || got.Header.Get("X-Stale") != "" {
+		t.Errorf("relayed %d %v %q, want the blocked response", got.StatusCode, got.Header, body)
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxDecodedSize caps the size of decompressed bodies, guarding against decompression bombs.
+const maxDecodedSize = 16 << 20
+
+// contentEncoding returns the normalized Content-Encoding, empty for identity.
+func contentEncoding(ce string) string {
+	ce = strings.ToLower(strings.TrimSpace(ce))
+	if ce == "identity" {
+		return ""
+	}
+	return ce
+}
+
+// decodableEncodings are the content encodings decodeContent supports.
+var decodableEncodings = []string{"gzip", "x-gzip", "deflate", "identity"}
+
+// contentReader returns a reader decompressing the body of the content encoding, which is gzip or deflate.
+func contentReader(body []byte, encoding string) (r io.ReadCloser, e error) {
+	switch contentEncoding(encoding) {
+	case "":
+		return io.NopCloser(bytes.NewReader(body)), nil
+	case "gzip", "x-gzip":
+		r, e = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		// deflate is meant to be zlib-wrapped, yet some servers send raw deflate
+		if r, e = zlib.NewReader(bytes.NewReader(body)); e != nil {
+			r, e = flate.NewReader(bytes.NewReader(body)), nil
+		}
+	default:
+		return nil, errors.Errorf("unsupported content encoding %q", encoding)
+	}
+	return r, errors.Wrapf(e, "failed to decode %s content", encoding)
+}
+
+// decodePrefix decompresses as much as possible of the leading part of a body of the content encoding,
+// up to limit bytes. It returns nil if the encoding isn't supported.
+func decodePrefix(prefix []byte, encoding string, limit int) []byte {
+	r, e := contentReader(prefix, encoding)
+	if e != nil {
+		return nil
+	}
+	defer r.Close()
+	// the prefix ends abruptly, so the error is expected
+	decoded, _ := io.ReadAll(io.LimitReader(r, int64(limit)))
+	return decoded
+}
+
+// acceptDecodable narrows the Accept-Encoding header value down to the encodings decodeContent supports.
+// It returns empty string if none of them is accepted.
+func acceptDecodable(ae string) string {
+	var accepted []string
+	for _, coding := range strings.Split(ae, ",") {
+		name, _, _ := strings.Cut(coding, ";")
+		for _, enc := range decodableEncodings {
+			if strings.EqualFold(strings.TrimSpace(name), enc) {
+				accepted = append(accepted, strings.TrimSpace(coding))
+				break
+			}
+		}
+	}
+	return strings.Join(accepted, ", ")
+}
+
+// decodeContent decompresses the body of the content encoding, which is gzip or deflate.
+// Truncated bodies and those decompressing beyond maxDecodedSize result in an error.
+func decodeContent(body []byte, encoding string) ([]byte, error) {
+	if contentEncoding(encoding) == "" {
+		return body, nil
+	}
+	r, e := contentReader(body, encoding)
+	if e != nil {
+		return nil, e
+	}
+	defer r.Close()
+	decoded, e := io.ReadAll(io.LimitReader(r, maxDecodedSize+1))
+	if e != nil {
+		return nil, errors.Wrapf(e, "failed to decode %s content", encoding)
+	}
+	if len(decoded) > maxDecodedSize {
+		return nil, errors.Errorf("decoded %s content exceeds %d bytes", encoding, maxDecodedSize)
+	}
+	return decoded, nil
+}
+
+// encodeContent compresses the body with the content encoding, which is gzip or deflate.
+func encodeContent(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch contentEncoding(encoding) {
+	case "":
+		return body, nil
+	case "gzip", "x-gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, errors.Errorf("unsupported content encoding %q", encoding)
+	}
+	if _, e := w.Write(body); e != nil {
+		return nil, errors.Wrapf(e, "failed to encode %s content", encoding)
+	}
+	if e := w.Close(); e != nil {
+		return nil, errors.Wrapf(e, "failed to encode %s content", encoding)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,471 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// HAR 1.2 document, see http://www.softwareishard.com/blog/har-12-spec/.
+// Fields prefixed with an underscore are custom ones preserving what HAR has no place for.
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	// ID is the network_traffic record ID.
+	ID uint `json:"_id,omitempty"`
+	// ClientAddress is the address of the proxy client.
+	ClientAddress string `json:"_clientAddress,omitempty"`
+	// Redacted lists the fields masked in the capture.
+	Redacted []string `json:"_redacted,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harCookie struct {
+	Name     string     `json:"name"`
+	Value    string     `json:"value"`
+	Path     string     `json:"path,omitempty"`
+	Domain   string     `json:"domain,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	HTTPOnly bool       `json:"httpOnly,omitempty"`
+	Secure   bool       `json:"secure,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	// Encoding is "base64" if the body isn't valid UTF-8. Not part of HAR 1.2 for postData.
+	Encoding string `json:"_encoding,omitempty"`
+	// Compressed denotes the text is still in the Content-Encoding as it couldn't be decoded.
+	Compressed bool `json:"_compressed,omitempty"`
+	// Truncated denotes the body was cut at the inspection size limit.
+	Truncated bool `json:"_truncated,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	// Compressed denotes the text is still in the Content-Encoding as it couldn't be decoded.
+	Compressed bool `json:"_compressed,omitempty"`
+	// Truncated denotes the body was cut at the inspection size limit.
+	Truncated bool `json:"_truncated,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// TrafficFilter selects captured network traffic. Zero values match all.
+type TrafficFilter struct {
+	From, To time.Time
+	// Host matches the target host, with or without port.
+	Host   string
+	Status int
+	// Client matches the client IP, with or without port.
+	Client string
+	// Limit caps the number of records. 0 for unlimited.
+	Limit int
+}
+
+// ParseTrafficFilter reads the filter from parameters from, to (RFC 3339 or yyyy-mm-dd), host, status,
+// client and limit.
+func ParseTrafficFilter(q url.Values) (f TrafficFilter, e error) {
+	parseTime := func(key string) (t time.Time, e error) {
+		v := q.Get(key)
+		if v == "" {
+			return
+		}
+		if t, e = time.Parse(time.RFC3339, v); e != nil {
+			if t, e = time.ParseInLocation(time.DateOnly, v, time.Local); e != nil {
+				e = errors.Errorf("invalid %s %q, expecting RFC 3339 time or yyyy-mm-dd", key, v)
+			}
+		}
+		return
+	}
+	parseInt := func(key string) (n int, e error) {
+		if v := q.Get(key); v != "" {
+			if n, e = strconv.Atoi(v); e != nil {
+				e = errors.Errorf("invalid %s %q", key, v)
+			}
+		}
+		return
+	}
+	if f.From, e = parseTime("from"); e != nil {
+		return
+	}
+	if f.To, e = parseTime("to"); e != nil {
+		return
+	}
+	if f.Status, e = parseInt("status"); e != nil {
+		return
+	}
+	if f.Limit, e = parseInt("limit"); e != nil {
+		return
+	}
+	f.Host, f.Client = q.Get("host"), q.Get("client")
+	return
+}
+
+func (f TrafficFilter) query(db *gorm.DB) *gorm.DB {
+	if !f.From.IsZero() {
+		db = db.Where("timestamp >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		db = db.Where("timestamp < ?", f.To)
+	}
+	if f.Host != "" {
+		db = db.Where("destination_ip = ? OR destination_ip LIKE ?", f.Host, net.JoinHostPort(f.Host, "%"))
+	}
+	if f.Status != 0 {
+		db = db.Where("status_code = ?", f.Status)
+	}
+	if f.Client != "" {
+		db = db.Where("source_ip = ? OR source_ip LIKE ?", f.Client, net.JoinHostPort(f.Client, "%"))
+	}
+	return db.Order("timestamp, id")
+}
+
+// ExportHAR writes the network traffic selected by the filter to w as a HAR 1.2 document.
+// Entries are streamed, so that large exports aren't held in memory.
+func ExportHAR(w io.Writer, f TrafficFilter) (n int, e error) {
+	bw := bufio.NewWriter(w)
+	creator, _ := json.Marshal(harCreator{Name: "roprox", Version: "1.0"})
+	bw.WriteString(`{"log":{"version":"1.2","creator":`)
+	bw.Write(creator)
+	bw.WriteString(`,"entries":[`)
+	var batch []*types.NetworkTraffic
+	// batches are paged manually to honor the limit
+	for offset := 0; f.Limit <= 0 || offset < f.Limit; offset += len(batch) {
+		size := 100
+		if f.Limit > 0 {
+			size = min(size, f.Limit-offset)
+		}
+		batch = batch[:0]
+		q := f.query(data.GormDB.Model(&types.NetworkTraffic{})).Offset(offset).Limit(size)
+		if e = q.Find(&batch).Error; e != nil {
+			return n, errors.Wrap(e, "failed to query network traffic")
+		}
+		for _, nt := range batch {
+			if e = bodies.load(nt); e != nil {
+				return n, e
+			}
+			entry, e := json.Marshal(toHAREntry(nt))
+			if e != nil {
+				return n, errors.Wrapf(e, "failed to encode network traffic #%d", nt.ID)
+			}
+			if n > 0 {
+				bw.WriteByte(',')
+			}
+			bw.Write(entry)
+			n++
+		}
+		if len(batch) < size {
+			break
+		}
+	}
+	bw.WriteString("]}}\n")
+	return n, bw.Flush()
+}
+
+func toHAREntry(nt *types.NetworkTraffic) harEntry {
+	reqHeader, resHeader := parseHeaders(nt.RequestHeaders), parseHeaders(nt.ResponseHeaders)
+	entry := harEntry{
+		StartedDateTime: nt.Timestamp,
+		ID:              nt.ID,
+		ClientAddress:   nt.SourceIP,
+		Request: harRequest{
+			Method:      nt.Method,
+			URL:         nt.URL,
+			HTTPVersion: nt.Protocol,
+			Cookies:     harCookies((&http.Request{Header: reqHeader}).Cookies()),
+			Headers:     harHeaders(reqHeader),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    len(nt.RequestBody),
+		},
+		Response: harResponse{
+			Status:      int(nt.StatusCode),
+			StatusText:  http.StatusText(int(nt.StatusCode)),
+			HTTPVersion: nt.Protocol,
+			Cookies:     harCookies((&http.Response{Header: resHeader}).Cookies()),
+			Headers:     harHeaders(resHeader),
+			Content:     harContent{MimeType: nt.MIMEType},
+			RedirectURL: resHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    len(nt.ResponseBody),
+		},
+	}
+	if nt.Redacted != "" {
+		if e := json.Unmarshal([]byte(nt.Redacted), &entry.Redacted); e != nil {
+			log.Warnf("invalid redacted fields of network traffic #%d: %+v", nt.ID, e)
+		}
+	}
+	if u, e := url.Parse(nt.URL); e == nil {
+		for name, values := range u.Query() {
+			for _, v := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{name, v})
+			}
+		}
+	}
+	if len(nt.RequestBody) > 0 {
+		body, compressed := harBody(nt.RequestBody, reqHeader)
+		text, encoding := encodeHARText(body)
+		entry.Request.PostData = &harPostData{
+			MimeType: reqHeader.Get("Content-Type"), Text: text, Encoding: encoding, Compressed: compressed,
+			Truncated: nt.RequestTruncated,
+		}
+	}
+	body, compressed := harBody(nt.ResponseBody, resHeader)
+	content := &entry.Response.Content
+	content.Size, content.Compressed, content.Truncated = len(body), compressed, nt.ResponseTruncated
+	content.Text, content.Encoding = encodeHARText(body)
+	if host, _, e := net.SplitHostPort(nt.DestinationIP); e == nil && net.ParseIP(host) != nil {
+		entry.ServerIPAddress = host
+	}
+	return entry
+}
+
+// harBody returns the captured body decoded per Content-Encoding, as HAR bodies are meant to be.
+// Bodies that can't be decoded, e.g. truncated ones, are returned as is and reported compressed.
+func harBody(body []byte, h http.Header) (decoded []byte, compressed bool) {
+	decoded, e := decodeContent(body, h.Get("Content-Encoding"))
+	if e != nil {
+		return body, true
+	}
+	return decoded, false
+}
+
+// encodeHARText returns the body as is if it's valid UTF-8, otherwise in base64.
+func encodeHARText(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeHARText(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// parseHeaders parses headers formatted by PrettyPrintHeaders.
+func parseHeaders(s string) http.Header {
+	h := make(http.Header)
+	for _, line := range strings.Split(s, "\n") {
+		if name, value, found := strings.Cut(line, ": "); found {
+			h[name] = append(h[name], value)
+		}
+	}
+	return h
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for name, values := range h {
+		for _, v := range values {
+			nvs = append(nvs, harNameValue{name, v})
+		}
+	}
+	return nvs
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	hcs := []harCookie{}
+	for _, c := range cookies {
+		hc := harCookie{Name: c.Name, Value: c.Value, Path: c.Path, Domain: c.Domain, HTTPOnly: c.HttpOnly, Secure: c.Secure}
+		if !c.Expires.IsZero() {
+			hc.Expires = &c.Expires
+		}
+		hcs = append(hcs, hc)
+	}
+	return hcs
+}
+
+// ImportHAR loads the entries of the HAR document into the network_traffic table.
+// Nothing is imported if any entry is invalid, or if there are more than maxEntries entries unless it's 0.
+func ImportHAR(r io.Reader, maxEntries int) (n int, e error) {
+	nts, e := readHAR(r, maxEntries)
+	if e != nil {
+		return 0, e
+	}
+	if len(nts) == 0 {
+		return 0, nil
+	}
+	for _, nt := range nts {
+		// imported entries are redacted like captures
+		if e = loadRedactor().redactTraffic(nt); e != nil {
+			return 0, e
+		}
+		if e = bodies.offload(nt); e != nil {
+			return 0, e
+		}
+	}
+	if e = data.GormDB.CreateInBatches(nts, 100).Error; e != nil {
+		return 0, errors.Wrap(e, "failed to save HAR entries")
+	}
+	return len(nts), nil
+}
+
+// readHAR maps the entries of the HAR document to unsaved NetworkTraffic records.
+// Documents with more than maxEntries entries are rejected unless it's 0.
+func readHAR(r io.Reader, maxEntries int) (nts []*types.NetworkTraffic, e error) {
+	var doc harDocument
+	if e = json.NewDecoder(r).Decode(&doc); e != nil {
+		return nil, errors.Wrap(e, "failed to decode HAR")
+	}
+	if maxEntries > 0 && len(doc.Log.Entries) > maxEntries {
+		return nil, errors.Errorf("HAR has %d entries, exceeding the limit of %d", len(doc.Log.Entries), maxEntries)
+	}
+	nts = make([]*types.NetworkTraffic, 0, len(doc.Log.Entries))
+	for i, entry := range doc.Log.Entries {
+		nt, e := fromHAREntry(entry)
+		if e != nil {
+			return nil, errors.Wrapf(e, "invalid HAR entry #%d", i)
+		}
+		nts = append(nts, nt)
+	}
+	return
+}
+
+func fromHAREntry(entry harEntry) (nt *types.NetworkTraffic, e error) {
+	u, e := url.Parse(entry.Request.URL)
+	if e != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid request URL %q", entry.Request.URL)
+	}
+	nt = &types.NetworkTraffic{
+		Timestamp:     entry.StartedDateTime,
+		SourceIP:      entry.ClientAddress,
+		DestinationIP: u.Host,
+		Protocol:      entry.Request.HTTPVersion,
+		Method:        entry.Request.Method,
+		URL:           entry.Request.URL,
+		StatusCode:    uint(entry.Response.Status),
+		MIMEType:      entry.Response.Content.MimeType,
+	}
+	if port := u.Port(); port != "" {
+		nt.DestinationPort, _ = strconv.Atoi(port)
+	}
+	if _, port, e := net.SplitHostPort(entry.ClientAddress); e == nil {
+		nt.SourcePort, _ = strconv.Atoi(port)
+	}
+	if pd := entry.Request.PostData; pd != nil {
+		if nt.RequestBody, e = decodeHARText(pd.Text, pd.Encoding); e != nil {
+			return nil, errors.Wrap(e, "invalid request body")
+		}
+		nt.RequestTruncated = pd.Truncated
+	}
+	content := entry.Response.Content
+	if nt.ResponseBody, e = decodeHARText(content.Text, content.Encoding); e != nil {
+		return nil, errors.Wrap(e, "invalid response body")
+	}
+	nt.ResponseTruncated = content.Truncated
+	if len(entry.Redacted) > 0 {
+		redacted, _ := json.Marshal(entry.Redacted)
+		nt.Redacted = string(redacted)
+	}
+	reqHeader, resHeader := httpHeader(entry.Request.Headers), httpHeader(entry.Response.Headers)
+	if pd := entry.Request.PostData; pd == nil || !pd.Compressed {
+		nt.RequestBody, reqHeader = relayedBody(nt.RequestBody, reqHeader)
+	}
+	if !content.Compressed {
+		nt.ResponseBody, resHeader = relayedBody(nt.ResponseBody, resHeader)
+	}
+	nt.RequestHeaders, nt.ResponseHeaders = PrettyPrintHeaders(reqHeader), PrettyPrintHeaders(resHeader)
+	nt.ResponseContentLength = uint(len(nt.ResponseBody))
+	nt.Size = int64(len(nt.RequestBody) + len(nt.ResponseBody))
+	return nt, nil
+}
+
+// relayedBody returns the HAR body and header as relayed. HAR bodies are meant to be decoded, so they're
+// encoded again per Content-Encoding, unless they're encoded already as exported by earlier versions.
+// If the encoding isn't supported, Content-Encoding is dropped so that it doesn't claim a decoded body
+// is compressed.
+func relayedBody(body []byte, h http.Header) ([]byte, http.Header) {
+	ce := h.Get("Content-Encoding")
+	if len(body) == 0 || contentEncoding(ce) == "" {
+		return body, h
+	}
+	if _, e := decodeContent(body, ce); e == nil {
+		return body, h
+	}
+	if encoded, e := encodeContent(body, ce); e == nil {
+		return encoded, h
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	return body, h
+}
+
+func httpHeader(nvs []harNameValue) http.Header {
+	h := make(http.Header, len(nvs))
+	for _, nv := range nvs {
+		h[nv.Name] = append(h[nv.Name], nv.Value)
+	}
+	return h
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestParseTrafficFilter(t *testing.T) {
+	f, e := ParseTrafficFilter(url.Values{
+		"from": {"2024-03-01"}, "to": {"2024-03-02T08:00:00Z"}, "host": {"a.test"}, "status": {"404"}, "limit": {"5"},
+	})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if f.From.Day() != 1 || f.To.Hour() != 8 || f.Host != "a.test" || f.Status != 404 || f.Limit != 5 {
+		t.Errorf("filter = %+v", f)
+	}
+	for _, q := range []url.Values{{"from": {"yesterday"}}, {"status": {"ok"}}} {
+		if _, e := ParseTrafficFilter(q); e == nil {
+			t.Errorf("ParseTrafficFilter(%v) shall fail", q)
+		}
+	}
+}
+
+func TestHARRoundTrip(t *testing.T) {
+	const host = "har.test"
+	cleanup := func() {
+		data.GormDB.Unscoped().Where("destination_ip LIKE ?", host+"%").Delete(&types.NetworkTraffic{})
+	}
+	cleanup()
+	defer cleanup()
+
+	start := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	binary := []byte{0x89, 'P', 'N', 'G', 0xff, 0x00}
+	records := []*types.NetworkTraffic{
+		{
+			Timestamp: start, SourceIP: "10.0.0.1:50000", DestinationIP: host, Protocol: "HTTP/1.1",
+			Method: "POST", URL: "http://har.test/login?next=%2Fhome", StatusCode: 302,
+			RequestHeaders:  "Content-Type: application/x-www-form-urlencoded\nCookie: sid=1\n",
+			RequestBody:     []byte("user=a"),
+			ResponseHeaders: "Location: /home\nSet-Cookie: sid=2; Path=/; HttpOnly\n",
+		},
+		{
+			Timestamp: start.Add(time.Minute), SourceIP: "10.0.0.2:50001", DestinationIP: host + ":8080",
+			Protocol: "HTTP/1.1", Method: "GET", URL: "http://har.test:8080/logo.png", StatusCode: 200,
+			ResponseHeaders: "Content-Type: image/png\n", ResponseBody: binary,
+			ResponseContentLength: uint(len(binary)), MIMEType: "image/png",
+		},
+		{
+			Timestamp: start.Add(time.Hour), SourceIP: "10.0.0.1:50002", DestinationIP: host,
+			Protocol: "HTTP/1.1", Method: "GET", URL: "http://har.test/later", StatusCode: 200,
+		},
+	}
+	if e := data.GormDB.Create(records).Error; e != nil {
+		t.Fatal(e)
+	}
+
+	var buf bytes.Buffer
+	n, e := ExportHAR(&buf, TrafficFilter{From: start, To: start.Add(time.Hour), Host: host})
+	if e != nil {
+		t.Fatal(e)
+	}
+	var doc harDocument
+	if e = json.Unmarshal(buf.Bytes(), &doc); e != nil {
+		t.Fatalf("invalid HAR: %v\n%s", e, buf.String())
+	}
+	if n != 2 || len(doc.Log.Entries) != 2 || doc.Log.Version != "1.2" {
+		t.Fatalf("exported %d entries of HAR %s, want 2 of HAR 1.2", len(doc.Log.Entries), doc.Log.Version)
+	}
+	login, logo := doc.Log.Entries[0], doc.Log.Entries[1]
+	if login.ID != records[0].ID || login.Request.PostData == nil || login.Request.PostData.Text != "user=a" ||
+		len(login.Request.QueryString) != 1 || login.Request.QueryString[0].Value != "/home" ||
+		len(login.Request.Cookies) != 1 || len(login.Response.Cookies) != 1 || login.Response.RedirectURL != "/home" {
+		t.Errorf("login entry = %+v", login)
+	}
+	if logo.Response.Content.Encoding != "base64" || logo.Response.Content.MimeType != "image/png" {
+		t.Errorf("logo content = %+v, want base64 encoded image/png", logo.Response.Content)
+	}
+
+	buf.Reset()
+	if n, e = ExportHAR(&buf, TrafficFilter{Host: host, Client: "10.0.0.1", Limit: 1}); e != nil || n != 1 {
+		t.Errorf("export by client with limit = %d, %v, want 1 entry", n, e)
+	}
+
+	cleanup()
+	raw, _ := json.Marshal(doc)
+	if n, e = ImportHAR(bytes.NewReader(raw), 1); e == nil || n != 0 {
+		t.Errorf("ImportHAR() beyond max entries = %d, %v, want an error", n, e)
+	}
+	if n, e = ImportHAR(bytes.NewReader(raw), 0); e != nil || n != 2 {
+		t.Fatalf("ImportHAR() = %d, %v, want 2", n, e)
+	}
+	var imported []*types.NetworkTraffic
+	data.GormDB.Where("destination_ip LIKE ?", host+"%").Order("timestamp").Find(&imported)
+	if len(imported) != 2 {
+		t.Fatalf("imported %d records, want 2", len(imported))
+	}
+	if got := imported[0]; string(got.RequestBody) != "user=a" || got.SourceIP != "10.0.0.1:50000" ||
+		got.SourcePort != 50000 || parseHeaders(got.ResponseHeaders).Get("Location") != "/home" {
+		t.Errorf("imported login = %+v", got)
+	}
+	if got := imported[1]; !bytes.Equal(got.ResponseBody, binary) || got.DestinationPort != 8080 ||
+		got.DestinationIP != host+":8080" || !got.Timestamp.Equal(start.Add(time.Minute)) {
+		t.Errorf("imported logo = %+v", got)
+	}
+
+	if _, e = ImportHAR(bytes.NewReader([]byte(`{"log":{"entries":[{"request":{"url":"/relative"}}]}}`)), 0); e == nil {
+		t.Error("importing entry with relative URL shall fail")
+	}
+}
+
+func TestImportHARRedacts(t *testing.T) {
+	const host = "redact.har.test"
+	defer data.GormDB.Unscoped().Where("destination_ip = ?", host).Delete(&types.NetworkTraffic{})
+
+	raw := `{"log":{"version":"1.2","entries":[{"startedDateTime":"2024-03-01T10:00:00Z",
+		"request":{"method":"POST","url":"http://redact.har.test/login?token=t1","httpVersion":"HTTP/1.1",
+			"headers":[{"name":"Authorization","value":"Bearer t2"},{"name":"Content-Type","value":"application/json"}],
+			"postData":{"mimeType":"application/json","text":"{\"password\":\"p1\"}"}},
+		"response":{"status":200,"httpVersion":"HTTP/1.1",
+			"headers":[{"name":"Content-Type","value":"application/json"},{"name":"Content-Encoding","value":"gzip"}],
+			"content":{"mimeType":"application/json","text":"{\"access_token\":\"t3\"}"}},
+		"_redacted":["request.header.Cookie"]}]}}`
+	if n, e := ImportHAR(bytes.NewReader([]byte(raw)), 0); e != nil || n != 1 {
+		t.Fatalf("ImportHAR() = %d, %v, want 1", n, e)
+	}
+	var nt types.NetworkTraffic
+	if e := data.GormDB.Where("destination_ip = ?", host).First(&nt).Error; e != nil {
+		t.Fatal(e)
+	}
+	body, e := decodeContent(nt.ResponseBody, "gzip")
+	for _, secret := range []string{"t1", "t2", "p1"} {
+		if bytes.Contains([]byte(nt.URL+nt.RequestHeaders+string(nt.RequestBody)), []byte(secret)) {
+			t.Errorf("imported request contains %q", secret)
+		}
+	}
+	if e != nil || bytes.Contains(body, []byte("t3")) {
+		t.Errorf("imported response body = %s, %v", body, e)
+	}
+	want := `["request.body.password","request.header.Authorization","request.header.Cookie",` +
+		`"request.query.token","response.body.access_token"]`
+	if nt.Redacted != want {
+		t.Errorf("redacted = %s, want %s", nt.Redacted, want)
+	}
+}
+
+func TestHARContentEncoding(t *testing.T) {
+	const host = "encoding.har.test"
+	cleanup := func() { data.GormDB.Unscoped().Where("destination_ip = ?", host).Delete(&types.NetworkTraffic{}) }
+	cleanup()
+	defer cleanup()
+
+	gzipped, _ := encodeContent([]byte(`{"ok":true}`), "gzip")
+	records := []*types.NetworkTraffic{
+		{
+			Timestamp: time.Now(), DestinationIP: host, Method: "GET", URL: "http://encoding.har.test/gzip",
+			StatusCode: 200, ResponseHeaders: "Content-Encoding: gzip\nContent-Type: application/json\n",
+			ResponseBody: gzipped,
+		},
+		{
+			Timestamp: time.Now(), DestinationIP: host, Method: "GET", URL: "http://encoding.har.test/br",
+			StatusCode: 200, ResponseHeaders: "Content-Encoding: br\n", ResponseBody: []byte{0x1b, 0xff},
+		},
+	}
+	if e := data.GormDB.Create(records).Error; e != nil {
+		t.Fatal(e)
+	}
+	var buf bytes.Buffer
+	if _, e := ExportHAR(&buf, TrafficFilter{Host: host}); e != nil {
+		t.Fatal(e)
+	}
+	var doc harDocument
+	if e := json.Unmarshal(buf.Bytes(), &doc); e != nil || len(doc.Log.Entries) != 2 {
+		t.Fatalf("invalid HAR: %v\n%s", e, buf.String())
+	}
+	if c := doc.Log.Entries[0].Response.Content; c.Text != `{"ok":true}` || c.Size != 11 || c.Compressed {
+		t.Errorf("gzip content = %+v, want decoded", c)
+	}
+	if c := doc.Log.Entries[1].Response.Content; !c.Compressed || c.Encoding != "base64" {
+		t.Errorf("br content = %+v, want compressed", c)
+	}
+
+	cleanup()
+	// a decoded body of an encoding that can't be applied again
+	doc.Log.Entries = append(doc.Log.Entries, doc.Log.Entries[1])
+	doc.Log.Entries[2].Response.Content = harContent{Text: "plain"}
+	raw, _ := json.Marshal(doc)
+	if n, e := ImportHAR(bytes.NewReader(raw), 0); e != nil || n != 3 {
+		t.Fatalf("ImportHAR() = %d, %v, want 3", n, e)
+	}
+	var imported []*types.NetworkTraffic
+	data.GormDB.Where("destination_ip = ?", host).Order("id").Find(&imported)
+	if plain, e := decodeContent(imported[0].ResponseBody, "gzip"); e != nil || string(plain) != `{"ok":true}` {
+		t.Errorf("imported gzip body = %q, %v, want it compressed again", plain, e)
+	}
+	if got := imported[1]; !bytes.Equal(got.ResponseBody, []byte{0x1b, 0xff}) ||
+		parseHeaders(got.ResponseHeaders).Get("Content-Encoding") != "br" {
+		t.Errorf("imported br = %q %s, want it as exported", got.ResponseBody, got.ResponseHeaders)
+	}
+	if got := imported[2]; string(got.ResponseBody) != "plain" || parseHeaders(got.ResponseHeaders).Get("Content-Encoding") != "" {
+		t.Errorf("imported decoded br = %q %s, want Content-Encoding dropped", got.ResponseBody, got.ResponseHeaders)
+	}
+}
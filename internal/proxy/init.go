@@ -7,6 +7,7 @@ import (
 
 	"github.com/agux/roprox/internal/conf"
 	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/network"
 	"github.com/agux/roprox/internal/types"
 	"gorm.io/gorm"
 )
@@ -34,16 +35,35 @@ func (cache *proxyServerCache) RefreshData(db *gorm.DB) error {
 		return err
 	}
 	log.Infof("reloaded %d qualified proxy from the backend pool", len(servers))
+	dropStaleTransports(cache.proxyServers, servers)
 	cache.proxyServers = servers
 	cache.cacheLastUpdated = currentTime
+	usage.evict(servers)
+	reputation.prune()
 
 	cache.Unlock()
 
 	return nil
 }
 
+// dropStaleTransports drops the transports of proxies evicted from the pool or scored below threshold.
+func dropStaleTransports(previous, current []types.ProxyServer) {
+	retained := make(map[string]bool, len(current))
+	for _, ps := range current {
+		retained[ps.UrlString()] = true
+	}
+	for i := range previous {
+		if !retained[previous[i].UrlString()] {
+			network.DropTransport(&previous[i])
+		}
+	}
+}
+
 // GetData safely returns the in-memory data.
 func (cache *proxyServerCache) GetData() []types.ProxyServer {
+	if cache == nil {
+		return nil
+	}
 	cache.RLock()
 	defer cache.RUnlock()
 	return cache.proxyServers
@@ -53,8 +73,13 @@ func init() {
 	certStore = make(map[string]tls.Certificate)
 
 	if !conf.Args.Proxy.BypassTraffic {
+		reputation.load()
 		refreshProxyCache()
 	}
+
+	if conf.Args.Proxy.Session.Enabled {
+		go sessions.evictExpired()
+	}
 }
 
 func refreshProxyCache() {
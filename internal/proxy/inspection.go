@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+// captureFilter matches exchanges satisfying all of its non-empty criteria.
+type captureFilter struct {
+	hosts       []string
+	methods     map[string]bool
+	statusCodes map[int]bool
+	mimeTypes   []string
+	maxBodySize int
+}
+
+func compileCaptureFilters(args []conf.CaptureFilterArgs) (fs []*captureFilter) {
+	for _, fa := range args {
+		f := &captureFilter{hosts: fa.Hosts, maxBodySize: fa.MaxBodySize}
+		if len(fa.Methods) > 0 {
+			f.methods = make(map[string]bool, len(fa.Methods))
+			for _, m := range fa.Methods {
+				f.methods[strings.ToUpper(m)] = true
+			}
+		}
+		if len(fa.StatusCodes) > 0 {
+			f.statusCodes = make(map[int]bool, len(fa.StatusCodes))
+			for _, code := range fa.StatusCodes {
+				f.statusCodes[code] = true
+			}
+		}
+		for _, mt := range fa.MIMETypes {
+			f.mimeTypes = append(f.mimeTypes, strings.ToLower(mt))
+		}
+		fs = append(fs, f)
+	}
+	return
+}
+
+// matchesRequest matches the request criteria only.
+func (f *captureFilter) matchesRequest(req *http.Request) bool {
+	if len(f.hosts) > 0 && !hostMatches(targetHost(req), f.hosts) {
+		return false
+	}
+	return f.methods == nil || f.methods[req.Method]
+}
+
+// requestOnly returns whether the filter has no response criteria.
+func (f *captureFilter) requestOnly() bool {
+	return f.statusCodes == nil && len(f.mimeTypes) == 0
+}
+
+// matches returns whether the exchange satisfies all criteria. MIME types match as prefixes, e.g. "text/".
+func (f *captureFilter) matches(req *http.Request, res *http.Response) bool {
+	if !f.matchesRequest(req) {
+		return false
+	}
+	if f.statusCodes != nil && !f.statusCodes[res.StatusCode] {
+		return false
+	}
+	if len(f.mimeTypes) == 0 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	for _, mt := range f.mimeTypes {
+		if strings.HasPrefix(mediaType, mt) {
+			return true
+		}
+	}
+	return false
+}
+
+// inspector decides which exchanges are captured and writes the captures in batches
+// from a bounded queue, so that the request path is never blocked by the database.
+// Captures are dropped while the queue is full.
+type inspector struct {
+	includes []*captureFilter
+	excludes []*captureFilter
+	// maxBodySize caps captured bodies unless overridden by the matching include filter.
+	maxBodySize   int
+	batchSize     int
+	flushInterval time.Duration
+
+	sync.RWMutex
+	once    sync.Once
+	queue   chan *types.NetworkTraffic
+	closed  bool
+	done    chan struct{}
+	dropped atomic.Int64
+	written atomic.Int64
+	failed  atomic.Int64
+}
+
+// InspectionStats reports the state of the traffic inspection queue.
+type InspectionStats struct {
+	Queued  int   `json:"queued"`
+	Written int64 `json:"written"`
+	Dropped int64 `json:"dropped"`
+	Failed  int64 `json:"failed"`
+}
+
+var inspections = newInspector(
+	conf.Args.Proxy.Inspection.Include,
+	conf.Args.Proxy.Inspection.Exclude,
+	conf.Args.Proxy.InspectionMaxBodySize,
+	conf.Args.Proxy.Inspection.QueueSize,
+	conf.Args.Proxy.Inspection.BatchSize,
+	time.Duration(conf.Args.Proxy.Inspection.FlushInterval)*time.Millisecond,
+)
+
+func newInspector(includes, excludes []conf.CaptureFilterArgs, maxBodySize, queueSize, batchSize int,
+	flushInterval time.Duration) *inspector {
+	return &inspector{
+		includes:      compileCaptureFilters(includes),
+		excludes:      compileCaptureFilters(excludes),
+		maxBodySize:   maxBodySize,
+		batchSize:     max(batchSize, 1),
+		flushInterval: flushInterval,
+		queue:         make(chan *types.NetworkTraffic, max(queueSize, 1)),
+		done:          make(chan struct{}),
+	}
+}
+
+// wants returns whether the exchange of the request may be captured, judging by request criteria only.
+// It lets exchanges bound not to be captured skip copying the request body.
+func (i *inspector) wants(req *http.Request) bool {
+	for _, f := range i.excludes {
+		if f.requestOnly() && f.matchesRequest(req) {
+			return false
+		}
+	}
+	if len(i.includes) == 0 {
+		return true
+	}
+	for _, f := range i.includes {
+		if f.matchesRequest(req) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestBodyLimit returns the max bytes of the request body that may be captured, judging by request criteria only,
+// i.e. the largest limit of the include filters the request may match. Zero means unlimited.
+func (i *inspector) requestBodyLimit(req *http.Request) int {
+	if len(i.includes) == 0 {
+		return max(i.maxBodySize, 0)
+	}
+	limit := 0
+	for _, f := range i.includes {
+		if !f.matchesRequest(req) {
+			continue
+		}
+		l := i.maxBodySize
+		if f.maxBodySize != 0 {
+			l = f.maxBodySize
+		}
+		if l <= 0 {
+			return 0
+		}
+		limit = max(limit, l)
+	}
+	return limit
+}
+
+// accepts returns whether the exchange is captured, along with the max bytes of its captured bodies.
+func (i *inspector) accepts(req *http.Request, res *http.Response) (ok bool, maxBodySize int) {
+	for _, f := range i.excludes {
+		if f.matches(req, res) {
+			return false, 0
+		}
+	}
+	if len(i.includes) == 0 {
+		return true, i.maxBodySize
+	}
+	for _, f := range i.includes {
+		if f.matches(req, res) {
+			if f.maxBodySize != 0 {
+				return true, f.maxBodySize
+			}
+			return true, i.maxBodySize
+		}
+	}
+	return false, 0
+}
+
+// start launches the background writer unless it's running.
+func (i *inspector) start() {
+	i.once.Do(func() { go i.run() })
+}
+
+// enqueue hands the capture over to the background writer, or drops it if the queue is full.
+func (i *inspector) enqueue(nt *types.NetworkTraffic) bool {
+	i.start()
+	i.RLock()
+	defer i.RUnlock()
+	if i.closed {
+		return false
+	}
+	select {
+	case i.queue <- nt:
+		return true
+	default:
+		if n := i.dropped.Add(1); n == 1 || n%100 == 0 {
+			log.Warnf("traffic inspection queue is full, %d captures dropped so far", n)
+		}
+		return false
+	}
+}
+
+func (i *inspector) run() {
+	defer close(i.done)
+	batch := make([]*types.NetworkTraffic, 0, i.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for _, nt := range batch {
+			if e := bodies.offload(nt); e != nil {
+				log.Warnf("failed to offload captured bodies, keeping them in database: %+v", e)
+			}
+		}
+		if e := data.GormDB.CreateInBatches(batch, i.batchSize).Error; e != nil {
+			i.failed.Add(int64(len(batch)))
+			log.Warnf("failed to save %d traffic inspections to database: %+v", len(batch), e)
+		} else {
+			i.written.Add(int64(len(batch)))
+		}
+		batch = make([]*types.NetworkTraffic, 0, i.batchSize)
+	}
+	var tick <-chan time.Time
+	if i.flushInterval > 0 {
+		ticker := time.NewTicker(i.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case nt, ok := <-i.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, nt); len(batch) >= i.batchSize {
+				flush()
+			}
+		case <-tick:
+			flush()
+		}
+	}
+}
+
+// close stops accepting captures and waits for the queued ones to be written.
+func (i *inspector) close() {
+	i.start()
+	i.Lock()
+	if i.closed {
+		i.Unlock()
+		return
+	}
+	i.closed = true
+	close(i.queue)
+	i.Unlock()
+	<-i.done
+	if n := i.dropped.Load(); n > 0 {
+		log.Warnf("%d traffic inspection captures were dropped as the queue was full", n)
+	}
+}
+
+func (i *inspector) stats() InspectionStats {
+	return InspectionStats{
+		Queued:  len(i.queue),
+		Written: i.written.Load(),
+		Dropped: i.dropped.Load(),
+		Failed:  i.failed.Load(),
+	}
+}
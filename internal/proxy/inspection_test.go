@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestInspectorFilters(t *testing.T) {
+	i := newInspector(
+		[]conf.CaptureFilterArgs{
+			{Hosts: []string{"api.test"}, Methods: []string{"get", "post"}, MIMETypes: []string{"application/json"}, MaxBodySize: 16},
+			{Hosts: []string{"www.test"}, StatusCodes: []int{200}},
+		},
+		[]conf.CaptureFilterArgs{
+			{Hosts: []string{"private.api.test"}},
+			{MIMETypes: []string{"image/"}},
+		},
+		1024, 8, 8, 0,
+	)
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		status      int
+		contentType string
+		wants       bool
+		accepts     bool
+		maxBodySize int
+	}{
+		{"included json", http.MethodPost, "http://v1.api.test/users", 200, "application/json; charset=utf-8", true, true, 16},
+		{"included html", http.MethodGet, "http://www.test/", 200, "text/html", true, true, 1024},
+		{"excluded host", http.MethodGet, "http://private.api.test/", 200, "application/json", false, false, 0},
+		{"excluded mime", http.MethodGet, "http://www.test/logo.png", 200, "image/png", true, false, 0},
+		{"other method", http.MethodDelete, "http://api.test/users/1", 200, "application/json", false, false, 0},
+		{"other mime", http.MethodGet, "http://api.test/", 200, "text/plain", true, false, 0},
+		{"other status", http.MethodGet, "http://www.test/missing", 404, "text/html", true, false, 0},
+		{"other host", http.MethodGet, "http://other.test/", 200, "text/html", false, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.url, nil)
+			res := &http.Response{StatusCode: tt.status, Header: http.Header{"Content-Type": {tt.contentType}}}
+			if got := i.wants(req); got != tt.wants {
+				t.Errorf("wants() = %v, want %v", got, tt.wants)
+			}
+			ok, maxBodySize := i.accepts(req, res)
+			if ok != tt.accepts || maxBodySize != tt.maxBodySize {
+				t.Errorf("accepts() = %v, %d, want %v, %d", ok, maxBodySize, tt.accepts, tt.maxBodySize)
+			}
+			// the request body limit covers whatever limit the response may yield
+			if l := i.requestBodyLimit(req); tt.accepts && l < tt.maxBodySize {
+				t.Errorf("requestBodyLimit() = %d, want at least %d", l, tt.maxBodySize)
+			}
+		})
+	}
+}
+
+func TestInspectorQueue(t *testing.T) {
+	const url = "http://inspection.test/queue"
+	defer data.GormDB.Unscoped().Where("url = ?", url).Delete(&types.NetworkTraffic{})
+
+	i := newInspector(nil, nil, 0, 3, 2, 0)
+	// hold the writer back so that the queue fills up
+	i.once.Do(func() {})
+	for n := 0; n < 5; n++ {
+		i.enqueue(&types.NetworkTraffic{URL: url, Method: http.MethodGet})
+	}
+	if s := i.stats(); s.Queued != 3 || s.Dropped != 2 {
+		t.Errorf("stats = %+v, want 3 queued and 2 dropped", s)
+	}
+	go i.run()
+	i.close()
+	if s := i.stats(); s.Queued != 0 || s.Written != 3 || s.Failed != 0 {
+		t.Errorf("stats after close = %+v, want 3 written", s)
+	}
+	if i.enqueue(&types.NetworkTraffic{URL: url}) {
+		t.Error("enqueue() after close shall be rejected")
+	}
+	var count int64
+	data.GormDB.Model(&types.NetworkTraffic{}).Where("url = ?", url).Count(&count)
+	if count != 3 {
+		t.Errorf("saved %d captures, want 3", count)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+)
+
+// connTracker tracks client connections across listeners so that they can be drained on shutdown.
+type connTracker struct {
+	sync.Mutex
+	// conns maps connections to whether they're idle, i.e. waiting for the next request.
+	conns   map[net.Conn]bool
+	closing bool
+	wg      sync.WaitGroup
+}
+
+var clients = &connTracker{
+	conns: make(map[net.Conn]bool),
+}
+
+// add starts tracking the connection, initially idle. It returns false if the server is shutting down.
+func (t *connTracker) add(c net.Conn) bool {
+	t.Lock()
+	defer t.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[c] = true
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) remove(c net.Conn) {
+	t.Lock()
+	defer t.Unlock()
+	if _, ok := t.conns[c]; ok {
+		delete(t.conns, c)
+		t.wg.Done()
+	}
+}
+
+// setIdle marks whether the connection is waiting for the next request.
+// It returns false if the connection shall not wait because the server is shutting down.
+func (t *connTracker) setIdle(c net.Conn, idle bool) bool {
+	t.Lock()
+	defer t.Unlock()
+	if idle && t.closing {
+		return false
+	}
+	if _, ok := t.conns[c]; ok {
+		t.conns[c] = idle
+	}
+	return true
+}
+
+// drain closes idle connections and waits for active ones to finish within the timeout.
+// Connections still active afterwards are closed.
+func (t *connTracker) drain(timeout time.Duration) {
+	t.Lock()
+	t.closing = true
+	for c, idle := range t.conns {
+		if idle {
+			c.Close()
+		}
+	}
+	t.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	t.Lock()
+	log.Warnf("closing %d client connections still active after %v", len(t.conns), timeout)
+	for c := range t.conns {
+		c.Close()
+	}
+	t.Unlock()
+	<-done
+}
+
+// closeOnDone closes the listener once the context is done, which stops its accept loop.
+func closeOnDone(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+}
+
+// Shutdown drains client connections of both listeners within the configured timeout,
+// and flushes pending captures and reputation records. It must be called once after Serve and ServeSocks5 return.
+func Shutdown() {
+	clients.drain(time.Duration(conf.Args.Proxy.ShutdownTimeout) * time.Second)
+	inspections.close()
+	reputation.flush()
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerDrain(t *testing.T) {
+	tracker := &connTracker{conns: make(map[net.Conn]bool)}
+	idle, idlePeer := net.Pipe()
+	active, activePeer := net.Pipe()
+	defer idlePeer.Close()
+	defer activePeer.Close()
+
+	// the handler of each connection returns once it fails reading from the client
+	for _, c := range []net.Conn{idle, active} {
+		if !tracker.add(c) {
+			t.Fatal("add() shall succeed before drain")
+		}
+		go func(c net.Conn) {
+			defer tracker.remove(c)
+			c.Read(make([]byte, 1))
+		}(c)
+	}
+	tracker.setIdle(active, false)
+
+	start := time.Now()
+	tracker.drain(100 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("drain() returned after %v, shall wait for the active connection until timeout", elapsed)
+	}
+	if len(tracker.conns) != 0 {
+		t.Errorf("%d connections left after drain", len(tracker.conns))
+	}
+	if tracker.add(idle) {
+		t.Error("add() shall fail while shutting down")
+	}
+	if tracker.setIdle(active, true) {
+		t.Error("setIdle() shall fail while shutting down")
+	}
+}
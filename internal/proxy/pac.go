@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+// pacPrologue defines helpers used by the generated conditions.
+const pacPrologue = `function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  var isIPv4 = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+  var port = url.match(/^[a-z]+:\/\/(?:[^\/@]*@)?(?:\[[^\]]*\]|[^\/:]*):(\d+)/i);
+  port = port ? parseInt(port[1], 10) : (/^(https|wss):/i.test(url) ? 443 : 80);
+`
+
+// generatePAC generates the proxy auto-config file directing clients to roprox at proxyAddr.
+// Bypass domains and routing rules with direct action are resolved on the client side, so such
+// hosts skip roprox entirely. Rules are translated in order until the first one that can't be
+// evaluated by the client, after which roprox decides.
+func generatePAC(proxyAddr string, bypassDomains []string, rs []*routingRule) string {
+	var sb strings.Builder
+	sb.WriteString(pacPrologue)
+	direct := `"DIRECT"`
+	viaProxy := strconv.Quote("PROXY " + proxyAddr)
+
+	if len(bypassDomains) > 0 {
+		fmt.Fprintf(&sb, "  if (%s) return %s;\n", pacDomainSuffix(bypassDomains), direct)
+	}
+	for _, r := range rs {
+		// keep the description within the line comment
+		desc := strings.NewReplacer("\r", " ", "\n", " ").Replace(r.String())
+		cond, ok := pacCondition(r)
+		if !ok {
+			fmt.Fprintf(&sb, "  // rule %s and the following ones are evaluated by roprox\n", desc)
+			break
+		}
+		result := viaProxy
+		if types.ProxyMode(r.action) == types.Direct {
+			result = direct
+		}
+		fmt.Fprintf(&sb, "  // rule %s\n  if (%s) return %s;\n", desc, cond, result)
+	}
+	fmt.Fprintf(&sb, "  return %s;\n}\n", viaProxy)
+	return sb.String()
+}
+
+func pacDomainSuffix(domains []string) string {
+	var conds []string
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimPrefix(d, "."))
+		conds = append(conds, fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", strconv.Quote(d), strconv.Quote("."+d)))
+	}
+	return strings.Join(conds, " || ")
+}
+
+// pacCondition translates the rule to a JavaScript condition. It returns false if the client can't evaluate the rule.
+func pacCondition(r *routingRule) (cond string, ok bool) {
+	var conds []string
+	switch r.match {
+	case matchDomainSuffix:
+		return pacDomainSuffix(r.values), true
+	case matchDomainKeyword:
+		for _, v := range r.values {
+			conds = append(conds, fmt.Sprintf("host.indexOf(%s) >= 0", strconv.Quote(strings.ToLower(v))))
+		}
+	case matchDomainRegex:
+		for _, re := range r.regexes {
+			pattern, flags := re.String(), ""
+			if strings.HasPrefix(pattern, "(?i)") {
+				pattern, flags = pattern[len("(?i)"):], "i"
+			}
+			// RE2 syntax without JavaScript counterpart
+			for _, s := range []string{"(?P<", "(?s", "(?m", "(?U", "(?i", `\A`, `\z`, `\p`, `\P`, "[[:"} {
+				if strings.Contains(pattern, s) {
+					return "", false
+				}
+			}
+			conds = append(conds, fmt.Sprintf("new RegExp(%s, %s).test(host)", strconv.Quote(pattern), strconv.Quote(flags)))
+		}
+	case matchIPCIDR:
+		for _, cidr := range r.cidrs {
+			if cidr.IP.To4() == nil {
+				// PAC has no IPv6 counterpart of isInNet
+				continue
+			}
+			conds = append(conds, fmt.Sprintf("isInNet(host, %s, %s)",
+				strconv.Quote(cidr.IP.String()), strconv.Quote(net.IP(cidr.Mask).String())))
+		}
+		if len(conds) == 0 {
+			return "false", true
+		}
+		// isInNet resolves host names, whereas roprox only matches IP targets
+		return fmt.Sprintf("isIPv4 && (%s)", strings.Join(conds, " || ")), true
+	case matchDstPort:
+		ports := make([]int, 0, len(r.ports))
+		for port := range r.ports {
+			ports = append(ports, port)
+		}
+		sort.Ints(ports)
+		for _, port := range ports {
+			conds = append(conds, fmt.Sprintf("port == %d", port))
+		}
+	default:
+		// the client IP as seen by roprox is unknown to the client
+		return "", false
+	}
+	if len(conds) == 0 {
+		return "false", true
+	}
+	return strings.Join(conds, " || "), true
+}
+
+// pacProxyAddr returns the proxy address advertised in the PAC file: the configured one,
+// or the address the client used to fetch the file.
+func pacProxyAddr(r *http.Request) string {
+	if conf.Args.Proxy.PAC.ProxyAddr != "" {
+		return conf.Args.Proxy.PAC.ProxyAddr
+	}
+	if _, _, e := net.SplitHostPort(r.Host); e == nil {
+		return r.Host
+	}
+	host := r.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(conf.Args.Proxy.Port))
+}
+
+// handlePAC serves the proxy auto-config file, also known as wpad.dat.
+func handlePAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	pac := generatePAC(pacProxyAddr(r), conf.Args.Proxy.PAC.BypassDomains, loadRules())
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Content-Length", strconv.Itoa(len(pac)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write([]byte(pac))
+	}
+}
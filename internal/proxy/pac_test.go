@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	rs, _ := compileRules([]conf.RuleArgs{
+		{Match: "domain_suffix", Values: []string{"lan"}, Action: "direct"},
+		{Match: "ip_cidr", Values: []string{"10.0.0.0/8", "fd00::/8"}, Action: "direct"},
+		{Match: "domain_regex", Values: []string{`(?i)^cdn\d+\.`}, Action: "direct"},
+		{Match: "dst_port", Values: []string{"8443", "25"}, Action: "reject"},
+		{Match: "src_ip", Values: []string{"192.168.1.10"}, Action: "direct"},
+		{Match: "domain_keyword", Values: []string{"static"}, Action: "direct"},
+	})
+	pac := generatePAC("roprox.lan:8080", []string{".intranet"}, rs)
+
+	for _, want := range []string{
+		`if (host == "intranet" || dnsDomainIs(host, ".intranet")) return "DIRECT";`,
+		`if (host == "lan" || dnsDomainIs(host, ".lan")) return "DIRECT";`,
+		`if (isIPv4 && (isInNet(host, "10.0.0.0", "255.0.0.0"))) return "DIRECT";`,
+		`if (new RegExp("^cdn\\d+\\.", "i").test(host)) return "DIRECT";`,
+		`if (port == 25 || port == 8443) return "PROXY roprox.lan:8080";`,
+		`return "PROXY roprox.lan:8080";`,
+	} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC shall contain %s\n%s", want, pac)
+		}
+	}
+	// rules after the one the client can't evaluate are left to roprox
+	if strings.Contains(pac, "static") {
+		t.Errorf("PAC shall stop translating at the src_ip rule\n%s", pac)
+	}
+}
+
+func TestServePACWithoutAPI(t *testing.T) {
+	args := conf.Args.Proxy
+	defer func() { conf.Args.Proxy = args }()
+	conf.Args.Proxy.EnableAPI, conf.Args.Proxy.PAC.Enabled = false, true
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go handleClient(server)
+	go io.WriteString(client, "GET /proxy.pac HTTP/1.1\r\nHost: roprox.lan:8080\r\n\r\n")
+	res, e := http.ReadResponse(bufio.NewReader(client), nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "FindProxyForURL") {
+		t.Errorf("GET /proxy.pac = %d %s, want the PAC file", res.StatusCode, body)
+	}
+
+	for _, tt := range []struct {
+		path string
+		pac  bool
+		want bool
+	}{
+		{"/proxy.pac", true, true},
+		{"/proxy.pac", false, false},
+		{"/roprox/sessions", true, false},
+	} {
+		conf.Args.Proxy.PAC.Enabled = tt.pac
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.URL, _ = url.Parse(tt.path)
+		if got := servesLocally(req); got != tt.want {
+			t.Errorf("servesLocally(%s) with PAC %v = %v, want %v", tt.path, tt.pac, got, tt.want)
+		}
+	}
+}
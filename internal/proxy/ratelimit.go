@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+)
+
+// errRateLimited denotes a request to the target would wait for its rate limit longer than allowed.
+var errRateLimited = errors.New("rate limit of target domain exceeded")
+
+// tokenBucket refills rate tokens per second up to burst. Tokens may drop below zero,
+// each missing token being a reservation queued behind the previous ones.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	burst = max(burst, 1)
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// advance refills the tokens accrued until now. It must be called with the lock held.
+func (b *tokenBucket) advance(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// reserve takes a token and returns how long to wait until it's available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.advance(now)
+	if b.tokens--; b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns a token taken by reserve.
+func (b *tokenBucket) cancel() {
+	b.Lock()
+	defer b.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// full returns whether the bucket is refilled, in which case forgetting it loses nothing.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.advance(now)
+	return b.tokens >= b.burst
+}
+
+// rateLimit limits requests to its domains, across all backend proxies and per proxy.
+type rateLimit struct {
+	domains    []string
+	rate       float64
+	burst      int
+	proxyRate  float64
+	proxyBurst int
+}
+
+var (
+	rateLimits     []*rateLimit
+	rateLimitsOnce sync.Once
+)
+
+// loadRateLimits compiles the rate limits defined in the configuration. Invalid limits are skipped.
+func loadRateLimits() []*rateLimit {
+	rateLimitsOnce.Do(func() {
+		var errs []error
+		rateLimits, errs = compileRateLimits(conf.Args.Proxy.RateLimits)
+		for _, e := range errs {
+			log.Error(e)
+		}
+	})
+	return rateLimits
+}
+
+func compileRateLimits(args []conf.RateLimitArgs) (ls []*rateLimit, errs []error) {
+	for i, ra := range args {
+		if ra.Rate < 0 || ra.ProxyRate < 0 || (ra.Rate == 0 && ra.ProxyRate == 0) {
+			errs = append(errs, errors.Errorf("invalid rate limit #%d: rate or proxy_rate shall be positive", i))
+			continue
+		}
+		ls = append(ls, &rateLimit{
+			domains:    ra.Domains,
+			rate:       ra.Rate,
+			burst:      ra.Burst,
+			proxyRate:  ra.ProxyRate,
+			proxyBurst: ra.ProxyBurst,
+		})
+	}
+	return
+}
+
+// rateLimitFor returns the first limit applicable to the host, along with the domain its buckets are keyed by:
+// subdomains share the bucket of the configured domain, whereas a limit without domains has buckets per host.
+func rateLimitFor(ls []*rateLimit, host string) (*rateLimit, string) {
+	for _, l := range ls {
+		if len(l.domains) == 0 {
+			return l, host
+		}
+		for _, d := range l.domains {
+			if hostMatches(host, []string{d}) {
+				return l, strings.ToLower(strings.TrimPrefix(d, "."))
+			}
+		}
+	}
+	return nil, ""
+}
+
+// bucketPruneInterval is how often refilled buckets are forgotten.
+const bucketPruneInterval = time.Minute
+
+// rateLimiter holds the token buckets of target domains and of backend proxies on them.
+type rateLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+var limiter = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+func (l *rateLimiter) bucket(key string, rate float64, burst int, now time.Time) *tokenBucket {
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.pruned) >= bucketPruneInterval {
+		l.prune(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(rate, burst, now)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// prune forgets refilled buckets. It must be called with the lock held.
+func (l *rateLimiter) prune(now time.Time) {
+	l.pruned = now
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// throttle waits until the limits of the target host, and of the backend proxy on it, allow another request.
+// It fails with errRateLimited right away if the wait would exceed timeout. proxyLimited reports whether
+// only the limit of the proxy is exceeded, in which case another proxy may take the request.
+func (l *rateLimiter) throttle(ctx context.Context, ls []*rateLimit, host string, ps *types.ProxyServer,
+	timeout time.Duration) (proxyLimited bool, e error) {
+	rl, domain := rateLimitFor(ls, host)
+	if rl == nil {
+		return
+	}
+	now := time.Now()
+	var delay, proxyDelay time.Duration
+	var reserved []*tokenBucket
+	if rl.rate > 0 {
+		b := l.bucket(domain, rl.rate, rl.burst, now)
+		delay = b.reserve(now)
+		reserved = append(reserved, b)
+	}
+	if rl.proxyRate > 0 && ps != nil {
+		b := l.bucket(domain+"|"+ps.UrlString(), rl.proxyRate, rl.proxyBurst, now)
+		proxyDelay = b.reserve(now)
+		reserved = append(reserved, b)
+	}
+	cancel := func() {
+		for _, b := range reserved {
+			b.cancel()
+		}
+	}
+
+	if delay > timeout || proxyDelay > timeout {
+		cancel()
+		if delay <= timeout {
+			return true, errors.Wrapf(errRateLimited, "%s via proxy [%s]", domain, ps.UrlString())
+		}
+		return false, errors.Wrap(errRateLimited, domain)
+	}
+	wait := max(delay, proxyDelay)
+	if wait <= 0 {
+		return
+	}
+	log.Debugf("request to %s is delayed by %v per rate limit", host, wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return
+	case <-ctx.Done():
+		cancel()
+		return false, errors.Wrapf(errRateLimited, "%s: %v", domain, ctx.Err())
+	}
+}
+
+// throttle applies the configured rate limits to a request to the host through the backend proxy.
+func throttle(ctx context.Context, host string, ps *types.ProxyServer) (proxyLimited bool, e error) {
+	return limiter.throttle(ctx, loadRateLimits(), host, ps, time.Duration(conf.Args.Proxy.RateLimitTimeout)*time.Second)
+}
+
+// upstreamErrorStatus returns the status answering the failure to reach the target:
+// 503 Service Unavailable if the request is rate limited or no proxy qualifies, otherwise fallback.
+func upstreamErrorStatus(e error, fallback int) int {
+	if errors.Is(e, errRateLimited) || errors.Is(e, errNoProxy) {
+		return http.StatusServiceUnavailable
+	}
+	return fallback
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2, now)
+	for i, want := range []time.Duration{0, 0, 500 * time.Millisecond, time.Second} {
+		if got := b.reserve(now); got != want {
+			t.Errorf("reservation #%d waits %v, want %v", i, got, want)
+		}
+	}
+	b.cancel()
+	if got := b.reserve(now.Add(time.Second)); got != 0 {
+		t.Errorf("reservation after refill waits %v, want 0", got)
+	}
+	if b.full(now.Add(time.Second)) {
+		t.Error("bucket shall not be full right after reservation")
+	}
+	if !b.full(now.Add(3 * time.Second)) {
+		t.Error("bucket shall be refilled")
+	}
+}
+
+func TestRateLimitFor(t *testing.T) {
+	ls, errs := compileRateLimits([]conf.RateLimitArgs{
+		{Domains: []string{".example.com"}, Rate: 1},
+		{Domains: []string{"invalid.test"}},
+		{ProxyRate: 1},
+	})
+	if len(ls) != 2 || len(errs) != 1 {
+		t.Fatalf("compiled %d limits with %d errors, want 2 and 1", len(ls), len(errs))
+	}
+	tests := []struct {
+		host       string
+		wantLimit  *rateLimit
+		wantDomain string
+	}{
+		{"www.example.com", ls[0], "example.com"},
+		{"example.com", ls[0], "example.com"},
+		{"other.test", ls[1], "other.test"},
+	}
+	for _, tt := range tests {
+		if l, d := rateLimitFor(ls, tt.host); l != tt.wantLimit || d != tt.wantDomain {
+			t.Errorf("rateLimitFor(%q) = %p, %q, want %p, %q", tt.host, l, d, tt.wantLimit, tt.wantDomain)
+		}
+	}
+	if l, _ := rateLimitFor(ls[:1], "other.test"); l != nil {
+		t.Errorf("rateLimitFor(other.test) = %+v, want nil", l)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	ls := []*rateLimit{{rate: 10, burst: 1, proxyRate: 1, proxyBurst: 1}}
+	p1 := &types.ProxyServer{Type: "http", Host: "10.0.0.1", Port: "8080"}
+	p2 := &types.ProxyServer{Type: "http", Host: "10.0.0.2", Port: "8080"}
+	ctx := context.Background()
+
+	if _, e := l.throttle(ctx, ls, "a.test", p1, time.Second); e != nil {
+		t.Fatal(e)
+	}
+	// the domain bucket delays the request by 100ms, whereas p1 needs 1s
+	proxyLimited, e := l.throttle(ctx, ls, "a.test", p1, 500*time.Millisecond)
+	if !errors.Is(e, errRateLimited) || !proxyLimited {
+		t.Fatalf("throttle() = %v, %v, want proxy rate limited", proxyLimited, e)
+	}
+	start := time.Now()
+	if _, e = l.throttle(ctx, ls, "a.test", p2, 500*time.Millisecond); e != nil {
+		t.Fatal(e)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("waited %v, want about 100ms per the domain rate", waited)
+	}
+	if _, e = l.throttle(ctx, ls, "b.test", p1, 0); e != nil {
+		t.Errorf("other domains shall have their own buckets: %v", e)
+	}
+
+	proxyLimited, e = l.throttle(ctx, ls, "a.test", nil, 0)
+	if !errors.Is(e, errRateLimited) || proxyLimited {
+		t.Fatalf("throttle() = %v, %v, want domain rate limited", proxyLimited, e)
+	}
+
+	// drain the refilled token so that the next request has to wait
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+	l.throttle(ctx, ls, "a.test", nil, time.Second)
+	if _, e = l.throttle(cctx, ls, "a.test", nil, time.Second); !errors.Is(e, errRateLimited) {
+		t.Errorf("throttle() with canceled context = %v, want rate limited", e)
+	}
+}
+
+func TestRateLimiterPrunes(t *testing.T) {
+	l := &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+	l.bucket("a.test", 10, 1, now).reserve(now)
+	l.bucket("b.test", 10, 1, now)
+	if len(l.buckets) != 2 {
+		t.Fatalf("%d buckets, want 2", len(l.buckets))
+	}
+	// a.test is refilled by now, b.test is never used
+	later := now.Add(bucketPruneInterval)
+	l.bucket("c.test", 10, 1, later)
+	if _, ok := l.buckets["a.test"]; ok || len(l.buckets) != 1 {
+		t.Errorf("buckets = %v, want only c.test after pruning", l.buckets)
+	}
+}
@@ -0,0 +1,364 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+)
+
+// Built-in redaction rules, applied unless disabled by Redaction.Defaults.
+var (
+	defaultRedactedHeaders = []string{
+		"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie",
+		`/(?i)^x-(.+-)?(api-?key|auth|token|secret|csrf-token|xsrf-token)$/`,
+	}
+	defaultRedactedParams = []string{
+		`/(?i)^(api[-_]?key|apikey|access[-_]?token|refresh[-_]?token|id[-_]?token|token|secret|client[-_]?secret|password|passwd|pwd|auth|signature|sig)$/`,
+	}
+	defaultRedactedFields = []string{
+		`/(?i)^(password|passwd|pwd|secret|client_?secret|token|access_?token|refresh_?token|id_?token|api_?key|private_?key|authorization|cookie)$/`,
+	}
+)
+
+// jsonMember matches a JSON object member with a scalar value, for redacting JSON bodies that can't be parsed,
+// e.g. truncated ones.
+var jsonMember = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)("(?:[^"\\]|\\.)*"|-?[\d.eE+-]+|true|false|null)`)
+
+// nameRule matches a header, parameter or JSON field name case-insensitively, or by regular expression.
+// A JSON field rule with dots matches the path from the root instead, with "*" matching any key or index.
+type nameRule struct {
+	name string
+	re   *regexp.Regexp
+	path []string
+}
+
+func (n nameRule) matches(name string) bool {
+	if n.re != nil {
+		return n.re.MatchString(name)
+	}
+	return n.path == nil && strings.EqualFold(n.name, name)
+}
+
+func (n nameRule) matchesPath(path []string) bool {
+	if n.path == nil {
+		return n.matches(path[len(path)-1])
+	}
+	if len(path) != len(n.path) {
+		return false
+	}
+	for i, seg := range n.path {
+		if seg != "*" && !strings.EqualFold(seg, path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// redactor masks secrets in captures before they're persisted.
+type redactor struct {
+	headers     []nameRule
+	params      []nameRule
+	fields      []nameRule
+	replacement string
+}
+
+var (
+	redactions     *redactor
+	redactionsOnce sync.Once
+)
+
+// loadRedactor compiles the redaction rules defined in the configuration. Invalid rules are skipped.
+func loadRedactor() *redactor {
+	redactionsOnce.Do(func() {
+		var errs []error
+		redactions, errs = compileRedactor(conf.Args.Proxy.Inspection.Redaction)
+		for _, e := range errs {
+			log.Error(e)
+		}
+	})
+	return redactions
+}
+
+func compileRedactor(args conf.RedactionArgs) (r *redactor, errs []error) {
+	r = &redactor{replacement: args.Replacement}
+	headers, params, fields := args.Headers, args.QueryParams, args.JSONFields
+	if args.Defaults {
+		headers = append(append([]string{}, defaultRedactedHeaders...), headers...)
+		params = append(append([]string{}, defaultRedactedParams...), params...)
+		fields = append(append([]string{}, defaultRedactedFields...), fields...)
+	}
+	compile := func(kind string, specs []string, paths bool) (rules []nameRule) {
+		for _, spec := range specs {
+			rule := nameRule{name: spec}
+			if len(spec) > 2 && strings.HasPrefix(spec, "/") && strings.HasSuffix(spec, "/") {
+				re, e := regexp.Compile(spec[1 : len(spec)-1])
+				if e != nil {
+					errs = append(errs, errors.Wrapf(e, "invalid redacted %s pattern %q", kind, spec))
+					continue
+				}
+				rule.re = re
+			} else if paths && strings.Contains(spec, ".") {
+				rule.path = strings.Split(spec, ".")
+			}
+			rules = append(rules, rule)
+		}
+		return
+	}
+	r.headers = compile("header", headers, false)
+	r.params = compile("query parameter", params, false)
+	r.fields = compile("JSON field", fields, true)
+	return
+}
+
+// redact masks secrets of the exchange in the capture, and records the masked fields in nt.Redacted
+// along with those recorded already. The request and response are left intact.
+func (r *redactor) redact(nt *types.NetworkTraffic, req *http.Request, res *http.Response) {
+	var masked []string
+	if nt.Redacted != "" {
+		if e := json.Unmarshal([]byte(nt.Redacted), &masked); e != nil {
+			log.Warnf("invalid redacted fields %s: %v", nt.Redacted, e)
+		}
+	}
+	mark := func(part string, names []string) {
+		for _, name := range names {
+			masked = append(masked, part+"."+name)
+		}
+	}
+	reqHeader, m := r.header(req.Header)
+	mark("request.header", m)
+	nt.RequestHeaders = PrettyPrintHeaders(reqHeader)
+	nt.URL, m = r.url(req.URL)
+	mark("request.query", m)
+	var dropped bool
+	if nt.RequestBody, m, dropped = r.body(nt.RequestBody, req.Header); dropped {
+		masked = append(masked, "request.body")
+	}
+	mark("request.body", m)
+	resHeader, m := r.header(res.Header)
+	mark("response.header", m)
+	nt.ResponseHeaders = PrettyPrintHeaders(resHeader)
+	if nt.ResponseBody, m, dropped = r.body(nt.ResponseBody, res.Header); dropped {
+		masked = append(masked, "response.body")
+	}
+	mark("response.body", m)
+	if len(masked) == 0 {
+		return
+	}
+	slices.Sort(masked)
+	j, _ := json.Marshal(slices.Compact(masked))
+	nt.Redacted = string(j)
+}
+
+// redactTraffic redacts the record like captures, e.g. one imported from HAR.
+func (r *redactor) redactTraffic(nt *types.NetworkTraffic) error {
+	u, e := url.Parse(nt.URL)
+	if e != nil {
+		return errors.Wrapf(e, "invalid URL %q", nt.URL)
+	}
+	req := &http.Request{Method: nt.Method, URL: u, Header: parseHeaders(nt.RequestHeaders)}
+	res := &http.Response{StatusCode: int(nt.StatusCode), Header: parseHeaders(nt.ResponseHeaders)}
+	r.redact(nt, req, res)
+	nt.Size = int64(len(nt.RequestBody) + len(nt.ResponseBody))
+	return nil
+}
+
+func matchesAny(rules []nameRule, name string) bool {
+	for _, rule := range rules {
+		if rule.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// header returns a copy of the header with the values of redacted headers masked, and the masked names.
+func (r *redactor) header(h http.Header) (redacted http.Header, masked []string) {
+	redacted = h.Clone()
+	for name, values := range redacted {
+		if !matchesAny(r.headers, name) {
+			continue
+		}
+		for i := range values {
+			values[i] = r.replacement
+		}
+		masked = append(masked, name)
+	}
+	return
+}
+
+// query masks the values of redacted parameters in the URL-encoded query, and returns the masked names.
+// Parameters are left in their original order.
+func (r *redactor) query(rawQuery string) (redacted string, masked []string) {
+	if rawQuery == "" {
+		return
+	}
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		name, e := url.QueryUnescape(key)
+		if e != nil {
+			name = key
+		}
+		if !matchesAny(r.params, name) {
+			continue
+		}
+		pairs[i] = key + "=" + url.QueryEscape(r.replacement)
+		masked = append(masked, name)
+	}
+	return strings.Join(pairs, "&"), masked
+}
+
+// url returns the URL with the values of redacted query parameters masked, and the masked names.
+func (r *redactor) url(u *url.URL) (redacted string, masked []string) {
+	if u.RawQuery == "" {
+		return u.String(), nil
+	}
+	c := *u
+	c.RawQuery, masked = r.query(u.RawQuery)
+	return c.String(), masked
+}
+
+// body masks redacted fields of JSON bodies and redacted parameters of URL-encoded form bodies,
+// and returns the masked field paths. Bodies of other types are returned as is.
+// Compressed bodies are decompressed for redaction and compressed again. Those that can't be decompressed,
+// e.g. truncated ones, are dropped as a whole.
+func (r *redactor) body(body []byte, h http.Header) (redacted []byte, masked []string, dropped bool) {
+	if len(body) == 0 {
+		return body, nil, false
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	form := mediaType == "application/x-www-form-urlencoded"
+	switch {
+	case form && len(r.params) > 0:
+	case strings.HasSuffix(mediaType, "json") && len(r.fields) > 0:
+	default:
+		return body, nil, false
+	}
+	ce := contentEncoding(h.Get("Content-Encoding"))
+	plain, e := decodeContent(body, ce)
+	if e != nil {
+		log.Debugf("dropping captured body: %v", e)
+		return nil, nil, true
+	}
+	if form {
+		redacted, masked = r.form(plain)
+	} else {
+		redacted, masked = r.jsonBody(plain)
+	}
+	if len(masked) == 0 {
+		return body, nil, false
+	}
+	if redacted, e = encodeContent(redacted, ce); e != nil {
+		log.Debugf("dropping captured body: %v", e)
+		return nil, nil, true
+	}
+	return redacted, masked, false
+}
+
+// frame masks the redacted fields in the payload of a websocket text frame.
+// Payloads compressed by the permessage-deflate extension can't be inspected and are dropped.
+func (r *redactor) frame(f *types.WebSocketFrame, compressed bool) {
+	if len(f.Payload) == 0 || len(r.fields) == 0 {
+		return
+	}
+	if compressed {
+		f.Payload = nil
+		return
+	}
+	if redacted, masked := r.jsonBody(f.Payload); len(masked) > 0 {
+		f.Payload = redacted
+	}
+}
+
+// form masks the redacted parameters of the URL-encoded form body.
+func (r *redactor) form(body []byte) (redacted []byte, masked []string) {
+	form, masked := r.query(string(body))
+	if len(masked) == 0 {
+		return body, nil
+	}
+	return []byte(form), masked
+}
+
+// jsonBody masks the redacted fields of the JSON body.
+// Bodies that can't be parsed, e.g. truncated ones, are redacted by field name only.
+func (r *redactor) jsonBody(body []byte) (redacted []byte, masked []string) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var v interface{}
+	if e := decoder.Decode(&v); e != nil {
+		return r.jsonText(body)
+	}
+	v, masked = r.json(v, nil)
+	if len(masked) == 0 {
+		return body, nil
+	}
+	if redacted, e := json.Marshal(v); e == nil {
+		return redacted, masked
+	}
+	return r.jsonText(body)
+}
+
+// json masks the redacted fields in the decoded JSON value at the path.
+func (r *redactor) json(v interface{}, path []string) (redacted interface{}, masked []string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			p := append(path[:len(path):len(path)], k)
+			if r.matchesField(p) {
+				v[k] = r.replacement
+				masked = append(masked, strings.Join(p, "."))
+				continue
+			}
+			var m []string
+			v[k], m = r.json(child, p)
+			masked = append(masked, m...)
+		}
+	case []interface{}:
+		for i, child := range v {
+			var m []string
+			v[i], m = r.json(child, append(path[:len(path):len(path)], strconv.Itoa(i)))
+			masked = append(masked, m...)
+		}
+	}
+	return v, masked
+}
+
+func (r *redactor) matchesField(path []string) bool {
+	for _, rule := range r.fields {
+		if rule.matchesPath(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonText masks scalar members of the JSON text whose names match the field rules other than paths.
+func (r *redactor) jsonText(body []byte) (redacted []byte, masked []string) {
+	replacement, _ := json.Marshal(r.replacement)
+	redacted = jsonMember.ReplaceAllFunc(body, func(member []byte) []byte {
+		m := jsonMember.FindSubmatch(member)
+		var name string
+		if json.Unmarshal(append(append([]byte{'"'}, m[1]...), '"'), &name) != nil {
+			return member
+		}
+		for _, rule := range r.fields {
+			if rule.path == nil && rule.matches(name) {
+				masked = append(masked, name)
+				return append(append(append(append([]byte{'"'}, m[1]...), '"'), m[2]...), replacement...)
+			}
+		}
+		return member
+	})
+	return
+}
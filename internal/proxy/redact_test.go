@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestRedactor(t *testing.T) {
+	r, errs := compileRedactor(conf.RedactionArgs{
+		Defaults:    true,
+		Headers:     []string{"X-Session"},
+		QueryParams: []string{"/^sess/"},
+		JSONFields:  []string{"user.email", "items.*.code", "/(invalid/"},
+		Replacement: "***",
+	})
+	if len(errs) != 1 {
+		t.Errorf("compiled with errors %v, want 1", errs)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://api.test/login?api_key=k1&q=a+b&session_id=s1", nil)
+	req.Header.Set("Authorization", "Bearer t1")
+	req.Header.Set("X-Session", "s2")
+	req.Header.Set("X-Upstream-Api-Key", "k2")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{
+		"Set-Cookie":   {"sid=1", "lang=en"},
+		"Content-Type": {"application/json"},
+	}}
+	nt, e := newNetworkTraffic(req, []byte("user=a&password=p1"), res, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	nt.RequestBody = []byte("user=a&password=p1")
+	nt.ResponseBody = []byte(`{"token":"t2","user":{"email":"a@test","name":"a"},"items":[{"code":1,"id":2}]}`)
+	r.redact(nt, req, res)
+
+	if nt.URL != "http://api.test/login?api_key=%2A%2A%2A&q=a+b&session_id=%2A%2A%2A" {
+		t.Errorf("URL = %s", nt.URL)
+	}
+	for _, secret := range []string{"t1", "s2", "k2", "sid=1"} {
+		if strings.Contains(nt.RequestHeaders+nt.ResponseHeaders, secret) {
+			t.Errorf("headers contain %q:\n%s%s", secret, nt.RequestHeaders, nt.ResponseHeaders)
+		}
+	}
+	if body := string(nt.RequestBody); body != "user=a&password=%2A%2A%2A" {
+		t.Errorf("request body = %s", body)
+	}
+	if body, want := string(nt.ResponseBody),
+		`{"items":[{"code":"***","id":2}],"token":"***","user":{"email":"***","name":"a"}}`; body != want {
+		t.Errorf("response body = %s, want %s", body, want)
+	}
+	want := `["request.body.password","request.header.Authorization","request.header.X-Session",` +
+		`"request.header.X-Upstream-Api-Key","request.query.api_key","request.query.session_id",` +
+		`"response.body.items.0.code","response.body.token","response.body.user.email","response.header.Set-Cookie"]`
+	if nt.Redacted != want {
+		t.Errorf("redacted = %s, want %s", nt.Redacted, want)
+	}
+	if req.Header.Get("Authorization") != "Bearer t1" || res.Header.Get("Set-Cookie") != "sid=1" {
+		t.Error("the exchange itself shall be left intact")
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	r, _ := compileRedactor(conf.RedactionArgs{Defaults: true, Replacement: "[REDACTED]"})
+	json := http.Header{"Content-Type": {"application/vnd.api+json"}}
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   string
+	}{
+		{"truncated", json, `{"a":1,"password" : "p\"1","nested":{"secret":42,"ok":tr`,
+			`{"a":1,"password" : "[REDACTED]","nested":{"secret":"[REDACTED]","ok":tr`},
+		{"nothing to mask", json, `{"b": 1,  "a": 2}`, `{"b": 1,  "a": 2}`},
+		{"other type", http.Header{"Content-Type": {"text/plain"}}, "password=p1", "password=p1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _, _ := r.body([]byte(tt.body), tt.header); string(got) != tt.want {
+				t.Errorf("body() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	gzipped := http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}}
+	compressed, _ := encodeContent([]byte(`{"password":"p1"}`), "gzip")
+	got, masked, dropped := r.body(compressed, gzipped)
+	if plain, e := decodeContent(got, "gzip"); e != nil || string(plain) != `{"password":"[REDACTED]"}` ||
+		len(masked) != 1 || dropped {
+		t.Errorf("body() of compressed JSON = %s, %v, %v, %v", plain, masked, dropped, e)
+	}
+	if got, masked, dropped = r.body(compressed[:len(compressed)-4], gzipped); got != nil || masked != nil || !dropped {
+		t.Errorf("body() of truncated compressed JSON = %q, %v, %v, want dropped", got, masked, dropped)
+	}
+	compressed, _ = encodeContent([]byte("GIF89a"), "gzip")
+	if got, _, dropped = r.body(compressed, http.Header{"Content-Type": {"image/gif"}, "Content-Encoding": {"gzip"}}); dropped ||
+		string(got) != string(compressed) {
+		t.Error("compressed body of other type shall be left as is")
+	}
+
+	r, _ = compileRedactor(conf.RedactionArgs{Replacement: "x"})
+	if got, masked, _ := r.body([]byte(`{"password":"p1"}`), json); string(got) != `{"password":"p1"}` || masked != nil {
+		t.Errorf("body() without defaults = %s, %v, want nothing masked", got, masked)
+	}
+}
+
+func TestSaveNetworkTrafficRedacts(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://save.redact.test/ws?token=t1", nil)
+	req.Header.Set("Authorization", "Bearer t2")
+	res := &http.Response{StatusCode: http.StatusSwitchingProtocols, Header: http.Header{"Set-Cookie": {"sid=t3"}}}
+	nt, e := saveNetworkTraffic(req, nil, res, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer data.GormDB.Unscoped().Delete(nt)
+	var saved types.NetworkTraffic
+	data.GormDB.First(&saved, nt.ID)
+	for _, secret := range []string{"t1", "t2", "t3"} {
+		if strings.Contains(saved.URL+saved.RequestHeaders+saved.ResponseHeaders, secret) {
+			t.Errorf("saved traffic contains %q: %+v", secret, saved)
+		}
+	}
+}
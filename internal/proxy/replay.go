@@ -0,0 +1,393 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// diffContext is the number of unchanged lines shown around changed body lines.
+	diffContext = 3
+	// maxDiffCells caps the product of line counts of bodies to diff, bounding time and memory.
+	maxDiffCells = 4 << 20
+	// maxDiffSize caps the length of a body diff.
+	maxDiffSize = 64 << 10
+)
+
+// replayIgnoredHeaders differ between any two responses, or are set by roprox while relaying.
+var replayIgnoredHeaders = append([]string{"Date", "Content-Length", headerCache}, hopHeaders...)
+
+// replayUser runs replays without inspection, as the recorded exchange is already captured.
+var replayUser = &proxyUser{name: "replay", inspection: new(bool)}
+
+// ReplayResult compares the response to a replayed request with the recorded one.
+type ReplayResult struct {
+	// ID is the replayed network_traffic record ID, 0 if replayed from HAR without IDs.
+	ID     uint   `json:"id,omitempty"`
+	Method string `json:"method"`
+	URL    string `json:"url"`
+	// Error is the reason the request couldn't be replayed, if any.
+	Error          string       `json:"error,omitempty"`
+	RecordedStatus int          `json:"recordedStatus"`
+	ReplayedStatus int          `json:"replayedStatus"`
+	Headers        []HeaderDiff `json:"headers,omitempty"`
+	Body           BodyDiff     `json:"body"`
+}
+
+// HeaderDiff denotes a response header whose values changed. Missing headers have nil values.
+type HeaderDiff struct {
+	Name     string   `json:"name"`
+	Recorded []string `json:"recorded"`
+	Replayed []string `json:"replayed"`
+}
+
+// BodyDiff compares the response bodies, decoded per Content-Encoding.
+type BodyDiff struct {
+	Equal        bool `json:"equal"`
+	RecordedSize int  `json:"recordedSize"`
+	ReplayedSize int  `json:"replayedSize"`
+	// RecordedTruncated denotes the recorded body was cut at capture, so only its length is compared.
+	RecordedTruncated bool `json:"recordedTruncated,omitempty"`
+	// Diff is the line diff of textual bodies that aren't equal.
+	Diff string `json:"diff,omitempty"`
+}
+
+// Changed returns whether the replayed response differs from the recorded one.
+func (r *ReplayResult) Changed() bool {
+	return r.Error != "" || r.RecordedStatus != r.ReplayedStatus || len(r.Headers) > 0 || !r.Body.Equal
+}
+
+func (r *ReplayResult) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "#%d %s %s\n", r.ID, r.Method, r.URL)
+	if r.Error != "" {
+		fmt.Fprintf(&sb, "error: %s\n", r.Error)
+		return sb.String()
+	}
+	if !r.Changed() {
+		sb.WriteString("unchanged\n")
+		return sb.String()
+	}
+	if r.RecordedStatus != r.ReplayedStatus {
+		fmt.Fprintf(&sb, "status: %d -> %d\n", r.RecordedStatus, r.ReplayedStatus)
+	}
+	for _, h := range r.Headers {
+		fmt.Fprintf(&sb, "header %s: %q -> %q\n", h.Name, h.Recorded, h.Replayed)
+	}
+	if !r.Body.Equal {
+		fmt.Fprintf(&sb, "body: %d -> %d bytes\n", r.Body.RecordedSize, r.Body.ReplayedSize)
+		sb.WriteString(r.Body.Diff)
+	}
+	if r.Body.RecordedTruncated {
+		fmt.Fprintf(&sb, "recorded body was truncated at %d bytes\n", r.Body.RecordedSize)
+	}
+	return sb.String()
+}
+
+// ReplayTraffic replays the network_traffic records of the IDs, see Replay.
+func ReplayTraffic(ids []uint, proxy string) ([]*ReplayResult, error) {
+	nts, e := loadTraffic(ids)
+	if e != nil {
+		return nil, e
+	}
+	return Replay(nts, proxy)
+}
+
+// loadTraffic loads the network_traffic records of the IDs with their bodies.
+func loadTraffic(ids []uint) (nts []*types.NetworkTraffic, e error) {
+	if e = data.GormDB.Where("id IN ?", ids).Order("id").Find(&nts).Error; e != nil {
+		return nil, errors.Wrap(e, "failed to query network traffic")
+	}
+	if len(nts) < len(ids) {
+		return nil, errors.Errorf("found %d of %d network traffic records", len(nts), len(ids))
+	}
+	for _, nt := range nts {
+		if e = bodies.load(nt); e != nil {
+			return nil, e
+		}
+	}
+	return
+}
+
+// ReplayHAR replays the entries of the HAR document, see Replay.
+func ReplayHAR(r io.Reader, proxy string) ([]*ReplayResult, error) {
+	nts, e := readHAR(r, 0)
+	if e != nil {
+		return nil, e
+	}
+	return Replay(nts, proxy)
+}
+
+// Replay re-issues the recorded requests one by one through the normal selection and retry path,
+// and compares the responses with the recorded ones. The proxy is the URL of the backend proxy to use,
+// "master", "direct", or empty for freshly rotated proxies. Responses aren't served from cache.
+// Routing rules apply as to any request, overridden by the chosen proxy like routing headers do.
+func Replay(nts []*types.NetworkTraffic, proxy string) ([]*ReplayResult, error) {
+	return replayAs(nil, nts, proxy)
+}
+
+// replayAs replays on behalf of the proxy user, whose allowed proxy modes apply. The user may be nil.
+func replayAs(u *proxyUser, nts []*types.NetworkTraffic, proxy string) ([]*ReplayResult, error) {
+	chosen, e := replayRoute(proxy)
+	if e != nil {
+		return nil, e
+	}
+	results := make([]*ReplayResult, 0, len(nts))
+	for _, nt := range nts {
+		results = append(results, replay(nt, chosen, u))
+	}
+	return results, nil
+}
+
+// replayRoute resolves the route of the chosen proxy, whose mode is empty if none is chosen.
+func replayRoute(proxy string) (rt route, e error) {
+	switch proxy {
+	case "":
+		return
+	case string(types.Direct), string(types.MasterProxy):
+		rt.mode = types.ProxyMode(proxy)
+		return
+	}
+	u, e := url.Parse(proxy)
+	if e != nil || u.Hostname() == "" || u.Port() == "" {
+		return rt, errors.Errorf("invalid proxy %q, expecting scheme://host:port, master or direct", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return rt, errors.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	// a known proxy keeps its score and reputation updated
+	ps := &types.ProxyServer{}
+	if e = data.GormDB.Where("host = ? AND port = ?", u.Hostname(), u.Port()).Limit(1).Find(ps).Error; e != nil {
+		return rt, errors.Wrapf(e, "failed to query proxy %s", proxy)
+	}
+	if ps.ID == 0 {
+		ps = &types.ProxyServer{Source: "replay", Host: u.Hostname(), Port: u.Port(), Type: u.Scheme}
+	}
+	rt.mode = types.RotateProxy
+	rt.pinned = ps
+	return
+}
+
+// replay relays the recorded request with serveRequest over an in-memory connection and diffs the response.
+func replay(nt *types.NetworkTraffic, chosen route, u *proxyUser) (r *ReplayResult) {
+	r = &ReplayResult{ID: nt.ID, Method: nt.Method, URL: nt.URL, RecordedStatus: int(nt.StatusCode)}
+	// masked credentials would be sent upstream verbatim
+	if fields := redactedRequestFields(nt); len(fields) > 0 {
+		r.Error = fmt.Sprintf("request has redacted fields %s", strings.Join(fields, ", "))
+		return
+	}
+	if nt.RequestTruncated || shortOfLength(parseHeaders(nt.RequestHeaders), nt.RequestBody) {
+		r.Error = fmt.Sprintf("request body was truncated at %d bytes", len(nt.RequestBody))
+		return
+	}
+	req, e := http.NewRequest(nt.Method, nt.URL, bytes.NewReader(nt.RequestBody))
+	if e != nil {
+		r.Error = e.Error()
+		return
+	}
+	req.Header = parseHeaders(nt.RequestHeaders)
+	req.RemoteAddr = nt.SourceIP
+
+	rt, e := applyRules(defaultRoute(u), targetOf(req))
+	if e != nil {
+		r.Error = e.Error()
+		return
+	}
+	if chosen.mode != "" {
+		rt.mode, rt.pinned = chosen.mode, chosen.pinned
+	}
+	if !u.allows(rt.mode) {
+		r.Error = fmt.Sprintf("proxy mode %s is not allowed", rt.mode)
+		return
+	}
+	rt.noCache = true
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		serveRequest(NewConnResponseWriter(server), req, replayUser, rt)
+	}()
+	res, e := http.ReadResponse(bufio.NewReader(client), req)
+	if e != nil {
+		r.Error = errors.Wrap(e, "failed to read replayed response").Error()
+		return
+	}
+	defer res.Body.Close()
+	body, e := io.ReadAll(res.Body)
+	if e != nil {
+		r.Error = errors.Wrap(e, "failed to read replayed response body").Error()
+		return
+	}
+
+	recordedHeader := parseHeaders(nt.ResponseHeaders)
+	r.ReplayedStatus = res.StatusCode
+	r.Headers = diffHeaders(recordedHeader, res.Header)
+	truncated := nt.ResponseTruncated ||
+		bodyAllowed(nt.Method, int(nt.StatusCode)) && shortOfLength(recordedHeader, nt.ResponseBody)
+	r.Body = diffBodies(nt.ResponseBody, recordedHeader, truncated, body, res.Header)
+	return
+}
+
+// shortOfLength returns whether the body is shorter than its Content-Length, which tells truncated bodies
+// of captures made before truncation was recorded.
+func shortOfLength(h http.Header, body []byte) bool {
+	n, e := strconv.Atoi(h.Get("Content-Length"))
+	return e == nil && n > len(body)
+}
+
+// diffBodies compares the recorded and replayed bodies once decoded. Bodies that can't be decoded are compared
+// as is. A truncated recorded body is compared with the same length of the replayed one.
+func diffBodies(recorded []byte, recordedHeader http.Header, truncated bool, replayed []byte,
+	replayedHeader http.Header) (d BodyDiff) {
+	if truncated {
+		// the recorded body ends abruptly, so it's decoded as far as it goes
+		if decoded := decodePrefix(recorded, recordedHeader.Get("Content-Encoding"), maxDecodedSize); decoded != nil {
+			recorded = decoded
+		}
+	} else if decoded, e := decodeContent(recorded, recordedHeader.Get("Content-Encoding")); e == nil {
+		recorded = decoded
+	}
+	if decoded, e := decodeContent(replayed, replayedHeader.Get("Content-Encoding")); e == nil {
+		replayed = decoded
+	}
+	d = BodyDiff{RecordedSize: len(recorded), ReplayedSize: len(replayed), RecordedTruncated: truncated}
+	compared := replayed
+	if truncated {
+		compared = replayed[:min(len(recorded), len(replayed))]
+	}
+	if d.Equal = bytes.Equal(recorded, compared); !d.Equal && utf8.Valid(recorded) && utf8.Valid(compared) {
+		d.Diff = diffLines(string(recorded), string(compared))
+	}
+	return
+}
+
+// redactedRequestFields lists the request fields masked in the record.
+func redactedRequestFields(nt *types.NetworkTraffic) (fields []string) {
+	if nt.Redacted == "" {
+		return
+	}
+	var redacted []string
+	if e := json.Unmarshal([]byte(nt.Redacted), &redacted); e != nil {
+		return []string{nt.Redacted}
+	}
+	for _, f := range redacted {
+		if strings.HasPrefix(f, "request.") {
+			fields = append(fields, f)
+		}
+	}
+	return
+}
+
+// diffHeaders lists the headers whose values differ, sorted by name, except replayIgnoredHeaders.
+func diffHeaders(recorded, replayed http.Header) (diffs []HeaderDiff) {
+	names := make(map[string]bool)
+	for name := range recorded {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range replayed {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range replayIgnoredHeaders {
+		delete(names, http.CanonicalHeaderKey(name))
+	}
+	for name := range names {
+		a, b := recorded.Values(name), replayed.Values(name)
+		if strings.Join(a, "\n") != strings.Join(b, "\n") {
+			diffs = append(diffs, HeaderDiff{Name: name, Recorded: a, Replayed: b})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Name < diffs[j].Name })
+	return
+}
+
+// diffLines returns the line diff of a and b, with changed lines prefixed by "-" or "+" and hunks
+// of diffContext unchanged lines around them separated by "@@".
+func diffLines(a, b string) string {
+	al, bl := splitLines(a), splitLines(b)
+	if len(al)*len(bl) > maxDiffCells {
+		return fmt.Sprintf("(%d and %d lines, too large to diff)\n", len(al), len(bl))
+	}
+	// lcs[i][j] is the length of the longest common subsequence of al[i:] and bl[j:]
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	type edit struct {
+		op   byte
+		line string
+	}
+	var edits []edit
+	for i, j := 0, 0; i < len(al) || j < len(bl); {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			edits = append(edits, edit{' ', al[i]})
+			i++
+			j++
+		case i < len(al) && (j == len(bl) || lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', al[i]})
+			i++
+		default:
+			edits = append(edits, edit{'+', bl[j]})
+			j++
+		}
+	}
+	shown := make([]bool, len(edits))
+	for k, ed := range edits {
+		if ed.op == ' ' {
+			continue
+		}
+		for c := max(k-diffContext, 0); c <= min(k+diffContext, len(edits)-1); c++ {
+			shown[c] = true
+		}
+	}
+	var sb strings.Builder
+	for k, ed := range edits {
+		if !shown[k] {
+			continue
+		}
+		if k == 0 || !shown[k-1] {
+			sb.WriteString("@@\n")
+		}
+		if sb.Len() > maxDiffSize {
+			sb.WriteString("(diff truncated)\n")
+			break
+		}
+		sb.WriteByte(ed.op)
+		sb.WriteString(ed.line)
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
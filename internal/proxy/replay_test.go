@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestDiffLines(t *testing.T) {
+	if d := diffLines("a\nb\n", "a\nb\n"); d != "" {
+		t.Errorf("diff of equal text = %q, want empty", d)
+	}
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprint(i))
+	}
+	a := strings.Join(lines, "\n") + "\n"
+	lines[4] = "five"
+	b := strings.Join(append(lines, "21"), "\n") + "\n"
+	want := "@@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n@@\n 18\n 19\n 20\n+21\n"
+	if d := diffLines(a, b); d != want {
+		t.Errorf("diffLines() =\n%s\nwant\n%s", d, want)
+	}
+}
+
+func TestDiffHeaders(t *testing.T) {
+	recorded := http.Header{"Server": {"nginx"}, "Date": {"yesterday"}, "X-Removed": {"1"}, "Etag": {`"a"`}}
+	replayed := http.Header{"Server": {"nginx"}, "Date": {"today"}, "Etag": {`"b"`}, "Connection": {"close"}}
+	diffs := diffHeaders(recorded, replayed)
+	if len(diffs) != 2 || diffs[0].Name != "Etag" || diffs[1].Name != "X-Removed" || diffs[1].Replayed != nil {
+		t.Errorf("diffHeaders() = %+v, want Etag changed and X-Removed removed", diffs)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	args := conf.Args.Proxy
+	defer func() { conf.Args.Proxy = args }()
+	conf.Args.Proxy.MaxRetryDuration, conf.Args.Proxy.BackendProxyTimeout = 10, 10
+	conf.Args.Proxy.EnableInspection = true
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Token", r.Header.Get("X-Token"))
+		switch r.URL.Path {
+		case "/same":
+			fmt.Fprint(w, "line 1\nline 2\n")
+		case "/echo":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "line 1\n%s\n", body)
+		}
+	}))
+	defer origin.Close()
+	defer data.GormDB.Unscoped().Where("url LIKE ?", origin.URL+"%").Delete(&types.NetworkTraffic{})
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	records := []*types.NetworkTraffic{
+		{
+			Timestamp: time.Now(), DestinationIP: host, Method: http.MethodGet, URL: origin.URL + "/same", StatusCode: 200,
+			RequestHeaders: "X-Token: t1\n", ResponseHeaders: "X-Token: t1\nContent-Type: text/plain; charset=utf-8\n",
+			ResponseBody: []byte("line 1\nline 2\n"),
+		},
+		{
+			Timestamp: time.Now(), DestinationIP: host, Method: http.MethodPost, URL: origin.URL + "/echo", StatusCode: 200,
+			RequestHeaders: "X-Token: t2\n", RequestBody: []byte("posted"),
+			ResponseHeaders: "X-Token: t1\nContent-Type: text/plain; charset=utf-8\n",
+			ResponseBody:    []byte("line 1\nline 2\n"),
+		},
+	}
+	if e := data.GormDB.Create(records).Error; e != nil {
+		t.Fatal(e)
+	}
+
+	results, e := ReplayTraffic([]uint{records[0].ID, records[1].ID}, "direct")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if same := results[0]; same.Changed() {
+		t.Errorf("replay of /same changed:\n%s", same)
+	}
+	echo := results[1]
+	if echo.ReplayedStatus != http.StatusCreated || len(echo.Headers) != 1 || echo.Headers[0].Name != "X-Token" ||
+		echo.Body.Equal || echo.Body.Diff != "@@\n line 1\n-line 2\n+posted\n" {
+		t.Errorf("replay of /echo =\n%s", echo)
+	}
+	var count int64
+	data.GormDB.Model(&types.NetworkTraffic{}).Where("url LIKE ?", origin.URL+"%").Count(&count)
+	if count != 2 {
+		t.Errorf("replays shall not be captured, found %d records", count)
+	}
+
+	// replay from HAR
+	var buf bytes.Buffer
+	if _, e = ExportHAR(&buf, TrafficFilter{Host: host}); e != nil {
+		t.Fatal(e)
+	}
+	if results, e = ReplayHAR(&buf, ""); e != nil || len(results) != 2 {
+		t.Fatalf("ReplayHAR() = %d results, %v, want 2", len(results), e)
+	}
+	raw, _ := json.Marshal(results)
+	if !strings.Contains(string(raw), `"replayedStatus":201`) {
+		t.Errorf("HAR replay results = %s", raw)
+	}
+
+	if _, e = ReplayTraffic([]uint{records[0].ID}, "ftp://a.test:21"); e == nil {
+		t.Error("replay through unsupported proxy shall fail")
+	}
+
+	redacted := *records[0]
+	redacted.Redacted = `["request.header.Authorization","response.header.Set-Cookie"]`
+	if results, e = Replay([]*types.NetworkTraffic{&redacted}, "direct"); e != nil ||
+		results[0].Error != "request has redacted fields request.header.Authorization" {
+		t.Errorf("replay of redacted request = %+v, %v, want refused", results, e)
+	}
+
+	// routing rules and the allowed proxy modes of the user apply to replays
+	saved := loadRules()
+	defer func() { rules = saved }()
+	rules, _ = compileRules([]conf.RuleArgs{{Match: "ip_cidr", Values: []string{"127.0.0.0/8"}, Action: "reject"}})
+	if results, e = Replay(records[:1], "direct"); e != nil || !strings.Contains(results[0].Error, "rejected") {
+		t.Errorf("replay of rejected target = %+v, %v, want rejected", results, e)
+	}
+	rules = nil
+	u := &proxyUser{name: "crawler", modes: []types.ProxyMode{types.MasterProxy}}
+	if results, e = replayAs(u, records[:1], "direct"); e != nil || !strings.Contains(results[0].Error, "not allowed") {
+		t.Errorf("replay in disallowed mode = %+v, %v, want not allowed", results, e)
+	}
+}
+
+func TestDiffBodies(t *testing.T) {
+	plain := []byte("line 1\nline 2\n")
+	gzipped, _ := encodeContent(plain, "gzip")
+	gzip := http.Header{"Content-Encoding": {"gzip"}}
+	if d := diffBodies(plain, http.Header{}, false, gzipped, gzip); !d.Equal || d.ReplayedSize != len(plain) {
+		t.Errorf("diff of the body compressed on replay = %+v, want equal", d)
+	}
+	if d := diffBodies(gzipped[:len(gzipped)-8], gzip, true, []byte("line 1\nline 3\n"), http.Header{}); d.Equal ||
+		!d.RecordedTruncated || d.Diff == "" {
+		t.Errorf("diff of truncated compressed body = %+v, want the decoded part diffed", d)
+	}
+	if d := diffBodies([]byte("line 1\n"), http.Header{}, true, plain, http.Header{}); !d.Equal || !d.RecordedTruncated {
+		t.Errorf("diff of truncated body = %+v, want equal up to its length", d)
+	}
+}
+
+func TestReplayTruncatedRequest(t *testing.T) {
+	nts := []*types.NetworkTraffic{
+		{Method: http.MethodPost, URL: "http://replay.test/upload", RequestBody: []byte("part"), RequestTruncated: true},
+		{Method: http.MethodPost, URL: "http://replay.test/upload", RequestBody: []byte("part"),
+			RequestHeaders: "Content-Length: 1024\n"},
+	}
+	results, e := Replay(nts, "direct")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for i, r := range results {
+		if !strings.Contains(r.Error, "truncated") {
+			t.Errorf("replay of truncated request #%d = %+v, want refused", i, r)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// BlockInfo is the public view of a backend proxy banned by a domain.
+type BlockInfo struct {
+	Domain      string    `json:"domain"`
+	Proxy       string    `json:"proxy"`
+	Bans        int       `json:"bans"`
+	BannedUntil time.Time `json:"banned_until"`
+	Reason      string    `json:"reason"`
+}
+
+// reputationFlushInterval is how often recorded outcomes are written to the database.
+const reputationFlushInterval = 5 * time.Second
+
+// reputationStore records the reputation of backend proxies per domain in table proxy_domain_stats.
+// Active bans and cooldowns are mirrored in memory so that proxy selection doesn't hit the database,
+// and outcomes are aggregated in memory and flushed in batches so that requests don't either.
+type reputationStore struct {
+	sync.RWMutex
+	// excluded maps domain to proxy IDs and the time their exclusion expires.
+	excluded map[string]map[uint]time.Time
+	// pending holds the outcomes recorded since the last flush.
+	pending   map[statKey]*types.ProxyDomainStat
+	flushOnce sync.Once
+	// flushLock keeps flushes in order.
+	flushLock sync.Mutex
+}
+
+type statKey struct {
+	proxyID uint
+	domain  string
+}
+
+var reputation = &reputationStore{
+	excluded: make(map[string]map[uint]time.Time),
+	pending:  make(map[statKey]*types.ProxyDomainStat),
+}
+
+// targetHost returns the lowercase host name the request is addressed to.
+func targetHost(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if h, _, e := net.SplitHostPort(host); e == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// load restores unexpired bans and cooldowns from the database.
+func (s *reputationStore) load() {
+	var stats []types.ProxyDomainStat
+	now := time.Now()
+	if e := data.GormDB.Where("banned_until > ? or cooldown_until > ?", now, now).Find(&stats).Error; e != nil {
+		log.Errorln("failed to load proxy domain stats from database", e)
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, st := range stats {
+		s.exclude(st.Domain, st.ProxyID, st.BannedUntil, st.CooldownUntil)
+	}
+}
+
+// exclude must be called with the lock held.
+func (s *reputationStore) exclude(domain string, id uint, until ...time.Time) {
+	for _, t := range until {
+		if t.Before(time.Now()) {
+			continue
+		}
+		proxies, ok := s.excluded[domain]
+		if !ok {
+			proxies = make(map[uint]time.Time)
+			s.excluded[domain] = proxies
+		}
+		if t.After(proxies[id]) {
+			proxies[id] = t
+		}
+	}
+}
+
+// isExcluded returns whether the proxy is banned or cooling down for the domain.
+func (s *reputationStore) isExcluded(domain string, id uint) bool {
+	if domain == "" {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return time.Now().Before(s.excluded[domain][id])
+}
+
+// prune forgets expired exclusions.
+func (s *reputationStore) prune() {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for domain, proxies := range s.excluded {
+		for id, until := range proxies {
+			if now.After(until) {
+				delete(proxies, id)
+			}
+		}
+		if len(proxies) == 0 {
+			delete(s.excluded, domain)
+		}
+	}
+}
+
+// record updates the reputation of the proxy on the domain per the outcome of the request.
+// A response classified as blocked bans the proxy from the domain; other failures trigger a cooldown.
+func (s *reputationStore) record(ps *types.ProxyServer, domain string, outcome error) {
+	if ps == nil || ps.ID <= 0 || domain == "" {
+		return
+	}
+	s.flushOnce.Do(func() { go s.flushPeriodically() })
+	now := time.Now()
+	var bannedUntil, cooldownUntil time.Time
+	var be *blockedError
+	if errors.As(outcome, &be) {
+		log.Infof("proxy [%s] is banned by %s: %s", ps.UrlString(), domain, be.reason)
+		bannedUntil = now.Add(time.Duration(conf.Args.Proxy.BanDuration) * time.Second)
+	} else if outcome != nil && conf.Args.Proxy.DomainCooldown > 0 {
+		cooldownUntil = now.Add(time.Duration(conf.Args.Proxy.DomainCooldown) * time.Second)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if outcome != nil {
+		s.exclude(domain, ps.ID, bannedUntil, cooldownUntil)
+	}
+	key := statKey{ps.ID, domain}
+	st, ok := s.pending[key]
+	if !ok {
+		st = &types.ProxyDomainStat{ProxyID: ps.ID, Domain: domain}
+		s.pending[key] = st
+	}
+	st.LastUsed = now
+	switch {
+	case outcome == nil:
+		st.Suc++
+	case be != nil:
+		st.Fail++
+		st.Bans++
+		st.BannedUntil, st.LastReason = bannedUntil, be.reason
+	default:
+		st.Fail++
+		if !cooldownUntil.IsZero() {
+			st.CooldownUntil = cooldownUntil
+		}
+	}
+}
+
+// flushPeriodically flushes the recorded outcomes every reputationFlushInterval.
+func (s *reputationStore) flushPeriodically() {
+	tk := time.NewTicker(reputationFlushInterval)
+	defer tk.Stop()
+	for range tk.C {
+		s.flush()
+	}
+}
+
+// flush adds the outcomes recorded since the last flush to the stats in the database.
+func (s *reputationStore) flush() {
+	s.flushLock.Lock()
+	defer s.flushLock.Unlock()
+	s.Lock()
+	pending := s.pending
+	s.pending = make(map[statKey]*types.ProxyDomainStat)
+	s.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	e := data.GormDB.Transaction(func(tx *gorm.DB) error {
+		for _, st := range pending {
+			updates := map[string]interface{}{
+				"updated_at": time.Now(),
+				"last_used":  st.LastUsed,
+				"suc":        gorm.Expr("suc + ?", st.Suc),
+				"fail":       gorm.Expr("fail + ?", st.Fail),
+				"bans":       gorm.Expr("bans + ?", st.Bans),
+			}
+			if st.Bans > 0 {
+				updates["banned_until"] = st.BannedUntil
+				updates["last_reason"] = st.LastReason
+			}
+			if !st.CooldownUntil.IsZero() {
+				updates["cooldown_until"] = st.CooldownUntil
+			}
+			if e := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "proxy_id"}, {Name: "domain"}},
+				DoUpdates: clause.Assignments(updates),
+			}).Create(st).Error; e != nil {
+				return errors.Wrapf(e, "failed to update stats of proxy %d for domain %s", st.ProxyID, st.Domain)
+			}
+		}
+		return nil
+	})
+	if e != nil {
+		log.Errorf("failed to flush %d proxy domain stats: %+v", len(pending), e)
+	}
+}
+
+// blocks returns the proxies currently banned per domain, sorted by domain and proxy.
+func (s *reputationStore) blocks() (infos []BlockInfo, e error) {
+	s.flush()
+	var stats []types.ProxyDomainStat
+	if e = data.GormDB.Where("banned_until > ?", time.Now()).Find(&stats).Error; e != nil {
+		return nil, errors.Wrap(e, "failed to query proxy domain stats")
+	}
+	ids := make([]uint, 0, len(stats))
+	for _, st := range stats {
+		ids = append(ids, st.ProxyID)
+	}
+	var servers []types.ProxyServer
+	if len(ids) > 0 {
+		if e = data.GormDB.Find(&servers, ids).Error; e != nil {
+			return nil, errors.Wrap(e, "failed to query proxy servers")
+		}
+	}
+	urls := make(map[uint]string, len(servers))
+	for i := range servers {
+		urls[servers[i].ID] = servers[i].UrlString()
+	}
+	infos = make([]BlockInfo, 0, len(stats))
+	for _, st := range stats {
+		infos = append(infos, BlockInfo{
+			Domain:      st.Domain,
+			Proxy:       urls[st.ProxyID],
+			Bans:        st.Bans,
+			BannedUntil: st.BannedUntil,
+			Reason:      st.LastReason,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Domain != infos[j].Domain {
+			return infos[i].Domain < infos[j].Domain
+		}
+		return infos[i].Proxy < infos[j].Proxy
+	})
+	return
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestTargetHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"Example.com:8443", "example.com"},
+		{"example.com", "example.com"},
+		{"[::1]:80", "::1"},
+	}
+	for _, tt := range tests {
+		if got := targetHost(&http.Request{Host: tt.host}); got != tt.want {
+			t.Errorf("targetHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestReputationRecord(t *testing.T) {
+	ps := &types.ProxyServer{Type: "http", Host: "10.0.0.1", Port: "8080"}
+	ps.ID = 900001
+	const domain = "reputation.test"
+	defer data.GormDB.Unscoped().Where("proxy_id = ?", ps.ID).Delete(&types.ProxyDomainStat{})
+
+	reputation.record(ps, domain, nil)
+	if reputation.isExcluded(domain, ps.ID) {
+		t.Fatal("proxy shall not be excluded after success")
+	}
+	reputation.record(ps, "other.test", errors.New("connection reset"))
+	reputation.record(ps, domain, &blockedError{domain: domain, reason: "status 403"})
+	if !reputation.isExcluded(domain, ps.ID) {
+		t.Error("banned proxy shall be excluded for the domain")
+	}
+	if reputation.isExcluded("unrelated.test", ps.ID) {
+		t.Error("banned proxy shall not be excluded for other domains")
+	}
+
+	reputation.record(ps, domain, nil)
+	reputation.flush()
+	var st types.ProxyDomainStat
+	if e := data.GormDB.Where("proxy_id = ? and domain = ?", ps.ID, domain).First(&st).Error; e != nil {
+		t.Fatal(e)
+	}
+	if st.Suc != 2 || st.Fail != 1 || st.Bans != 1 || st.LastReason != "status 403" {
+		t.Errorf("stats = %+v, want 2 successes, 1 failure and 1 ban", st)
+	}
+	reputation.record(ps, domain, nil)
+	reputation.flush()
+	data.GormDB.Where("proxy_id = ? and domain = ?", ps.ID, domain).First(&st)
+	if st.Suc != 3 || st.Bans != 1 || st.LastReason != "status 403" {
+		t.Errorf("stats after another flush = %+v, want 3 successes and the ban kept", st)
+	}
+
+	infos, e := reputation.blocks()
+	if e != nil {
+		t.Fatal(e)
+	}
+	found := false
+	for _, b := range infos {
+		found = found || b.Domain == domain
+	}
+	if !found {
+		t.Errorf("blocks() = %+v, want ban on %s", infos, domain)
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// captureSize is the size of a capture's bodies. Captures saved before sizes were recorded have zero size,
+// so the inline bodies are measured instead.
+const captureSize = "CASE WHEN size > 0 THEN size ELSE coalesce(length(request_body), 0) + coalesce(length(response_body), 0) END"
+
+// trafficRetention limits the captured network traffic kept in the database. Zero values are unlimited.
+type trafficRetention struct {
+	maxAge         time.Duration
+	maxTotalSize   int64
+	maxRowsPerHost int
+}
+
+// loadRetention reads the retention limits from the configuration.
+func loadRetention() trafficRetention {
+	args := conf.Args.Proxy.Inspection
+	return trafficRetention{
+		maxAge:         time.Duration(args.MaxAge) * time.Second,
+		maxTotalSize:   args.MaxTotalSize,
+		maxRowsPerHost: args.MaxRowsPerHost,
+	}
+}
+
+func (r trafficRetention) unlimited() bool {
+	return r.maxAge <= 0 && r.maxTotalSize <= 0 && r.maxRowsPerHost <= 0
+}
+
+// purgeTrafficPeriodically purges captures beyond the retention limits at once and then every
+// PurgeInterval seconds, until the context is done.
+func purgeTrafficPeriodically(ctx context.Context) {
+	r := loadRetention()
+	if r.unlimited() {
+		return
+	}
+	purgeTraffic(r)
+	tk := time.NewTicker(time.Duration(max(conf.Args.Proxy.Inspection.PurgeInterval, 1)) * time.Second)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+			purgeTraffic(r)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func purgeTraffic(r trafficRetention) {
+	log.Debug("purging network traffic...")
+	n, e := r.purge(data.GormDB)
+	if e != nil {
+		log.Errorln("failed to purge network traffic", e)
+	}
+	if n == 0 {
+		return
+	}
+	log.Infof("%d network traffic captures purged", n)
+	if removed, e := bodies.collect(); e != nil {
+		log.Errorln("failed to collect unreferenced bodies", e)
+	} else if removed > 0 {
+		log.Infof("%d unreferenced body files removed", removed)
+	}
+}
+
+// purge deletes the captures older than maxAge, then the oldest captures of each host beyond maxRowsPerHost,
+// then the oldest captures until the bodies total maxTotalSize at most, along with the websocket frames recorded
+// for them. It returns the number of captures deleted.
+func (r trafficRetention) purge(db *gorm.DB) (n int64, e error) {
+	// a new session keeps conditions from accumulating across the queries below
+	db = db.Unscoped().Session(&gorm.Session{})
+	defer func() {
+		if n == 0 {
+			return
+		}
+		res := db.Where("network_traffic_id NOT IN (?)", db.Model(&types.NetworkTraffic{}).Select("id")).
+			Delete(&types.WebSocketFrame{})
+		if res.Error != nil && e == nil {
+			e = errors.Wrap(res.Error, "failed to purge websocket frames of purged captures")
+		}
+	}()
+	if r.maxAge > 0 {
+		res := db.Where("timestamp < ?", time.Now().Add(-r.maxAge)).Delete(&types.NetworkTraffic{})
+		if res.Error != nil {
+			return n, errors.Wrap(res.Error, "failed to purge expired captures")
+		}
+		n += res.RowsAffected
+	}
+	if r.maxRowsPerHost > 0 {
+		deleted, e := r.purgeHosts(db)
+		n += deleted
+		if e != nil {
+			return n, e
+		}
+	}
+	if r.maxTotalSize > 0 {
+		deleted, e := r.purgeSize(db)
+		n += deleted
+		if e != nil {
+			return n, e
+		}
+	}
+	return
+}
+
+// purgeHosts deletes the oldest captures of each host beyond maxRowsPerHost.
+func (r trafficRetention) purgeHosts(db *gorm.DB) (n int64, e error) {
+	var hosts []string
+	if e = db.Model(&types.NetworkTraffic{}).Group("destination_ip").Having("count(*) > ?", r.maxRowsPerHost).
+		Pluck("destination_ip", &hosts).Error; e != nil {
+		return 0, errors.Wrap(e, "failed to count captures per host")
+	}
+	for _, host := range hosts {
+		// the newest capture to delete
+		var cutoff types.NetworkTraffic
+		if e = db.Select("id", "timestamp").Where("destination_ip = ?", host).Order("timestamp desc, id desc").
+			Offset(r.maxRowsPerHost).Limit(1).Find(&cutoff).Error; e != nil {
+			return n, errors.Wrapf(e, "failed to query captures of %s", host)
+		}
+		if cutoff.ID == 0 {
+			continue
+		}
+		res := db.Where("destination_ip = ? AND (timestamp < ? OR (timestamp = ? AND id <= ?))",
+			host, cutoff.Timestamp, cutoff.Timestamp, cutoff.ID).Delete(&types.NetworkTraffic{})
+		if res.Error != nil {
+			return n, errors.Wrapf(res.Error, "failed to purge captures of %s", host)
+		}
+		n += res.RowsAffected
+	}
+	return
+}
+
+// purgeSize deletes the oldest captures until the bodies total maxTotalSize at most.
+func (r trafficRetention) purgeSize(db *gorm.DB) (n int64, e error) {
+	var total int64
+	if e = db.Model(&types.NetworkTraffic{}).Select("coalesce(sum(" + captureSize + "), 0)").Scan(&total).Error; e != nil {
+		return 0, errors.Wrap(e, "failed to sum capture sizes")
+	}
+	for total > r.maxTotalSize {
+		var oldest []*types.NetworkTraffic
+		if e = db.Select("id, " + captureSize + " AS size").Order("timestamp, id").Limit(500).Find(&oldest).Error; e != nil {
+			return n, errors.Wrap(e, "failed to query oldest captures")
+		}
+		if len(oldest) == 0 {
+			break
+		}
+		var ids []uint
+		for _, nt := range oldest {
+			if total <= r.maxTotalSize {
+				break
+			}
+			ids = append(ids, nt.ID)
+			total -= nt.Size
+		}
+		res := db.Where("id IN ?", ids).Delete(&types.NetworkTraffic{})
+		if res.Error != nil {
+			return n, errors.Wrap(res.Error, "failed to purge oldest captures")
+		}
+		n += res.RowsAffected
+	}
+	return
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestTrafficRetention(t *testing.T) {
+	clear := func() {
+		data.GormDB.Unscoped().Where("1 = 1").Delete(&types.NetworkTraffic{})
+		data.GormDB.Unscoped().Where("1 = 1").Delete(&types.WebSocketFrame{})
+	}
+	clear()
+	defer clear()
+
+	now := time.Now()
+	capture := func(host string, age time.Duration, size int64) *types.NetworkTraffic {
+		return &types.NetworkTraffic{Timestamp: now.Add(-age), DestinationIP: host, URL: "http://" + host, Size: size}
+	}
+	records := []*types.NetworkTraffic{
+		capture("a.test", 48*time.Hour, 10), // expired
+		capture("a.test", 3*time.Hour, 10),  // beyond max rows of a.test
+		capture("a.test", 2*time.Hour, 10),
+		capture("a.test", time.Hour, 10),
+		capture("b.test", 5*time.Hour, 0), // beyond max total size, saved without size
+		capture("b.test", 4*time.Hour, 30),
+	}
+	records[4].ResponseBody = make([]byte, 40)
+	if e := data.GormDB.Create(records).Error; e != nil {
+		t.Fatal(e)
+	}
+	frames := []*types.WebSocketFrame{
+		{NetworkTrafficID: records[0].ID, Timestamp: now},
+		{NetworkTrafficID: records[5].ID, Timestamp: now},
+	}
+	if e := data.GormDB.Create(frames).Error; e != nil {
+		t.Fatal(e)
+	}
+	r := trafficRetention{maxAge: 24 * time.Hour, maxRowsPerHost: 2, maxTotalSize: 50}
+	n, e := r.purge(data.GormDB)
+	if e != nil {
+		t.Fatal(e)
+	}
+	var kept []uint
+	data.GormDB.Model(&types.NetworkTraffic{}).Order("id").Pluck("id", &kept)
+	want := []uint{records[2].ID, records[3].ID, records[5].ID}
+	if n != 3 || len(kept) != len(want) || kept[0] != want[0] || kept[1] != want[1] || kept[2] != want[2] {
+		t.Errorf("purged %d, kept %v, want 3 purged and %v kept", n, kept, want)
+	}
+	var keptFrames []uint
+	data.GormDB.Model(&types.WebSocketFrame{}).Pluck("id", &keptFrames)
+	if len(keptFrames) != 1 || keptFrames[0] != frames[1].ID {
+		t.Errorf("kept frames %v, want %d", keptFrames, frames[1].ID)
+	}
+	if n, e = r.purge(data.GormDB); n != 0 || e != nil {
+		t.Errorf("purge again = %d, %v, want nothing purged", n, e)
+	}
+}
+
+func TestBodyStore(t *testing.T) {
+	defer data.GormDB.Unscoped().Where("url = ?", "http://store.test").Delete(&types.NetworkTraffic{})
+	s := newBodyStore(t.TempDir())
+	body := []byte("same response")
+	nts := []*types.NetworkTraffic{
+		{DestinationIP: "store.test", URL: "http://store.test", RequestBody: []byte("req"), ResponseBody: body},
+		{DestinationIP: "store.test", URL: "http://store.test", ResponseBody: body},
+	}
+	for _, nt := range nts {
+		if e := s.offload(nt); e != nil {
+			t.Fatal(e)
+		}
+		if nt.RequestBody != nil || nt.ResponseBody != nil {
+			t.Errorf("bodies shall be offloaded: %+v", nt)
+		}
+	}
+	if nts[0].ResponseBodyHash != nts[1].ResponseBodyHash || nts[1].RequestBodyHash != "" {
+		t.Errorf("hashes = %+v, want identical bodies stored once", nts)
+	}
+	files, _ := filepath.Glob(filepath.Join(s.dir, "*", "*"))
+	if len(files) != 2 {
+		t.Errorf("stored %d files, want 2", len(files))
+	}
+	if e := data.GormDB.Create(nts[1:]).Error; e != nil {
+		t.Fatal(e)
+	}
+	loaded := *nts[0]
+	if e := s.load(&loaded); e != nil || string(loaded.RequestBody) != "req" || string(loaded.ResponseBody) != string(body) {
+		t.Errorf("load() = %q, %q, %v", loaded.RequestBody, loaded.ResponseBody, e)
+	}
+
+	// the request body of the first capture isn't referenced as the capture was never saved
+	old := time.Now().Add(-2 * bodyStoreGrace)
+	for _, f := range files {
+		os.Chtimes(f, old, old)
+	}
+	if removed, e := s.collect(); removed != 1 || e != nil {
+		t.Errorf("collect() = %d, %v, want 1 removed", removed, e)
+	}
+	if _, e := os.Stat(s.path(nts[0].RequestBodyHash)); !os.IsNotExist(e) {
+		t.Error("unreferenced body shall be removed")
+	}
+	if _, e := os.Stat(s.path(nts[1].ResponseBodyHash)); e != nil {
+		t.Errorf("referenced body shall be kept: %v", e)
+	}
+}
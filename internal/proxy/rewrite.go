@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/pkg/errors"
+)
+
+// Rewrite phases.
+const (
+	phaseRequest  = "request"
+	phaseResponse = "response"
+)
+
+// rewriteRule modifies requests before forwarding, or responses before writing back to the client.
+type rewriteRule struct {
+	index   int
+	hosts   []string
+	path    *regexp.Regexp
+	methods map[string]bool
+	phase   string
+
+	setHeaders     []headerValue
+	removeHeaders  []string
+	replaceHeaders []substitution
+	url            *substitution
+	body           []substitution
+}
+
+type headerValue struct {
+	name  string
+	value string
+}
+
+// substitution replaces matches of re with replacement, in the header if applicable.
+type substitution struct {
+	header      string
+	re          *regexp.Regexp
+	replacement string
+}
+
+var (
+	rewrites     []*rewriteRule
+	rewritesOnce sync.Once
+)
+
+// loadRewrites compiles the rewrite rules defined in the configuration. Invalid rules are skipped.
+func loadRewrites() []*rewriteRule {
+	rewritesOnce.Do(func() {
+		var errs []error
+		rewrites, errs = compileRewrites(conf.Args.Proxy.Rewrites)
+		for _, e := range errs {
+			log.Error(e)
+		}
+	})
+	return rewrites
+}
+
+func compileRewrites(args []conf.RewriteArgs) (rs []*rewriteRule, errs []error) {
+	for i, ra := range args {
+		r, e := compileRewrite(i, ra)
+		if e != nil {
+			errs = append(errs, errors.Wrapf(e, "invalid rewrite rule #%d", i))
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return
+}
+
+func compileRewrite(index int, ra conf.RewriteArgs) (r *rewriteRule, e error) {
+	r = &rewriteRule{
+		index:         index,
+		hosts:         ra.Hosts,
+		phase:         strings.ToLower(ra.Phase),
+		removeHeaders: ra.RemoveHeaders,
+	}
+	if r.phase != phaseRequest && r.phase != phaseResponse {
+		return nil, errors.Errorf("unknown phase %q", ra.Phase)
+	}
+	if ra.Path != "" {
+		if r.path, e = regexp.Compile(ra.Path); e != nil {
+			return nil, errors.Wrapf(e, "invalid path pattern %q", ra.Path)
+		}
+	}
+	if len(ra.Methods) > 0 {
+		r.methods = make(map[string]bool, len(ra.Methods))
+		for _, m := range ra.Methods {
+			r.methods[strings.ToUpper(m)] = true
+		}
+	}
+	for _, h := range ra.SetHeaders {
+		name, value, found := strings.Cut(h, ":")
+		if !found || strings.TrimSpace(name) == "" {
+			return nil, errors.Errorf("invalid header %q, expecting \"Name: value\"", h)
+		}
+		r.setHeaders = append(r.setHeaders, headerValue{strings.TrimSpace(name), strings.TrimSpace(value)})
+	}
+	compile := func(sa conf.SubstitutionArgs) (s substitution, e error) {
+		s = substitution{header: sa.Header, replacement: sa.Replacement}
+		if s.re, e = regexp.Compile(sa.Pattern); e != nil {
+			e = errors.Wrapf(e, "invalid pattern %q", sa.Pattern)
+		}
+		return
+	}
+	for _, sa := range ra.ReplaceHeaders {
+		if sa.Header == "" {
+			return nil, errors.Errorf("header to replace %q in is missing", sa.Pattern)
+		}
+		s, e := compile(sa)
+		if e != nil {
+			return nil, e
+		}
+		r.replaceHeaders = append(r.replaceHeaders, s)
+	}
+	if ra.URL.Pattern != "" {
+		if r.phase != phaseRequest {
+			return nil, errors.New("URL can only be rewritten in request phase")
+		}
+		s, e := compile(ra.URL)
+		if e != nil {
+			return nil, e
+		}
+		r.url = &s
+	}
+	for _, sa := range ra.Body {
+		if r.phase != phaseResponse {
+			return nil, errors.New("body can only be rewritten in response phase")
+		}
+		s, e := compile(sa)
+		if e != nil {
+			return nil, e
+		}
+		r.body = append(r.body, s)
+	}
+	return
+}
+
+// matches returns whether the request satisfies all conditions of the rule.
+func (r *rewriteRule) matches(req *http.Request) bool {
+	if len(r.hosts) > 0 && !hostMatches(req.URL.Hostname(), r.hosts) {
+		return false
+	}
+	if r.methods != nil && !r.methods[req.Method] {
+		return false
+	}
+	return r.path == nil || r.path.MatchString(req.URL.Path)
+}
+
+// rewriteHeader applies the header modifications of the rule in order: remove, set, then replace.
+func (r *rewriteRule) rewriteHeader(h http.Header) {
+	for _, name := range r.removeHeaders {
+		h.Del(name)
+	}
+	for _, hv := range r.setHeaders {
+		h.Set(hv.name, hv.value)
+	}
+	for _, s := range r.replaceHeaders {
+		values := h.Values(s.header)
+		for i, v := range values {
+			values[i] = s.re.ReplaceAllString(v, s.replacement)
+		}
+	}
+}
+
+// rewriteRequest applies the request rules matching the request before it's forwarded.
+func rewriteRequest(rs []*rewriteRule, req *http.Request) {
+	for _, r := range rs {
+		if !r.matches(req) {
+			continue
+		}
+		if r.phase == phaseResponse {
+			if len(r.body) > 0 {
+				// let the transport negotiate compression so that the body arrives decoded
+				req.Header.Del("Accept-Encoding")
+			}
+			continue
+		}
+		log.Debugf("rewriting request to %s per rule #%d", req.URL, r.index)
+		r.rewriteHeader(req.Header)
+		if r.url == nil {
+			continue
+		}
+		rewritten := r.url.re.ReplaceAllString(req.URL.String(), r.url.replacement)
+		u, e := url.Parse(rewritten)
+		if e != nil || u.Host == "" {
+			log.Warnf("rewrite rule #%d produced invalid URL %q: %v", r.index, rewritten, e)
+			continue
+		}
+		req.URL, req.Host = u, u.Host
+	}
+}
+
+// rewriteResponse applies the response rules matching the request to the response before it's written back.
+// Bodies are substituted only if they're uncompressed text within conf.Args.Proxy.RewriteMaxBodySize.
+func rewriteResponse(rs []*rewriteRule, req *http.Request, res *http.Response) error {
+	var subs []substitution
+	for _, r := range rs {
+		if r.phase != phaseResponse || !r.matches(req) {
+			continue
+		}
+		log.Debugf("rewriting response from %s per rule #%d", req.URL, r.index)
+		r.rewriteHeader(res.Header)
+		subs = append(subs, r.body...)
+	}
+	if len(subs) == 0 || !bodyAllowed(req.Method, res.StatusCode) || !textual(res.Header) {
+		return nil
+	}
+	limit := int64(conf.Args.Proxy.RewriteMaxBodySize)
+	if res.ContentLength > limit {
+		return nil
+	}
+	body, e := io.ReadAll(io.LimitReader(res.Body, limit+1))
+	if e != nil {
+		return errors.Wrap(e, "failed to read response body to rewrite")
+	}
+	if int64(len(body)) > limit {
+		log.Debugf("response body from %s exceeds %d bytes, skipped rewriting", req.URL, limit)
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return nil
+	}
+	for _, s := range subs {
+		body = s.re.ReplaceAll(body, []byte(s.replacement))
+	}
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{bytes.NewReader(body), res.Body}
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// textual returns whether the header denotes an uncompressed text body.
+func textual(h http.Header) bool {
+	if ce := h.Get("Content-Encoding"); ce != "" && !strings.EqualFold(ce, "identity") {
+		return false
+	}
+	mediaType, _, e := mime.ParseMediaType(h.Get("Content-Type"))
+	if e != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/x-www-form-urlencoded" ||
+		strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml") ||
+		strings.HasSuffix(mediaType, "javascript")
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestCompileRewrites(t *testing.T) {
+	rs, errs := compileRewrites([]conf.RewriteArgs{
+		{Phase: "Request", SetHeaders: []string{"X-Api-Key: secret"}},
+		{Phase: "sometime"},
+		{Phase: "request", Path: "("},
+		{Phase: "request", SetHeaders: []string{"no colon"}},
+		{Phase: "request", Body: []conf.SubstitutionArgs{{Pattern: "a"}}},
+		{Phase: "response", URL: conf.SubstitutionArgs{Pattern: "a"}},
+		{Phase: "response", ReplaceHeaders: []conf.SubstitutionArgs{{Pattern: "a"}}},
+	})
+	if len(rs) != 1 || len(errs) != 6 {
+		t.Errorf("compiled %d rules with %d errors, want 1 and 6: %v", len(rs), len(errs), errs)
+	}
+}
+
+func TestRewriteRequest(t *testing.T) {
+	rs, errs := compileRewrites([]conf.RewriteArgs{
+		{
+			Hosts:         []string{"api.test"},
+			Methods:       []string{"post"},
+			Phase:         "request",
+			SetHeaders:    []string{"X-Api-Key: secret"},
+			RemoveHeaders: []string{"X-Tracking"},
+			ReplaceHeaders: []conf.SubstitutionArgs{
+				{Header: "Accept", Pattern: `^text/plain$`, Replacement: "application/json"},
+			},
+			URL: conf.SubstitutionArgs{Pattern: `^http://api\.test/v1/`, Replacement: "https://v2.api.test/"},
+		},
+		{Hosts: []string{"api.test"}, Path: "/feed$", Phase: "response", Body: []conf.SubstitutionArgs{{Pattern: "a"}}},
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://api.test/v1/feed?q=1", nil)
+	req.Header.Set("X-Tracking", "1")
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("Accept-Encoding", "br")
+	rewriteRequest(rs, req)
+	if got := req.URL.String(); got != "https://v2.api.test/feed?q=1" || req.Host != "v2.api.test" {
+		t.Errorf("URL = %s, host = %s, want https://v2.api.test/feed?q=1", got, req.Host)
+	}
+	want := http.Header{"X-Api-Key": {"secret"}, "Accept": {"application/json"}}
+	for k := range want {
+		if req.Header.Get(k) != want.Get(k) {
+			t.Errorf("header %s = %q, want %q", k, req.Header.Get(k), want.Get(k))
+		}
+	}
+	for _, k := range []string{"X-Tracking", "Accept-Encoding"} {
+		if v := req.Header.Get(k); v != "" {
+			t.Errorf("header %s = %q, want removed", k, v)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://api.test/v1/feed", nil)
+	rewriteRequest(rs, req)
+	if req.Header.Get("X-Api-Key") != "" || req.URL.Host != "api.test" {
+		t.Error("rule shall not apply to other methods")
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	size := conf.Args.Proxy.RewriteMaxBodySize
+	defer func() { conf.Args.Proxy.RewriteMaxBodySize = size }()
+	conf.Args.Proxy.RewriteMaxBodySize = 64
+
+	rs, errs := compileRewrites([]conf.RewriteArgs{{
+		Phase:          "response",
+		SetHeaders:     []string{"Content-Type: application/json; charset=utf-8"},
+		RemoveHeaders:  []string{"Server"},
+		ReplaceHeaders: []conf.SubstitutionArgs{{Header: "Location", Pattern: "^http:", Replacement: "https:"}},
+		Body:           []conf.SubstitutionArgs{{Pattern: `http://(\w+)\.test`, Replacement: "https://$1.test"}},
+	}})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	tests := []struct {
+		name     string
+		method   string
+		encoding string
+		body     string
+		want     string
+	}{
+		{"substituted", http.MethodGet, "", `{"url":"http://a.test"}`, `{"url":"https://a.test"}`},
+		{"compressed", http.MethodGet, "gzip", `{"url":"http://a.test"}`, `{"url":"http://a.test"}`},
+		{"head", http.MethodHead, "", "", ""},
+		{"too large", http.MethodGet, "", strings.Repeat("http://a.test ", 8), strings.Repeat("http://a.test ", 8)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://a.test/", nil)
+			res := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Server": {"nginx"}, "Location": {"http://a.test/next"}},
+				Body:          io.NopCloser(strings.NewReader(tt.body)),
+				ContentLength: -1,
+			}
+			if tt.encoding != "" {
+				res.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if e := rewriteResponse(rs, req, res); e != nil {
+				t.Fatal(e)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != tt.want {
+				t.Errorf("body = %q, want %q", body, tt.want)
+			}
+			if res.Header.Get("Server") != "" || res.Header.Get("Location") != "https://a.test/next" ||
+				!strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+				t.Errorf("header = %v, want rewritten", res.Header)
+			}
+		})
+	}
+}
+
+func TestRewriteOnceAcrossRetries(t *testing.T) {
+	args := conf.Args.Proxy
+	saved := loadRewrites()
+	defer func() {
+		conf.Args.Proxy = args
+		rewrites = saved
+	}()
+	conf.Args.Proxy.MaxRetryDuration, conf.Args.Proxy.BackendProxyTimeout = 10, 10
+	rewrites, _ = compileRewrites([]conf.RewriteArgs{
+		{Phase: "request", URL: conf.SubstitutionArgs{Pattern: `/api/`, Replacement: "/api/v2/"}},
+	})
+
+	// the backend proxy drops the first request, so that it's retried
+	var attempts atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		io.WriteString(w, r.URL.String())
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	rt := route{mode: types.RotateProxy, noCache: true,
+		pinned: &types.ProxyServer{Source: "test", Host: u.Hostname(), Port: u.Port(), Type: "http"}}
+
+	req := httptest.NewRequest(http.MethodGet, "http://api.test/api/x", nil)
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		serveRequest(NewConnResponseWriter(server), req, nil, rt)
+	}()
+	res, e := http.ReadResponse(bufio.NewReader(client), req)
+	if e != nil {
+		t.Fatal(e)
+	}
+	body, _ := io.ReadAll(res.Body)
+	if attempts.Load() != 2 || string(body) != "http://api.test/api/v2/x" {
+		t.Errorf("relayed %s in %d attempts, want http://api.test/api/v2/x in 2", body, attempts.Load())
+	}
+}
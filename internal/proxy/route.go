@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+	"github.com/agux/roprox/internal/util"
+	"github.com/pkg/errors"
+)
+
+// Routing control headers. They are consumed by roprox and never relayed.
+const (
+	headerMode     = "X-Roprox-Mode"
+	headerCountry  = "X-Roprox-Country"
+	headerType     = "X-Roprox-Type"
+	headerMinScore = "X-Roprox-Min-Score"
+)
+
+// route describes how a request shall be relayed.
+type route struct {
+	mode types.ProxyMode
+	// countries restricts rotated proxies to those located in any of the countries (ProxyServer.Loc).
+	countries []string
+	// proxyType restricts rotated proxies to the type, either http or socks5.
+	proxyType string
+	// minScore restricts rotated proxies to those scored at least the value.
+	minScore float64
+	// session pins rotated proxies to the sticky session if not empty.
+	session string
+	// strategy overrides the global selection strategy if not empty.
+	strategy string
+	// host is the target host. Rotated proxies banned or cooling down for it are skipped.
+	host string
+	// pinned is the backend proxy to use regardless of mode if not nil, e.g. for replays.
+	pinned *types.ProxyServer
+	// noCache bypasses the response cache, e.g. for replays.
+	noCache bool
+	// noMaster denotes the user isn't allowed the master proxy, even as a fallback.
+	noMaster bool
+}
+
+// errNoProxy denotes no rotated proxy qualifies for the route, which can't fall back to the master proxy.
+var errNoProxy = errors.New("no qualified proxy available")
+
+// routeError denotes the client asked for a route it's not allowed to or that's malformed.
+type routeError struct {
+	status int
+	error
+}
+
+// defaultRoute determines the route for the client when no routing header is present.
+// If the user policy doesn't allow the default mode, the first allowed mode is used instead.
+func defaultRoute(u *proxyUser) route {
+	mode := types.RotateProxy
+	if conf.Args.Proxy.BypassTraffic {
+		mode = types.Direct
+	}
+	if !u.allows(mode) {
+		mode = u.modes[0]
+	}
+	return route{mode: mode, noMaster: !u.allows(types.MasterProxy)}
+}
+
+// routeFromHeaders derives the route from the routing control headers on top of base,
+// and removes the headers from the request.
+func routeFromHeaders(base route, header http.Header, u *proxyUser) (rt route, e error) {
+	rt = base
+	defer func() {
+		for _, h := range []string{headerMode, headerCountry, headerType, headerMinScore, headerStrategy} {
+			header.Del(h)
+		}
+	}()
+
+	if v := strings.ToLower(strings.TrimSpace(header.Get(headerMode))); v != "" {
+		mode := types.ProxyMode(v)
+		switch mode {
+		case types.Direct, types.MasterProxy, types.RotateProxy:
+		default:
+			return rt, &routeError{http.StatusBadRequest, errors.Errorf("invalid %s: %s", headerMode, v)}
+		}
+		if !u.allows(mode) {
+			return rt, &routeError{http.StatusForbidden, errors.Errorf("proxy mode %s is not allowed", mode)}
+		}
+		rt.mode = mode
+	}
+	if v := header.Get(headerCountry); v != "" {
+		rt.countries = nil
+		for _, c := range strings.Split(v, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				rt.countries = append(rt.countries, c)
+			}
+		}
+	}
+	if v := strings.ToLower(strings.TrimSpace(header.Get(headerType))); v != "" {
+		if v != "http" && v != "socks5" {
+			return rt, &routeError{http.StatusBadRequest, errors.Errorf("invalid %s: %s", headerType, v)}
+		}
+		rt.proxyType = v
+	}
+	if v := strings.TrimSpace(header.Get(headerMinScore)); v != "" {
+		if rt.minScore, e = strconv.ParseFloat(v, 64); e != nil {
+			return rt, &routeError{http.StatusBadRequest, errors.Errorf("invalid %s: %s", headerMinScore, v)}
+		}
+	}
+	if v := strings.ToLower(strings.TrimSpace(header.Get(headerStrategy))); v != "" {
+		if _, ok := strategies[v]; !ok {
+			return rt, &routeError{http.StatusBadRequest, errors.Errorf("invalid %s: %s", headerStrategy, v)}
+		}
+		rt.strategy = v
+	}
+	return
+}
+
+// writeRouteError responds to the client with the status denoted by the routing error.
+func writeRouteError(cw *ConnResponseWriter, e error) {
+	status := http.StatusBadRequest
+	if re, ok := e.(*routeError); ok {
+		status = re.status
+	}
+	cw.close = true
+	http.Error(cw, e.Error(), status)
+}
+
+// matches returns whether the backend proxy satisfies the filters of the route.
+func (rt route) matches(ps *types.ProxyServer) bool {
+	if ps.Score < rt.minScore {
+		return false
+	}
+	if rt.proxyType != "" {
+		t := strings.ToLower(ps.Type)
+		if rt.proxyType == "http" && !strings.HasPrefix(t, "http") ||
+			rt.proxyType != "http" && t != rt.proxyType {
+			return false
+		}
+	}
+	if len(rt.countries) > 0 {
+		found := false
+		for _, c := range rt.countries {
+			if strings.EqualFold(c, ps.Loc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// proxyFor returns the backend proxy for the route. nil denotes direct connection.
+// Rotated routes never fall back to direct connections, see selectProxy.
+func proxyFor(rt route) (ps *types.ProxyServer, e error) {
+	if rt.pinned != nil {
+		return rt.pinned, nil
+	}
+	switch rt.mode {
+	case types.Direct:
+		return nil, nil
+	case types.MasterProxy:
+		return util.GetMasterProxy(), nil
+	default:
+		pick := func() *types.ProxyServer {
+			ps, e = selectProxy(rt)
+			return ps
+		}
+		if rt.session != "" {
+			ps = sessions.acquire(rt.session, func(pinned *types.ProxyServer) *types.ProxyServer {
+				current := pooledProxy(pinned.ID)
+				if current == nil || !rt.matches(current) || reputation.isExcluded(rt.host, current.ID) {
+					return nil
+				}
+				return current
+			}, pick)
+			return
+		}
+		return pick(), e
+	}
+}
+
+// fallsBackToMaster returns whether the master proxy may serve the route when no rotated proxy qualifies:
+// the fallback is enabled, the user is allowed the master proxy, and no filter is requested that it may fail.
+func (rt route) fallsBackToMaster() bool {
+	return conf.Args.Proxy.FallbackMasterProxy && !rt.noMaster &&
+		len(rt.countries) == 0 && rt.proxyType == "" && rt.minScore <= 0
+}
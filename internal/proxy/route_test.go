@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+)
+
+func TestRouteFromHeaders(t *testing.T) {
+	base := route{mode: types.RotateProxy}
+	restricted := &proxyUser{name: "crawler", modes: []types.ProxyMode{types.RotateProxy}}
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		user       *proxyUser
+		want       route
+		wantStatus int
+	}{
+		{"no header", nil, nil, base, 0},
+		{"all headers", map[string]string{
+			headerMode:     "Master",
+			headerCountry:  "US, de",
+			headerType:     "SOCKS5",
+			headerMinScore: "85.5",
+			headerStrategy: "P2C",
+		}, nil, route{
+			mode:      types.MasterProxy,
+			countries: []string{"US", "de"},
+			proxyType: "socks5",
+			minScore:  85.5,
+			strategy:  "p2c",
+		}, 0},
+		{"invalid mode", map[string]string{headerMode: "random"}, nil, base, http.StatusBadRequest},
+		{"invalid type", map[string]string{headerType: "socks4"}, nil, base, http.StatusBadRequest},
+		{"invalid score", map[string]string{headerMinScore: "high"}, nil, base, http.StatusBadRequest},
+		{"invalid strategy", map[string]string{headerStrategy: "fastest"}, nil, base, http.StatusBadRequest},
+		{"mode not allowed", map[string]string{headerMode: "direct"}, restricted, base, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.headers {
+				header.Set(k, v)
+			}
+			got, e := routeFromHeaders(base, header, tt.user)
+			for k := range tt.headers {
+				if header.Get(k) != "" {
+					t.Errorf("header %s shall be removed", k)
+				}
+			}
+			if tt.wantStatus != 0 {
+				re, ok := e.(*routeError)
+				if !ok || re.status != tt.wantStatus {
+					t.Fatalf("routeFromHeaders() error = %v, want status %d", e, tt.wantStatus)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("routeFromHeaders() unexpected error: %v", e)
+			}
+			if got.mode != tt.want.mode || got.proxyType != tt.want.proxyType ||
+				got.minScore != tt.want.minScore || got.strategy != tt.want.strategy || len(got.countries) != len(tt.want.countries) {
+				t.Errorf("routeFromHeaders() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	ps := &types.ProxyServer{Type: "https", Loc: "US", Score: 80}
+	tests := []struct {
+		name string
+		rt   route
+		want bool
+	}{
+		{"no filter", route{}, true},
+		{"http type matches https proxy", route{proxyType: "http"}, true},
+		{"socks5 type", route{proxyType: "socks5"}, false},
+		{"country case-insensitive", route{countries: []string{"de", "us"}}, true},
+		{"other country", route{countries: []string{"DE"}}, false},
+		{"score satisfied", route{minScore: 80}, true},
+		{"score too low", route{minScore: 80.1}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.rt.matches(ps); got != tt.want {
+			t.Errorf("%s: matches() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProxyForNoCandidate(t *testing.T) {
+	fallback := conf.Args.Proxy.FallbackMasterProxy
+	defer func() { conf.Args.Proxy.FallbackMasterProxy = fallback }()
+	// the proxy cache is empty while bypassing traffic in tests
+	if len(proxyCache.GetData()) > 0 {
+		t.Skip("proxy cache is loaded")
+	}
+
+	tests := []struct {
+		name       string
+		fallback   bool
+		rt         route
+		wantMaster bool
+	}{
+		{"no fallback", false, route{mode: types.RotateProxy, countries: []string{"ZZ"}}, false},
+		{"fallback with filter", true, route{mode: types.RotateProxy, countries: []string{"ZZ"}}, false},
+		{"fallback not allowed", true, route{mode: types.RotateProxy, noMaster: true}, false},
+		{"fallback", true, route{mode: types.RotateProxy}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.Args.Proxy.FallbackMasterProxy = tt.fallback
+			ps, e := proxyFor(tt.rt)
+			if tt.wantMaster {
+				if e != nil || ps == nil || ps.ID != 0 {
+					t.Errorf("proxyFor() = %+v, %v, want master proxy", ps, e)
+				}
+				return
+			}
+			if ps != nil || !errors.Is(e, errNoProxy) || upstreamErrorStatus(e, 0) != http.StatusServiceUnavailable {
+				t.Errorf("proxyFor() = %+v, %v, want errNoProxy", ps, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+	"github.com/pkg/errors"
+)
+
+// Rule match types.
+const (
+	matchDomainSuffix  = "domain_suffix"
+	matchDomainKeyword = "domain_keyword"
+	matchDomainRegex   = "domain_regex"
+	matchIPCIDR        = "ip_cidr"
+	matchDstPort       = "dst_port"
+	matchSrcIP         = "src_ip"
+)
+
+// actionReject rejects matching requests. Other rule actions are proxy modes.
+const actionReject = "reject"
+
+// routingRule routes requests matching any of its values per its action.
+type routingRule struct {
+	index   int
+	match   string
+	values  []string
+	regexes []*regexp.Regexp
+	cidrs   []*net.IPNet
+	ports   map[int]bool
+	action  string
+	// filters of rotated proxies
+	countries []string
+	proxyType string
+	minScore  float64
+}
+
+// ruleTarget is what routing rules are evaluated against.
+type ruleTarget struct {
+	host     string
+	port     int
+	clientIP net.IP
+}
+
+var (
+	rules     []*routingRule
+	rulesOnce sync.Once
+)
+
+// loadRules compiles the routing rules defined in the configuration. Invalid rules are skipped.
+func loadRules() []*routingRule {
+	rulesOnce.Do(func() {
+		var errs []error
+		rules, errs = compileRules(conf.Args.Proxy.Rules)
+		for _, e := range errs {
+			log.Error(e)
+		}
+	})
+	return rules
+}
+
+func compileRules(args []conf.RuleArgs) (rs []*routingRule, errs []error) {
+	for i, ra := range args {
+		r := &routingRule{
+			index:     i,
+			match:     strings.ToLower(ra.Match),
+			values:    ra.Values,
+			action:    strings.ToLower(ra.Action),
+			countries: ra.Countries,
+			proxyType: strings.ToLower(ra.Type),
+			minScore:  ra.MinScore,
+		}
+		if e := r.compile(); e != nil {
+			errs = append(errs, errors.Wrapf(e, "invalid routing rule #%d", i))
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return
+}
+
+func (r *routingRule) compile() error {
+	switch types.ProxyMode(r.action) {
+	case types.Direct, types.MasterProxy, types.RotateProxy, actionReject:
+	default:
+		return errors.Errorf("unknown action %q", r.action)
+	}
+	if r.proxyType != "" && r.proxyType != "http" && r.proxyType != "socks5" {
+		return errors.Errorf("unknown proxy type %q", r.proxyType)
+	}
+	for _, v := range r.values {
+		switch r.match {
+		case matchDomainSuffix, matchDomainKeyword:
+		case matchDomainRegex:
+			re, e := regexp.Compile(v)
+			if e != nil {
+				return errors.Wrapf(e, "invalid regex %q", v)
+			}
+			r.regexes = append(r.regexes, re)
+		case matchIPCIDR, matchSrcIP:
+			if !strings.Contains(v, "/") {
+				if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+					v += "/32"
+				} else {
+					v += "/128"
+				}
+			}
+			_, cidr, e := net.ParseCIDR(v)
+			if e != nil {
+				return errors.Wrapf(e, "invalid CIDR %q", v)
+			}
+			r.cidrs = append(r.cidrs, cidr)
+		case matchDstPort:
+			port, e := strconv.Atoi(v)
+			if e != nil {
+				return errors.Wrapf(e, "invalid port %q", v)
+			}
+			if r.ports == nil {
+				r.ports = make(map[int]bool)
+			}
+			r.ports[port] = true
+		default:
+			return errors.Errorf("unknown match type %q", r.match)
+		}
+	}
+	return nil
+}
+
+// matches returns whether the target matches any value of the rule.
+// Domain names are not resolved, so ip_cidr rules only match targets addressed by IP.
+func (r *routingRule) matches(t ruleTarget) bool {
+	switch r.match {
+	case matchDomainSuffix:
+		return hostMatches(t.host, r.values)
+	case matchDomainKeyword:
+		for _, v := range r.values {
+			if strings.Contains(t.host, strings.ToLower(v)) {
+				return true
+			}
+		}
+	case matchDomainRegex:
+		for _, re := range r.regexes {
+			if re.MatchString(t.host) {
+				return true
+			}
+		}
+	case matchIPCIDR, matchSrcIP:
+		ip := t.clientIP
+		if r.match == matchIPCIDR {
+			ip = net.ParseIP(t.host)
+		}
+		for _, cidr := range r.cidrs {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		}
+	case matchDstPort:
+		return r.ports[t.port]
+	}
+	return false
+}
+
+// String describes the rule for logging and dry runs.
+func (r *routingRule) String() string {
+	s := fmt.Sprintf("#%d %s %s -> %s", r.index, r.match, strings.Join(r.values, ","), r.action)
+	if len(r.countries) > 0 {
+		s += " country=" + strings.Join(r.countries, ",")
+	}
+	if r.proxyType != "" {
+		s += " type=" + r.proxyType
+	}
+	if r.minScore > 0 {
+		s += fmt.Sprintf(" min_score=%v", r.minScore)
+	}
+	return s
+}
+
+// evaluateRules returns the first rule matching the target, or nil if none matches.
+func evaluateRules(rs []*routingRule, t ruleTarget) *routingRule {
+	for _, r := range rs {
+		if r.matches(t) {
+			return r
+		}
+	}
+	return nil
+}
+
+// targetOf returns the rule target of the request from the client.
+func targetOf(req *http.Request) ruleTarget {
+	t := ruleTarget{host: targetHost(req)}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if _, p, e := net.SplitHostPort(host); e == nil {
+		t.port, _ = strconv.Atoi(p)
+	} else if req.Method == http.MethodConnect || req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+		t.port = 443
+	} else {
+		t.port = 80
+	}
+	if ip, _, e := net.SplitHostPort(req.RemoteAddr); e == nil {
+		t.clientIP = net.ParseIP(ip)
+	}
+	return t
+}
+
+// applyRules returns base amended by the first rule matching the target.
+// Requests matching a reject rule result in a routing error.
+func applyRules(base route, t ruleTarget) (route, error) {
+	return applyRulesWith(loadRules(), base, t)
+}
+
+func applyRulesWith(rs []*routingRule, base route, t ruleTarget) (rt route, e error) {
+	rt = base
+	r := evaluateRules(rs, t)
+	if r == nil {
+		return
+	}
+	log.Debugf("%s:%d matches routing rule %s", t.host, t.port, r)
+	if r.action == actionReject {
+		return rt, &routeError{http.StatusForbidden, errors.Errorf("%s is rejected by routing rule #%d", t.host, r.index)}
+	}
+	rt.mode = types.ProxyMode(r.action)
+	rt.countries = r.countries
+	rt.proxyType = r.proxyType
+	rt.minScore = r.minScore
+	return
+}
+
+// DryRunRoute describes how a request to the target URL from the client IP would be routed.
+// The client IP may be empty.
+func DryRunRoute(target, clientIP string) (string, error) {
+	u, e := url.Parse(target)
+	if e != nil || u.Host == "" {
+		// host[:port] without scheme
+		if u, e = url.Parse("http://" + target); e != nil {
+			return "", errors.Wrapf(e, "invalid target %q", target)
+		}
+	}
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, RemoteAddr: net.JoinHostPort(clientIP, "0")}
+	t := targetOf(req)
+	rt := defaultRoute(nil)
+	desc := fmt.Sprintf("target: host=%s port=%d client_ip=%v\n", t.host, t.port, t.clientIP)
+	r := evaluateRules(loadRules(), t)
+	if r == nil {
+		return desc + fmt.Sprintf("no rule matched, default mode: %s", rt.mode), nil
+	}
+	desc += fmt.Sprintf("matched rule: %s\n", r)
+	if rt, e = applyRules(rt, t); e != nil {
+		return desc + "result: reject", nil
+	}
+	return desc + fmt.Sprintf("result: mode=%s", rt.mode), nil
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestEvaluateRules(t *testing.T) {
+	rs, errs := compileRules([]conf.RuleArgs{
+		{Match: "domain_suffix", Values: []string{"example.com"}, Action: "rotate", Countries: []string{"US"}, Type: "socks5"},
+		{Match: "domain_keyword", Values: []string{"ads"}, Action: "reject"},
+		{Match: "domain_regex", Values: []string{`^api\d+\.test$`}, Action: "master"},
+		{Match: "ip_cidr", Values: []string{"10.0.0.0/8", "fd00::/8"}, Action: "direct"},
+		{Match: "dst_port", Values: []string{"25"}, Action: "reject"},
+		{Match: "src_ip", Values: []string{"192.168.1.10"}, Action: "direct"},
+		{Match: "domain_suffix", Values: []string{"bad.test"}, Action: "bounce"},
+		{Match: "ip_cidr", Values: []string{"10.0.0.0/33"}, Action: "direct"},
+	})
+	if len(errs) != 2 {
+		t.Errorf("compileRules() errors = %v, want 2", errs)
+	}
+
+	tests := []struct {
+		name     string
+		target   ruleTarget
+		wantRule int
+	}{
+		{"suffix", ruleTarget{host: "www.example.com", port: 443}, 0},
+		{"keyword", ruleTarget{host: "ads.tracker.net", port: 80}, 1},
+		{"regex", ruleTarget{host: "api42.test", port: 80}, 2},
+		{"cidr", ruleTarget{host: "10.1.2.3", port: 80}, 3},
+		{"ipv6 cidr", ruleTarget{host: "fd00::1", port: 80}, 3},
+		{"port", ruleTarget{host: "mail.org", port: 25}, 4},
+		{"client ip", ruleTarget{host: "other.org", port: 80, clientIP: net.ParseIP("192.168.1.10")}, 5},
+		{"no match", ruleTarget{host: "other.org", port: 80, clientIP: net.ParseIP("192.168.1.11")}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := evaluateRules(rs, tt.target)
+			if tt.wantRule < 0 {
+				if got != nil {
+					t.Errorf("evaluateRules() = %s, want no match", got)
+				}
+				return
+			}
+			if got == nil || got.index != tt.wantRule {
+				t.Errorf("evaluateRules() = %v, want rule #%d", got, tt.wantRule)
+			}
+		})
+	}
+
+	rt, e := applyRulesWith(rs, route{mode: types.Direct}, ruleTarget{host: "example.com", port: 443})
+	if e != nil || rt.mode != types.RotateProxy || rt.proxyType != "socks5" || len(rt.countries) != 1 {
+		t.Errorf("applyRules() = %+v, %v", rt, e)
+	}
+	if _, e = applyRulesWith(rs, route{}, ruleTarget{host: "ads.test", port: 80}); e == nil {
+		t.Error("applyRules() shall reject the target")
+	}
+}
+
+func TestTargetOf(t *testing.T) {
+	u, _ := url.Parse("https://Example.com/path")
+	got := targetOf(&http.Request{Method: http.MethodGet, URL: u, Host: u.Host, RemoteAddr: "192.168.1.10:5000"})
+	if got.host != "example.com" || got.port != 443 || !got.clientIP.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("targetOf() = %+v", got)
+	}
+	got = socks5Target("10.0.0.1:8080", "[::1]:5000")
+	if got.host != "10.0.0.1" || got.port != 8080 || !got.clientIP.Equal(net.IPv6loopback) {
+		t.Errorf("socks5Target() = %+v", got)
+	}
+}
@@ -7,9 +7,10 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,12 +31,27 @@ import (
 var log = logging.Logger
 var masterProxy *types.ProxyServer
 
+const (
+	// maxDrainSize bounds the unread request body discarded to keep the client connection alive.
+	maxDrainSize = 256 << 10
+	// maxRetryBodySize bounds the request body kept for resending it with another proxy.
+	maxRetryBodySize = 1 << 20
+)
+
 // ConnResponseWriter is our custom ResponseWriter that uses net.Conn.
 type ConnResponseWriter struct {
 	conn        net.Conn
 	header      http.Header
 	statusCode  int
 	wroteHeader bool
+	// chunked encodes the body with chunked transfer coding if not nil.
+	chunked io.WriteCloser
+	// noBody denotes the response carries no body, e.g. response to HEAD request.
+	noBody bool
+	// close denotes the client connection shall be closed after this response.
+	close bool
+	// http10 denotes the client speaks HTTP/1.0, which needs explicit keep-alive.
+	http10 bool
 }
 
 // Make sure ConnResponseWriter implements http.ResponseWriter.
@@ -61,9 +77,28 @@ func (cw *ConnResponseWriter) Write(data []byte) (int, error) {
 	if !cw.wroteHeader {
 		cw.writeHeaders()
 	}
+	if cw.chunked != nil {
+		return cw.chunked.Write(data)
+	}
 	return cw.conn.Write(data)
 }
 
+// finish completes the response, writing the terminating chunk if chunked transfer coding is in use.
+func (cw *ConnResponseWriter) finish() (e error) {
+	if !cw.wroteHeader {
+		cw.writeHeaders()
+	}
+	if cw.chunked == nil {
+		return
+	}
+	if e = cw.chunked.Close(); e != nil {
+		return
+	}
+	cw.chunked = nil
+	_, e = cw.conn.Write([]byte("\r\n"))
+	return
+}
+
 // Header returns the header map that will be sent by WriteHeader.
 func (cw *ConnResponseWriter) Header() http.Header {
 	return cw.header
@@ -75,6 +110,18 @@ func (cw *ConnResponseWriter) writeHeaders() {
 		return // Headers already written
 	}
 
+	// The connection can only be reused if the end of the response can be determined by the client.
+	delimited := cw.noBody || cw.header.Get("Content-Length") != "" ||
+		strings.EqualFold(cw.header.Get("Transfer-Encoding"), "chunked")
+	if !delimited {
+		cw.close = true
+	}
+	if cw.close {
+		cw.header.Set("Connection", "close")
+	} else if cw.http10 {
+		cw.header.Set("Connection", "keep-alive")
+	}
+
 	// Write status line
 	statusLine := fmt.Sprintf("HTTP/1.1 %d %s\r\n", cw.statusCode, http.StatusText(cw.statusCode))
 	cw.conn.Write([]byte(statusLine))
@@ -90,10 +137,15 @@ func (cw *ConnResponseWriter) writeHeaders() {
 	// End of headers
 	cw.conn.Write([]byte("\r\n"))
 
+	if strings.EqualFold(cw.header.Get("Transfer-Encoding"), "chunked") {
+		cw.chunked = httputil.NewChunkedWriter(cw.conn)
+	}
+
 	cw.wroteHeader = true
 }
 
-func Serve(wg *sync.WaitGroup) {
+// Serve serves the HTTP proxy until the context is done. Client connections are drained by Shutdown.
+func Serve(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.Args.Proxy.Port))
@@ -114,25 +166,22 @@ func Serve(wg *sync.WaitGroup) {
 		}
 	}
 
-	for {
-		client, err := listener.Accept()
-		if err != nil {
-			log.Errorf("Error accepting connection: %v\n", err)
-			continue
-		}
-
-		// Handle each connection in a new goroutine
-		go handleClient(client)
-		//TODO: utilize pooling as guardrail.
-	}
+	closeOnDone(ctx, listener)
+	go purgeTrafficPeriodically(ctx)
+	acceptLoop(listener, func(client net.Conn) {
+		serveAdmitted(client, handleClient, rejectHTTP)
+	})
+	log.Info("proxy stopped accepting connections")
 }
 
 func handleClient(client net.Conn) {
 	// Create our custom ResponseWriter
 	cw := NewConnResponseWriter(client)
-	defer cw.conn.Close()
+	defer client.Close()
 
-	request, err := http.ReadRequest(bufio.NewReader(client))
+	reader := bufio.NewReader(client)
+	request, err := readRequest(client, reader)
+	clients.setIdle(client, false)
 	if err != nil {
 		emsg := fmt.Sprintf("Error reading request: %+v", err)
 		log.Error(emsg)
@@ -140,11 +189,44 @@ func handleClient(client net.Conn) {
 		return
 	}
 
+	if servesLocally(request) {
+		serveLocal(client, request)
+		return
+	}
+
+	user, userSession, ok := authenticateRequest(request)
+	if !ok {
+		requireAuthentication(cw)
+		return
+	}
+	if !userStore.acquire(user) {
+		http.Error(cw, "too many concurrent connections", http.StatusTooManyRequests)
+		return
+	}
+	defer userStore.release(user)
+
 	var e error
+	connRoute := defaultRoute(user)
+	conn := client
 	// var tlsClient *tls.Conn
 	// If method is CONNECT, we're dealing with HTTPS. This part is not retryable
 	if request.Method == http.MethodConnect {
-		if request, _, e = intercept(cw, request, client); e != nil {
+		// routing rules and headers on CONNECT apply to all requests within the tunnel
+		if connRoute, e = applyRules(connRoute, targetOf(request)); e != nil {
+			writeRouteError(cw, e)
+			return
+		}
+		if connRoute, e = routeFromHeaders(connRoute, request.Header, user); e != nil {
+			writeRouteError(cw, e)
+			return
+		}
+		connRoute.session = sessionKey(request.Header, request.RemoteAddr, user, userSession)
+		if !shouldIntercept(request.URL.Hostname()) {
+			tunnel(cw, request, reader, connRoute)
+			return
+		}
+		var tlsConn *tls.Conn
+		if tlsConn, e = intercept(cw, request, client); e != nil {
 			emsg := fmt.Sprintf("Error intercepting request: %+v", e)
 			log.Error(emsg)
 			http.Error(cw, "", http.StatusBadRequest)
@@ -205,36 +287,244 @@ func handleClient(client net.Conn) {
 			// 	log.Errorf("Unhandled error type: %T\n", e)
 			// }
 		}
+		conn = tlsConn
+		// read requests from the intercepted TLS connection hereafter
+		reader = bufio.NewReader(tlsConn)
+		if request, e = readRequest(conn, reader); e != nil {
+			log.Warnf("Error reading intercepted request: %+v", e)
+			return
+		}
 	}
 
-	op := func() (e error) {
-		var ps *types.ProxyServer
-		if !conf.Args.Proxy.BypassTraffic {
-			ps = selectProxy()
+	// serve requests on the same connection until either side asks to close it
+	for {
+		rt := connRoute
+		// requests in absolute form may address different targets over the same connection
+		if request.URL.IsAbs() {
+			if rt, e = applyRules(rt, targetOf(request)); e != nil {
+				writeRouteError(NewConnResponseWriter(conn), e)
+				return
+			}
 		}
-		e = handleHttpRequest(cw, request, ps)
-		network.UpdateProxyScore(ps, e == nil)
+		rt, e = routeFromHeaders(rt, request.Header, user)
+		if e != nil {
+			writeRouteError(NewConnResponseWriter(conn), e)
+			return
+		}
+		if session := sessionKey(request.Header, request.RemoteAddr, user, userSession); session != "" {
+			rt.session = session
+		}
+		if isUpgrade(request) {
+			handleUpgrade(conn, reader, request, user, rt)
+			return
+		}
+		if !serveRequest(NewConnResponseWriter(conn), request, user, rt) {
+			return
+		}
+		// the rest of an unread body would otherwise be parsed as the next request
+		if !drainBody(request.Body) {
+			return
+		}
+		if !clients.setIdle(client, true) {
+			return
+		}
+		request, e = readRequest(conn, reader)
+		clients.setIdle(client, false)
+		if e != nil {
+			if e != io.EOF && !errors.Is(e, os.ErrDeadlineExceeded) {
+				log.Debugf("Error reading subsequent request: %+v", e)
+			}
+			return
+		}
+		// the connection has been authenticated by its first request
+		request.Header.Del("Proxy-Authorization")
+	}
+}
+
+// drainBody discards the unread rest of the request body, up to maxDrainSize bytes, so that the next request
+// can be read from the client connection. It returns false if the body can't be consumed, and the
+// connection must be closed then.
+func drainBody(body io.ReadCloser) bool {
+	if body == nil || body == http.NoBody {
+		return true
+	}
+	n, e := io.Copy(io.Discard, io.LimitReader(body, maxDrainSize+1))
+	if e != nil || n > maxDrainSize {
+		return false
+	}
+	body.Close()
+	return true
+}
+
+// readRequest reads the next request from the client connection,
+// waiting at most the configured idle timeout for it to arrive.
+func readRequest(conn net.Conn, reader *bufio.Reader) (req *http.Request, e error) {
+	if conf.Args.Proxy.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(conf.Args.Proxy.IdleTimeout) * time.Second))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	if req, e = http.ReadRequest(reader); e != nil {
 		return
 	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	return
+}
+
+// serveRequest relays the request via backend proxy selected per the route, retrying
+// with another proxy within MaxRetryDuration. It returns whether the client connection can be reused.
+func serveRequest(cw *ConnResponseWriter, request *http.Request, user *proxyUser, rt route) (keepAlive bool) {
+	cw.close = request.Close
+	cw.http10 = !request.ProtoAtLeast(1, 1)
+	toClientRequest(request)
+	// rewrites apply once, as retries relay the same request
+	clientUserAgent := request.Header.Get("User-Agent")
+	rewriteRequest(loadRewrites(), request)
+	bindUserAgent := request.Header.Get("User-Agent") == clientUserAgent
+	rt.host = targetHost(request)
+	var cx *cacheExchange
+	if !rt.noCache {
+		cx = newCacheExchange(request)
+	}
+	if cx.serveStored(cw, request) {
+		return !cw.close
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(),
 		time.Duration(conf.Args.Proxy.MaxRetryDuration)*time.Second)
 	defer cancel()
+	// the latest blocked response is relayed if no proxy gets through
+	var blocked *blockedError
+	var body *retryBody
+	if request.Body != nil && request.Body != http.NoBody {
+		body = &retryBody{r: request.Body, limit: maxRetryBodySize}
+	}
+	op := func() (e error) {
+		if body != nil {
+			r, e := body.rewind()
+			if e != nil {
+				return retry.Unrecoverable(e)
+			}
+			request.Body = r
+		}
+		ps, e := proxyFor(rt)
+		if e != nil {
+			return retry.Unrecoverable(e)
+		}
+		if proxyLimited, e := throttle(ctx, rt.host, ps); e != nil {
+			if proxyLimited {
+				// another proxy may take the request
+				return e
+			}
+			return retry.Unrecoverable(e)
+		}
+		end := usage.begin(ps)
+		defer end()
+		if ps != nil && bindUserAgent {
+			request.Header.Set("User-Agent", userAgentFor(ps))
+		}
+		e = handleHttpRequest(cw, request, ps, user.inspect(), cx)
+		var be *blockedError
+		if errors.As(e, &be) {
+			blocked = be
+		}
+		network.UpdateProxyScore(ps, e == nil)
+		reputation.record(ps, rt.host, e)
+		if e != nil && rt.session != "" {
+			sessions.fail(rt.session, ps)
+		}
+		if e != nil && cw.wroteHeader {
+			// part of the response has reached the client, it's too late to retry with another proxy
+			return retry.Unrecoverable(e)
+		}
+		return
+	}
+
 	if e := retry.Do(
 		op,
 		retry.Delay(0),
 		retry.LastErrorOnly(true),
 		retry.Context(ctx),
 	); e != nil {
-		http.Error(cw, e.Error(), http.StatusInternalServerError)
+		if cw.wroteHeader {
+			log.Warnf("response to %s was interrupted: %+v", request.URL, e)
+			return false
+		}
+		cw.close = true
+		if blocked != nil {
+			log.Warnf("relaying blocked response to %s: %+v", request.URL, e)
+			if e = blocked.relay(cw, request); e != nil {
+				log.Warnf("failed to relay blocked response to %s: %+v", request.URL, e)
+			}
+			return false
+		}
+		http.Error(cw, e.Error(), upstreamErrorStatus(e, http.StatusInternalServerError))
+		return false
 	}
+	return !cw.close
 }
 
-// func handleCustomProtocol() {
+// retryBody keeps the first limit bytes read from the request body, so that the body can be sent again
+// with another proxy. Each attempt reads the body over, while readers of former attempts, which the transport
+// may not have stopped yet, fail.
+type retryBody struct {
+	sync.Mutex
+	r        io.Reader
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+	attempts int
+}
 
-// }
+// retryBodyReader reads the body for an attempt. It's left open, as the body may be sent again or drained.
+type retryBodyReader struct {
+	b       *retryBody
+	attempt int
+	pos     int
+}
 
-func handleHttpRequest(cw *ConnResponseWriter, req *http.Request, ps *types.ProxyServer) (e error) {
+// rewind returns a reader of the body from the start, which fails if more than limit bytes have been read.
+func (b *retryBody) rewind() (io.ReadCloser, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.overflow {
+		return nil, errors.Errorf("request body exceeding %d bytes can't be sent again", b.limit)
+	}
+	b.attempts++
+	return &retryBodyReader{b: b, attempt: b.attempts}, nil
+}
+
+func (r *retryBodyReader) Read(p []byte) (n int, e error) {
+	b := r.b
+	b.Lock()
+	defer b.Unlock()
+	if r.attempt != b.attempts {
+		return 0, errors.New("request body is read by another attempt")
+	}
+	if !b.overflow && r.pos < b.buf.Len() {
+		n = copy(p, b.buf.Bytes()[r.pos:])
+		r.pos += n
+		return
+	}
+	n, e = b.r.Read(p)
+	r.pos += n
+	if b.overflow {
+		return
+	}
+	if b.buf.Len()+n > b.limit {
+		b.overflow = true
+		b.buf = bytes.Buffer{}
+		return
+	}
+	b.buf.Write(p[:n])
+	return
+}
+
+func (r *retryBodyReader) Close() error {
+	return nil
+}
+
+// toClientRequest turns the request read from the client into a request to the target.
+func toClientRequest(req *http.Request) {
 	if req.URL != nil && req.URL.Scheme == "" {
 		req.URL.Scheme = "https"
 	}
@@ -242,20 +532,27 @@ func handleHttpRequest(cw *ConnResponseWriter, req *http.Request, ps *types.Prox
 	// Request.RequestURI can't be set in client requests
 	req.RequestURI = ""
 	req.URL.Host = req.Host
+	removeHopHeaders(req.Header)
+}
 
-	if ps != nil {
-		userAgent := conf.Args.Network.DefaultUserAgent
-		if uaVal, e := ua.GetUserAgent(ps.UrlString()); e != nil && uaVal == "" {
-			log.Warnf("failed to get random user-agent: %+v\nfallback to default User-Agent: %s", e, userAgent)
-		} else {
-			userAgent = uaVal
-		}
-		req.Header.Set("User-Agent", userAgent)
+// userAgentFor returns the User-Agent bound to the backend proxy, or the default one.
+func userAgentFor(ps *types.ProxyServer) string {
+	userAgent := conf.Args.Network.DefaultUserAgent
+	if uaVal, e := ua.GetUserAgent(ps.UrlString()); e != nil && uaVal == "" {
+		log.Warnf("failed to get random user-agent: %+v\nfallback to default User-Agent: %s", e, userAgent)
+	} else {
+		userAgent = uaVal
 	}
+	return userAgent
+}
 
-	targetClient := &http.Client{
-		Timeout: time.Duration(conf.Args.Proxy.BackendProxyTimeout) * time.Second,
-	}
+// func handleCustomProtocol() {
+
+// }
+
+func handleHttpRequest(cw *ConnResponseWriter, req *http.Request, ps *types.ProxyServer, inspect bool, cx *cacheExchange) (e error) {
+	cx.prepare(req)
+	targetClient := &http.Client{}
 
 	var transport *http.Transport
 	if transport, e = network.GetTransport(ps, true); e != nil {
@@ -265,15 +562,41 @@ func handleHttpRequest(cw *ConnResponseWriter, req *http.Request, ps *types.Prox
 		log.Tracef("relaying HTTP request via proxy [%s]:\n%+v", ps.UrlString(), req)
 	}
 	targetClient.Transport = transport
+	// headers of a previous attempt must not leak into this one, e.g. Content-Length
+	if !cw.wroteHeader {
+		clear(cw.Header())
+	}
 
-	var reqBodyCopy []byte
-	if req.Body != nil && conf.Args.Proxy.EnableInspection {
-		reqBodyCopy, _ = io.ReadAll(req.Body)
-		// After reading the body, it needs to be replaced for the client.Do call
-		req.Body = io.NopCloser(bytes.NewBuffer(reqBodyCopy))
+	if ps != nil && ps.ID > 0 && req.Header.Get("Accept-Encoding") != "" &&
+		classifiesBody(loadClassifiers(), strings.ToLower(req.URL.Hostname())) {
+		// body patterns can't see through other encodings, e.g. br
+		if ae := acceptDecodable(req.Header.Get("Accept-Encoding")); ae != "" {
+			req.Header.Set("Accept-Encoding", ae)
+		} else {
+			req.Header.Del("Accept-Encoding")
+		}
 	}
 
-	response, err := targetClient.Do(req)
+	inspect = inspect && inspections.wants(req)
+	var reqCapture *capturedBody
+	if inspect && req.Body != nil && req.Body != http.NoBody {
+		// the request body is captured as it's sent, up to the largest limit that may apply to the exchange
+		reqCapture = &capturedBody{ReadCloser: req.Body, capture: newCappedBuffer(inspections.requestBodyLimit(req))}
+		req.Body = reqCapture
+	}
+
+	// The backend proxy timeout applies until the response header arrives.
+	// The body is streamed afterwards without overall deadline to support large downloads and long polling,
+	// yet each read of it is bounded by the body idle timeout.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	timer := time.AfterFunc(time.Duration(conf.Args.Proxy.BackendProxyTimeout)*time.Second, cancel)
+	start := time.Now()
+	response, err := targetClient.Do(req.WithContext(ctx))
+	timer.Stop()
+	if err == nil {
+		usage.observeLatency(ps, time.Since(start))
+	}
 	if err != nil {
 		if ps != nil {
 			e = errors.Wrapf(err, "failed to relay request to proxy [%s]", ps.UrlString())
@@ -285,57 +608,192 @@ func handleHttpRequest(cw *ConnResponseWriter, req *http.Request, ps *types.Prox
 	}
 	defer response.Body.Close()
 
-	body, err := io.ReadAll(response.Body)
+	// only rotated proxies can be replaced by another one
+	if ps != nil && ps.ID > 0 {
+		domain := strings.ToLower(req.URL.Hostname())
+		if reason := classify(loadClassifiers(), domain, response); reason != "" {
+			return newBlockedError(domain, reason, response)
+		}
+	}
+
+	if ok, err := cx.revalidated(cw, req, response); ok {
+		if err != nil {
+			return errors.Wrap(err, "failed to serve revalidated cached response")
+		}
+		return nil
+	}
+	if e = rewriteResponse(loadRewrites(), req, response); e != nil {
+		return
+	}
+
+	copyHeader(cw.Header(), response.Header)
+	cacheBody := cx.capture(cw, req, response)
+	cw.noBody = !bodyAllowed(req.Method, response.StatusCode)
+	if response.Header.Get("Content-Length") == "" && !cw.noBody {
+		if response.ContentLength >= 0 {
+			cw.Header().Set("Content-Length", strconv.FormatInt(response.ContentLength, 10))
+		} else if !cw.http10 {
+			// HTTP/1.0 clients don't understand chunked transfer coding.
+			// The response will be delimited by closing the connection instead.
+			cw.Header().Set("Transfer-Encoding", "chunked")
+		}
+	}
+	cw.WriteHeader(response.StatusCode)
+
+	var body io.Reader = response.Body
+	var capture *cappedBuffer
+	var reqBodyCopy []byte
+	var reqTruncated bool
+	if inspect {
+		var limit int
+		if inspect, limit = inspections.accepts(req, response); inspect {
+			capture = newCappedBuffer(limit)
+			body = io.TeeReader(response.Body, capture)
+			reqBodyCopy, reqTruncated = reqCapture.captured()
+			if limit > 0 && len(reqBodyCopy) > limit {
+				reqBodyCopy, reqTruncated = reqBodyCopy[:limit], true
+			}
+		}
+	}
+	if cacheBody != nil {
+		body = io.TeeReader(body, cacheBody)
+	}
+	if d := time.Duration(conf.Args.Proxy.BodyIdleTimeout) * time.Second; d > 0 {
+		body = &idleReader{r: body, timer: timer, timeout: d}
+	}
+	if _, err = io.Copy(cw, body); err == nil {
+		err = cw.finish()
+	}
+	if err != nil && ctx.Err() != nil {
+		err = errors.Errorf("response body idle for over %ds", conf.Args.Proxy.BodyIdleTimeout)
+	}
 	if err != nil {
 		if ps != nil {
-			e = errors.Wrapf(err, "Error reading response body from proxy [%s]", ps.UrlString())
+			e = errors.Wrapf(err, "Error streaming response body from proxy [%s]", ps.UrlString())
 		} else {
-			e = errors.Wrap(err, "Error reading response body (bypass proxy)")
+			e = errors.Wrap(err, "Error streaming response body (bypass proxy)")
 		}
 		log.Warn(e)
-		return err
+		return
+	}
+
+	cx.store(response, cacheBody)
+	if inspect {
+		if nt, err := newNetworkTraffic(req, reqBodyCopy, response, capture.Bytes()); err != nil {
+			log.Warn("failed to save traffic inspection to database: ", err)
+		} else {
+			nt.RequestTruncated, nt.ResponseTruncated = reqTruncated, capture.truncated
+			inspections.enqueue(nt)
+		}
+	}
+
+	return nil
+}
+
+// capturedBody copies what's read from the request body to the capture.
+// The transport may still be sending the body while the response is relayed, hence the lock.
+type capturedBody struct {
+	io.ReadCloser
+	sync.Mutex
+	capture *cappedBuffer
+}
+
+func (b *capturedBody) Read(p []byte) (n int, e error) {
+	n, e = b.ReadCloser.Read(p)
+	b.Lock()
+	b.capture.Write(p[:n])
+	b.Unlock()
+	return
+}
+
+// captured returns a copy of the body captured so far, and whether it was cut to the limit.
+// A nil capturedBody denotes an empty body.
+func (b *capturedBody) captured() (body []byte, truncated bool) {
+	if b == nil {
+		return nil, false
 	}
+	b.Lock()
+	defer b.Unlock()
+	return bytes.Clone(b.capture.Bytes()), b.capture.truncated
+}
+
+// idleReader fires the timer if a read blocks for longer than the timeout.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	defer r.timer.Stop()
+	return r.r.Read(p)
+}
+
+// hopHeaders are hop-by-hop headers that shall not be relayed, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
-	for key, values := range response.Header {
+// copyHeader copies end-to-end headers from src to dst.
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		if isHopHeader(key, src) {
+			continue
+		}
 		for _, value := range values {
-			cw.Header().Add(key, value)
+			dst.Add(key, value)
 		}
 	}
-	cw.WriteHeader(response.StatusCode)
-	cw.Write(body)
+}
 
-	if conf.Args.Proxy.EnableInspection {
-		if err := SaveNetworkTraffic(req, reqBodyCopy, response, body); err != nil {
-			log.Warn("failed to save traffic inspection to database: ", err)
+// isHopHeader returns whether the header key is a hop-by-hop header in the header set.
+func isHopHeader(key string, header http.Header) bool {
+	for _, h := range hopHeaders {
+		if strings.EqualFold(key, h) {
+			return true
+		}
+	}
+	for _, f := range strings.Split(header.Get("Connection"), ",") {
+		if strings.EqualFold(key, strings.TrimSpace(f)) {
+			return true
 		}
 	}
+	return false
+}
 
-	return nil
+// removeHopHeaders deletes hop-by-hop headers, including those listed in the Connection header.
+func removeHopHeaders(header http.Header) {
+	for _, f := range strings.Split(header.Get("Connection"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			header.Del(f)
+		}
+	}
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+// bodyAllowed reports whether a response with the specified status to a request of the method carries a body.
+func bodyAllowed(method string, status int) bool {
+	if method == http.MethodHead {
+		return false
+	}
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
 }
 
-func intercept(cw *ConnResponseWriter, req *http.Request, client net.Conn) (newReq *http.Request, newConn *tls.Conn, e error) {
+// intercept acknowledges the CONNECT request and performs TLS handshake with the client
+// using a certificate issued for the requested host.
+func intercept(cw *ConnResponseWriter, req *http.Request, client net.Conn) (newConn *tls.Conn, e error) {
 	hostName := req.URL.Hostname()
-	newReq = req
-	//TODO: handle authentication tokens
-	// authHeader := req.Header.Get("Authorization")
-	// if authHeader == "" {
-	// 	authHeader = req.Header.Get("Proxy-Authorization")
-	// }
-	// var authResponse *http.Response
-	// var authBody []byte
-	// if authHeader != "" {
-	// 	if authResponse, e = handleHttpAuthentication(cw, req, client); e != nil {
-	// 		return
-	// 	}
-	// 	// defer authResponse.Body.Close()
-
-	// 	// authBody, e = io.ReadAll(authResponse.Body)
-	// 	// if e != nil {
-	// 	// 	e = errors.Wrap(e, "Error reading authentication response body")
-	// 	// 	log.Warn(e)
-	// 	// 	return
-	// 	// }
-	// }
 
 	var certificate tls.Certificate
 	var found bool
@@ -363,27 +821,12 @@ func intercept(cw *ConnResponseWriter, req *http.Request, client net.Conn) (newR
 	// swap the connection with intercepted connection
 	cw.conn = newConn
 
-	// if authResponse != nil {
-	// 	for key, values := range authResponse.Header {
-	// 		for _, value := range values {
-	// 			cw.Header().Add(key, value)
-	// 		}
-	// 	}
-	// 	cw.WriteHeader(authResponse.StatusCode)
-	// 	cw.Write(authBody)
-	// }
-
 	if e = newConn.Handshake(); e != nil {
 		defer newConn.Close()
 		log.Warnf("TLS handshake error: %v\n", e)
 		return
 	}
 
-	// read request from tlsConn
-	if newReq, e = http.ReadRequest(bufio.NewReader(newConn)); e != nil {
-		return
-	}
-
 	return
 }
 
@@ -480,23 +923,43 @@ func readFromConnection(conn net.Conn, timeout int) (data []byte, e error) {
 	return totalData, nil
 }
 
-// randomly select a proxy from the cache
-func selectProxy() *types.ProxyServer {
+// select a proxy satisfying the route from the cache per the selection strategy.
+// errNoProxy is returned if none qualifies and the route can't fall back to the master proxy.
+func selectProxy(rt route) (*types.ProxyServer, error) {
 
 	cache := proxyCache.GetData()
 
-	if len(cache) > 0 {
-		//TODO: consider (per request) direct:master:rotate proxy weights (from the custom req header?)
-		// Select a random proxy server from the cache
-		return &cache[rand.Intn(len(cache))]
+	candidates := make([]*types.ProxyServer, 0, len(cache))
+	for i := range cache {
+		if rt.matches(&cache[i]) && !reputation.isExcluded(rt.host, cache[i].ID) {
+			candidates = append(candidates, &cache[i])
+		}
 	}
 
-	if !conf.Args.Proxy.FallbackMasterProxy {
-		return nil
+	if len(candidates) > 0 {
+		return strategyFor(rt.strategy)(candidates), nil
 	}
 
+	if !rt.fallsBackToMaster() {
+		return nil, errNoProxy
+	}
+	master := util.GetMasterProxy()
+	if master == nil {
+		return nil, errNoProxy
+	}
 	log.Warnf("no qualified proxy at the moment. falling back to master proxy: %s", conf.Args.Network.MasterProxyAddr)
-	return util.GetMasterProxy()
+	return master, nil
+}
+
+// pooledProxy returns the backend proxy of the ID from the pool, or nil if it's no longer there.
+func pooledProxy(id uint) *types.ProxyServer {
+	cache := proxyCache.GetData()
+	for i := range cache {
+		if cache[i].ID == id {
+			return &cache[i]
+		}
+	}
+	return nil
 }
 
 // PrettyPrintHeaders formats http.Header into a human-readable string.
@@ -514,24 +977,48 @@ func PrettyPrintHeaders(headers http.Header) string {
 }
 
 // SaveNetworkTraffic takes an http.Request, its body, http.Response, and response body,
-// maps them to the NetworkTraffic model, and saves it to the database.
+// maps them to the NetworkTraffic model, and queues it to be saved to the database in batches.
+// The capture is dropped if the queue is full.
 func SaveNetworkTraffic(req *http.Request, reqBody []byte, res *http.Response, resBody []byte) (e error) {
+	networkTraffic, e := newNetworkTraffic(req, reqBody, res, resBody)
+	if e != nil {
+		return
+	}
+	inspections.enqueue(networkTraffic)
+	return
+}
+
+// saveNetworkTraffic saves the exchange to the database synchronously and returns the saved record.
+func saveNetworkTraffic(req *http.Request, reqBody []byte, res *http.Response, resBody []byte) (
+	networkTraffic *types.NetworkTraffic, e error) {
+	if networkTraffic, e = newNetworkTraffic(req, reqBody, res, resBody); e != nil {
+		return
+	}
+	if e = data.GormDB.Create(networkTraffic).Error; e != nil {
+		return nil, e
+	}
+	return
+}
+
+// newNetworkTraffic maps the exchange to the NetworkTraffic model.
+func newNetworkTraffic(req *http.Request, reqBody []byte, res *http.Response, resBody []byte) (
+	networkTraffic *types.NetworkTraffic, e error) {
 	var sourcePort, destinationPort int
 	if _, sourcePortStr, e := net.SplitHostPort(req.RemoteAddr); e != nil {
 		log.Warnf("failed to parse RemoteAddr: %s", req.RemoteAddr)
 		sourcePort = 0
 	} else if sourcePort, e = strconv.Atoi(sourcePortStr); e != nil {
 		log.Warnf("failed to parse source port: %s", sourcePortStr)
-		return e
+		return nil, e
 	}
 	if _, destPortStr, e := net.SplitHostPort(req.Host); e != nil {
 		log.Warnf("failed to parse Host: %s", req.Host)
 		destinationPort = 0
 	} else if destinationPort, e = strconv.Atoi(destPortStr); e != nil {
 		log.Warnf("failed to parse destination port: %s", destPortStr)
-		return e
+		return nil, e
 	}
-	networkTraffic := &types.NetworkTraffic{
+	networkTraffic = &types.NetworkTraffic{
 		Timestamp:             time.Now(),
 		SourceIP:              req.RemoteAddr,
 		DestinationIP:         req.Host, // This is the host:port
@@ -548,11 +1035,7 @@ func SaveNetworkTraffic(req *http.Request, reqBody []byte, res *http.Response, r
 		ResponseContentLength: uint(len(resBody)),
 		MIMEType:              res.Header.Get("Content-Type"),
 	}
-
-	// Save the record to the database
-	result := data.GormDB.CreateInBatches(&networkTraffic, 8)
-	if result.Error != nil {
-		return result.Error
-	}
-	return nil
+	loadRedactor().redact(networkTraffic, req, res)
+	networkTraffic.Size = int64(len(networkTraffic.RequestBody) + len(networkTraffic.ResponseBody))
+	return networkTraffic, nil
 }
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+)
+
+func TestCopyHeader(t *testing.T) {
+	src := http.Header{}
+	src.Set("Content-Type", "text/html")
+	src.Set("Connection", "keep-alive, X-Hop")
+	src.Set("X-Hop", "1")
+	src.Set("Keep-Alive", "timeout=5")
+	src.Set("Transfer-Encoding", "chunked")
+	src.Add("Set-Cookie", "a=1")
+	src.Add("Set-Cookie", "b=2")
+
+	dst := http.Header{}
+	copyHeader(dst, src)
+
+	for _, h := range []string{"Connection", "X-Hop", "Keep-Alive", "Transfer-Encoding"} {
+		if v := dst.Get(h); v != "" {
+			t.Errorf("hop-by-hop header %s shall not be copied, got %q", h, v)
+		}
+	}
+	if dst.Get("Content-Type") != "text/html" {
+		t.Errorf("Content-Type = %q, want %q", dst.Get("Content-Type"), "text/html")
+	}
+	if len(dst.Values("Set-Cookie")) != 2 {
+		t.Errorf("Set-Cookie = %v, want 2 values", dst.Values("Set-Cookie"))
+	}
+}
+
+func TestBodyAllowed(t *testing.T) {
+	tests := []struct {
+		method string
+		status int
+		want   bool
+	}{
+		{http.MethodGet, http.StatusOK, true},
+		{http.MethodHead, http.StatusOK, false},
+		{http.MethodGet, http.StatusNoContent, false},
+		{http.MethodGet, http.StatusNotModified, false},
+		{http.MethodGet, http.StatusSwitchingProtocols, false},
+		{http.MethodPost, http.StatusNotFound, true},
+	}
+	for _, tt := range tests {
+		if got := bodyAllowed(tt.method, tt.status); got != tt.want {
+			t.Errorf("bodyAllowed(%s, %d) = %v, want %v", tt.method, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestDrainBody(t *testing.T) {
+	next := "GET http://example.com/next HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	reader := bufio.NewReader(strings.NewReader(
+		"POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 11\r\n\r\nhello world" + next))
+	req, e := http.ReadRequest(reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+	io.ReadFull(req.Body, make([]byte, 5))
+	if !drainBody(req.Body) {
+		t.Fatal("drainBody() = false, want the rest consumed")
+	}
+	if req, e = http.ReadRequest(reader); e != nil || req.URL.Path != "/next" {
+		t.Errorf("next request = %v, %v, want /next", req, e)
+	}
+
+	big := fmt.Sprintf("POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: %d\r\n\r\n", maxDrainSize+2)
+	req, _ = http.ReadRequest(bufio.NewReader(strings.NewReader(big + strings.Repeat("a", maxDrainSize+2))))
+	if drainBody(req.Body) {
+		t.Error("drainBody() of body beyond maxDrainSize = true, want false")
+	}
+	req, _ = http.ReadRequest(bufio.NewReader(strings.NewReader(big + "truncated")))
+	if drainBody(req.Body) {
+		t.Error("drainBody() of truncated body = true, want false")
+	}
+}
+
+func TestHandleHttpRequestStreaming(t *testing.T) {
+	args := conf.Args.Proxy
+	defer func() { conf.Args.Proxy = args }()
+	conf.Args.Proxy.BackendProxyTimeout, conf.Args.Proxy.BodyIdleTimeout = 10, 1
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer origin.Close()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	cw := NewConnResponseWriter(server)
+	// left over by a failed attempt
+	cw.Header().Set("Transfer-Encoding", "chunked")
+	cw.Header().Set("X-Stale", "1")
+	req := httptest.NewRequest(http.MethodGet, origin.URL, nil)
+	req.RequestURI = ""
+
+	start := time.Now()
+	e := handleHttpRequest(cw, req, nil, false, nil)
+	if e == nil || !strings.Contains(e.Error(), "idle") {
+		t.Errorf("handleHttpRequest() = %v, want idle error", e)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("idle body streamed for %v, want about 1s", d)
+	}
+	if h := cw.Header(); h.Get("X-Stale") != "" || h.Get("Transfer-Encoding") != "" || h.Get("Content-Length") != "10" {
+		t.Errorf("header = %v, want headers of the previous attempt reset", h)
+	}
+}
+
+func TestRetryBody(t *testing.T) {
+	body := &retryBody{r: strings.NewReader("hello world"), limit: 8}
+	first, _ := body.rewind()
+	if b, _ := io.ReadAll(io.LimitReader(first, 5)); string(b) != "hello" {
+		t.Fatalf("first attempt read %q", b)
+	}
+	second, e := body.rewind()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = first.Read(make([]byte, 1)); e == nil {
+		t.Error("reader of a former attempt shall fail")
+	}
+	if b, _ := io.ReadAll(second); string(b) != "hello world" {
+		t.Errorf("second attempt read %q, want the whole body", b)
+	}
+	if _, e = body.rewind(); e == nil {
+		t.Error("body beyond the limit shall not be sent again")
+	}
+}
+
+func TestCapturedBody(t *testing.T) {
+	b := &capturedBody{ReadCloser: io.NopCloser(strings.NewReader("hello world")), capture: newCappedBuffer(5)}
+	if sent, _ := io.ReadAll(b); string(sent) != "hello world" {
+		t.Fatalf("sent body = %q, want it whole", sent)
+	}
+	if body, truncated := b.captured(); string(body) != "hello" || !truncated {
+		t.Errorf("captured() = %q, %v, want the first 5 bytes truncated", body, truncated)
+	}
+	if body, truncated := (*capturedBody)(nil).captured(); body != nil || truncated {
+		t.Errorf("captured() of no body = %q, %v", body, truncated)
+	}
+}
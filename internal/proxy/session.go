@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+const (
+	// headerSession names the sticky session of the request. Consumed by roprox and never relayed.
+	headerSession = "X-Roprox-Session"
+	// sessionUserSeparator separates the user name and the session name in proxy credentials,
+	// e.g. "crawler-session-checkout01".
+	sessionUserSeparator = "-session-"
+)
+
+// stickySession pins a client session to one backend proxy.
+type stickySession struct {
+	proxy    types.ProxyServer
+	created  time.Time
+	lastUsed time.Time
+	requests int
+}
+
+// SessionInfo is the public view of an active sticky session.
+type SessionInfo struct {
+	Key      string    `json:"key"`
+	Proxy    string    `json:"proxy"`
+	Loc      string    `json:"loc"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Expires  time.Time `json:"expires"`
+	Requests int       `json:"requests"`
+}
+
+type sessionStore struct {
+	sync.Mutex
+	sessions map[string]*stickySession
+}
+
+var sessions = &sessionStore{
+	sessions: make(map[string]*stickySession),
+}
+
+func sessionTTL() time.Duration {
+	return time.Duration(conf.Args.Proxy.Session.TTL) * time.Second
+}
+
+// acquire returns the backend proxy pinned to the session, binding a new one picked by pick
+// if the session doesn't exist, has expired, or its proxy no longer qualifies.
+// qualifies returns the current state of the pinned proxy, or nil if it shall be re-pinned.
+func (s *sessionStore) acquire(key string, qualifies func(ps *types.ProxyServer) *types.ProxyServer,
+	pick func() *types.ProxyServer) *types.ProxyServer {
+	now := time.Now()
+	s.Lock()
+	ss, ok := s.sessions[key]
+	ok = ok && now.Sub(ss.lastUsed) <= sessionTTL()
+	var pinned types.ProxyServer
+	if ok {
+		pinned = ss.proxy
+	}
+	s.Unlock()
+
+	if ok {
+		if ps := qualifies(&pinned); ps != nil {
+			s.Lock()
+			if s.sessions[key] == ss {
+				ss.proxy = *ps
+				ss.lastUsed = now
+				ss.requests++
+			}
+			s.Unlock()
+			current := *ps
+			return &current
+		}
+		log.Debugf("session %s re-pinned from disqualified proxy [%s]", key, pinned.UrlString())
+	}
+
+	ps := pick()
+	// only rotated proxies from the pool are pinned
+	if ps == nil || ps.ID <= 0 {
+		return ps
+	}
+	s.Lock()
+	s.sessions[key] = &stickySession{proxy: *ps, created: now, lastUsed: now, requests: 1}
+	s.Unlock()
+	return ps
+}
+
+// fail unpins the backend proxy from the session so that the next request fails over to another one.
+func (s *sessionStore) fail(key string, ps *types.ProxyServer) {
+	if ps == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if ss, ok := s.sessions[key]; ok && ss.proxy.ID == ps.ID {
+		delete(s.sessions, key)
+		log.Debugf("session %s failed over from proxy [%s]", key, ps.UrlString())
+	}
+}
+
+// list removes expired sessions and returns the active ones.
+func (s *sessionStore) list() []SessionInfo {
+	now := time.Now()
+	ttl := sessionTTL()
+	s.Lock()
+	defer s.Unlock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for key, ss := range s.sessions {
+		if now.Sub(ss.lastUsed) > ttl {
+			delete(s.sessions, key)
+			continue
+		}
+		infos = append(infos, SessionInfo{
+			Key:      key,
+			Proxy:    ss.proxy.UrlString(),
+			Loc:      ss.proxy.Loc,
+			Created:  ss.created,
+			LastUsed: ss.lastUsed,
+			Expires:  ss.lastUsed.Add(ttl),
+			Requests: ss.requests,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+// evictExpired periodically removes expired sessions.
+func (s *sessionStore) evictExpired() {
+	ticker := time.NewTicker(time.Minute)
+	for range ticker.C {
+		s.list()
+	}
+}
+
+// splitSessionUser separates the session name from the user name of proxy credentials.
+func splitSessionUser(name string) (user, session string) {
+	if i := strings.LastIndex(name, sessionUserSeparator); i > 0 {
+		return name[:i], name[i+len(sessionUserSeparator):]
+	}
+	return name, ""
+}
+
+// sessionKey determines the sticky session of the request, in order of precedence:
+// the session header, the session suffix of the proxy user name, or the client IP if enabled.
+// The session header is removed from the request. Empty key means no session affinity.
+func sessionKey(header http.Header, remoteAddr string, user *proxyUser, userSession string) string {
+	session := strings.TrimSpace(header.Get(headerSession))
+	header.Del(headerSession)
+	if !conf.Args.Proxy.Session.Enabled {
+		return ""
+	}
+	if session == "" {
+		session = userSession
+	}
+	if session == "" && conf.Args.Proxy.Session.ClientIP {
+		if ip, _, e := net.SplitHostPort(remoteAddr); e == nil {
+			return "ip:" + ip
+		}
+	}
+	if session == "" {
+		return ""
+	}
+	if user != nil {
+		return user.name + "/" + session
+	}
+	return session
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+func TestSessionStore(t *testing.T) {
+	ttl := conf.Args.Proxy.Session.TTL
+	defer func() { conf.Args.Proxy.Session.TTL = ttl }()
+	conf.Args.Proxy.Session.TTL = 60
+
+	store := &sessionStore{sessions: make(map[string]*stickySession)}
+	pool := []*types.ProxyServer{
+		{ID: 1, Host: "10.0.0.1", Port: "80", Type: "http"},
+		{ID: 2, Host: "10.0.0.2", Port: "80", Type: "http"},
+		{ID: 3, Host: "10.0.0.3", Port: "80", Type: "http"},
+	}
+	next := 0
+	pick := func() *types.ProxyServer {
+		ps := pool[next%len(pool)]
+		next++
+		return ps
+	}
+	disqualified := map[uint]bool{}
+	qualifies := func(ps *types.ProxyServer) *types.ProxyServer {
+		if disqualified[ps.ID] {
+			return nil
+		}
+		return ps
+	}
+
+	first := store.acquire("s1", qualifies, pick)
+	if again := store.acquire("s1", qualifies, pick); again.ID != first.ID {
+		t.Fatalf("session shall stick to proxy #%d, got #%d", first.ID, again.ID)
+	}
+	if other := store.acquire("s2", qualifies, pick); other.ID == first.ID {
+		t.Errorf("new session is expected to pick the next proxy")
+	}
+
+	store.fail("s1", first)
+	if failover := store.acquire("s1", qualifies, pick); failover.ID == first.ID {
+		t.Errorf("session shall fail over from proxy #%d", first.ID)
+	}
+
+	pinned := store.acquire("s1", qualifies, pick)
+	disqualified[pinned.ID] = true
+	if repinned := store.acquire("s1", qualifies, pick); repinned.ID == pinned.ID {
+		t.Errorf("session shall be re-pinned from disqualified proxy #%d", pinned.ID)
+	}
+
+	store.sessions["s2"].lastUsed = time.Now().Add(-2 * time.Minute)
+	infos := store.list()
+	if len(infos) != 1 || infos[0].Key != "s1" || infos[0].Requests != 1 {
+		t.Errorf("list() = %+v, want only the failed-over session s1", infos)
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	session := conf.Args.Proxy.Session
+	defer func() { conf.Args.Proxy.Session = session }()
+	conf.Args.Proxy.Session.Enabled = true
+	conf.Args.Proxy.Session.ClientIP = true
+	user := &proxyUser{name: "crawler"}
+
+	if u, s := splitSessionUser("crawler-session-checkout01"); u != "crawler" || s != "checkout01" {
+		t.Errorf("splitSessionUser() = %q, %q", u, s)
+	}
+
+	header := http.Header{}
+	header.Set(headerSession, "login")
+	if key := sessionKey(header, "1.2.3.4:5678", user, "checkout01"); key != "crawler/login" {
+		t.Errorf("session header shall take precedence, got %q", key)
+	}
+	if header.Get(headerSession) != "" {
+		t.Error("session header shall be removed")
+	}
+	if key := sessionKey(http.Header{}, "1.2.3.4:5678", user, "checkout01"); key != "crawler/checkout01" {
+		t.Errorf("user suffix shall be used, got %q", key)
+	}
+	if key := sessionKey(http.Header{}, "1.2.3.4:5678", nil, ""); key != "ip:1.2.3.4" {
+		t.Errorf("client IP shall be used, got %q", key)
+	}
+
+	conf.Args.Proxy.Session.Enabled = false
+	if key := sessionKey(http.Header{}, "1.2.3.4:5678", user, "checkout01"); key != "" {
+		t.Errorf("sessions are disabled, got %q", key)
+	}
+}
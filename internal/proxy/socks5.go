@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/pkg/errors"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5UserPassVersion  = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5RepSucceeded          = 0x00
+	socks5RepGeneralFailure     = 0x01
+	socks5RepNotAllowed         = 0x02
+	socks5RepHostUnreachable    = 0x04
+	socks5RepCmdNotSupported    = 0x07
+	socks5RepAddrTypeNotSupport = 0x08
+)
+
+// handshakeTimeout limits how long a SOCKS5 client may take to negotiate the connection.
+const handshakeTimeout = 30 * time.Second
+
+// ServeSocks5 starts the SOCKS5 listener on the configured port.
+// Accepted CONNECT requests are relayed through the same rotating backend proxy pool as the HTTP proxy.
+// When the context is done, it stops accepting connections. Active ones are drained by Shutdown.
+func ServeSocks5(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.Args.Proxy.Socks5Port))
+	if err != nil {
+		log.Errorf("Error starting SOCKS5 server: %v\n", err)
+		return
+	}
+	defer listener.Close()
+
+	log.Infof("roprox SOCKS5 server started successfully on port %d.", conf.Args.Proxy.Socks5Port)
+
+	// SOCKS5 clients can't be told why before the handshake, they're simply disconnected
+	closeOnDone(ctx, listener)
+	acceptLoop(listener, func(client net.Conn) {
+		serveAdmitted(client, handleSocks5Client, func(net.Conn, error) {})
+	})
+}
+
+func handleSocks5Client(client net.Conn) {
+	defer client.Close()
+
+	reader := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(handshakeTimeout))
+	addr, user, userSession, e := socks5Handshake(reader, client)
+	clients.setIdle(client, false)
+	if e != nil {
+		log.Warnf("SOCKS5 handshake with %s failed: %+v", client.RemoteAddr(), e)
+		return
+	}
+	if !userStore.acquire(user) {
+		log.Warnf("SOCKS5 user %s exceeded max concurrent connections", user.name)
+		writeSocks5Reply(client, socks5RepNotAllowed)
+		return
+	}
+	defer userStore.release(user)
+
+	rt, e := applyRules(defaultRoute(user), socks5Target(addr, client.RemoteAddr().String()))
+	if e != nil {
+		log.Warnf("SOCKS5 request to %s rejected: %+v", addr, e)
+		writeSocks5Reply(client, socks5RepNotAllowed)
+		return
+	}
+	rt.session = sessionKey(http.Header{}, client.RemoteAddr().String(), user, userSession)
+	upstream, end, e := dialUpstream(addr, rt)
+	if e != nil {
+		log.Warnf("failed to relay SOCKS5 request to %s: %+v", addr, e)
+		rep := byte(socks5RepHostUnreachable)
+		if errors.Is(e, errRateLimited) {
+			rep = socks5RepGeneralFailure
+		}
+		writeSocks5Reply(client, rep)
+		return
+	}
+	defer end()
+	defer upstream.Close()
+
+	if e = writeSocks5Reply(client, socks5RepSucceeded); e != nil {
+		log.Warnf("failed to acknowledge SOCKS5 request to %s: %+v", addr, e)
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	if e = flushBuffered(reader, upstream, nil); e != nil {
+		log.Warnf("failed to forward buffered data to %s: %+v", addr, e)
+		return
+	}
+
+	relay(client, upstream)
+}
+
+// socks5Handshake negotiates the authentication method, authenticates the client if required,
+// and reads the CONNECT request. The returned address keeps domain names unresolved
+// so that the backend proxy performs DNS resolution remotely.
+// The returned user is nil unless the client authenticated as one of the proxy users,
+// in which case session denotes the sticky session suffix of the user name.
+func socks5Handshake(reader *bufio.Reader, client net.Conn) (addr string, user *proxyUser, session string, e error) {
+	header := make([]byte, 2)
+	if _, e = io.ReadFull(reader, header); e != nil {
+		return
+	}
+	if header[0] != socks5Version {
+		return "", nil, "", errors.Errorf("unsupported SOCKS version: %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, e = io.ReadFull(reader, methods); e != nil {
+		return
+	}
+
+	method := byte(socks5AuthNone)
+	if conf.Args.Proxy.Socks5User != "" || authRequired() {
+		method = socks5AuthUserPass
+	}
+	accepted := false
+	for _, m := range methods {
+		if m == method {
+			accepted = true
+			break
+		}
+	}
+	if !accepted {
+		client.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", nil, "", errors.New("no acceptable authentication method")
+	}
+	if _, e = client.Write([]byte{socks5Version, method}); e != nil {
+		return
+	}
+	if method == socks5AuthUserPass {
+		if user, session, e = socks5Authenticate(reader, client); e != nil {
+			return
+		}
+	}
+
+	// VER CMD RSV ATYP
+	request := make([]byte, 4)
+	if _, e = io.ReadFull(reader, request); e != nil {
+		return
+	}
+	if request[0] != socks5Version {
+		return "", nil, "", errors.Errorf("unsupported SOCKS version: %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if request[3] == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, e = io.ReadFull(reader, ip); e != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		var size byte
+		if size, e = reader.ReadByte(); e != nil {
+			return
+		}
+		domain := make([]byte, size)
+		if _, e = io.ReadFull(reader, domain); e != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		writeSocks5Reply(client, socks5RepAddrTypeNotSupport)
+		return "", nil, "", errors.Errorf("unsupported address type: %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, e = io.ReadFull(reader, port); e != nil {
+		return
+	}
+
+	if request[1] != socks5CmdConnect {
+		writeSocks5Reply(client, socks5RepCmdNotSupported)
+		return "", nil, "", errors.Errorf("unsupported command: %d", request[1])
+	}
+
+	addr = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	return
+}
+
+// socks5Authenticate performs the username/password sub-negotiation defined in RFC 1929.
+// The credential is checked against the dedicated SOCKS5 account first, then the proxy users.
+func socks5Authenticate(reader *bufio.Reader, client net.Conn) (user *proxyUser, session string, e error) {
+	// VER ULEN UNAME PLEN PASSWD
+	var ver, size byte
+	if ver, e = reader.ReadByte(); e != nil {
+		return
+	}
+	if ver != socks5UserPassVersion {
+		return nil, "", errors.Errorf("unsupported authentication version: %d", ver)
+	}
+	if size, e = reader.ReadByte(); e != nil {
+		return
+	}
+	name := make([]byte, size)
+	if _, e = io.ReadFull(reader, name); e != nil {
+		return
+	}
+	if size, e = reader.ReadByte(); e != nil {
+		return
+	}
+	password := make([]byte, size)
+	if _, e = io.ReadFull(reader, password); e != nil {
+		return
+	}
+
+	valid := conf.Args.Proxy.Socks5User != "" &&
+		subtle.ConstantTimeCompare(name, []byte(conf.Args.Proxy.Socks5User)) == 1 &&
+		subtle.ConstantTimeCompare(password, []byte(conf.Args.Proxy.Socks5Password)) == 1
+	if !valid && authRequired() {
+		var userName string
+		userName, session = splitSessionUser(string(name))
+		user = userStore.authenticate(userName, string(password))
+		valid = user != nil
+	}
+	if !valid {
+		client.Write([]byte{socks5UserPassVersion, socks5RepGeneralFailure})
+		return nil, "", errors.Errorf("authentication failed for user %q", string(name))
+	}
+	_, e = client.Write([]byte{socks5UserPassVersion, socks5RepSucceeded})
+	return
+}
+
+// writeSocks5Reply sends a reply with the specified status code.
+// The bound address is always reported as 0.0.0.0:0 since it's of no use to the client.
+func writeSocks5Reply(client net.Conn, rep byte) (e error) {
+	_, e = client.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return
+}
+
+// socks5Target returns the rule target of the SOCKS5 request to addr from the client.
+func socks5Target(addr, remoteAddr string) ruleTarget {
+	return targetOf(&http.Request{Method: http.MethodConnect, Host: addr, URL: &url.URL{Host: addr}, RemoteAddr: remoteAddr})
+}
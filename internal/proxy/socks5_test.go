@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"golang.org/x/net/proxy"
+)
+
+func TestSocks5Handshake(t *testing.T) {
+	user, password := conf.Args.Proxy.Socks5User, conf.Args.Proxy.Socks5Password
+	defer func() {
+		conf.Args.Proxy.Socks5User, conf.Args.Proxy.Socks5Password = user, password
+	}()
+	conf.Args.Proxy.Socks5User, conf.Args.Proxy.Socks5Password = "roprox", "secret"
+
+	tests := []struct {
+		name    string
+		auth    *proxy.Auth
+		wantErr bool
+	}{
+		{"valid credential", &proxy.Auth{User: "roprox", Password: "secret"}, false},
+		{"wrong password", &proxy.Auth{User: "roprox", Password: "wrong"}, true},
+		{"no credential", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+
+			ch := make(chan string, 1)
+			go func() {
+				addr, _, _, e := socks5Handshake(bufio.NewReader(server), server)
+				if e != nil {
+					server.Close()
+					ch <- ""
+					return
+				}
+				writeSocks5Reply(server, socks5RepSucceeded)
+				ch <- addr
+			}()
+
+			dialer, _ := proxy.SOCKS5("tcp", "roprox", tt.auth, pipeDialer{client})
+			_, e := dialer.Dial("tcp", "example.com:443")
+			addr := <-ch
+			if (e != nil) != tt.wantErr {
+				t.Fatalf("Dial() error = %v, wantErr %v", e, tt.wantErr)
+			}
+			if !tt.wantErr && addr != "example.com:443" {
+				t.Errorf("socks5Handshake() = %q, want %q", addr, "example.com:443")
+			}
+		})
+	}
+}
+
+type pipeDialer struct {
+	conn net.Conn
+}
+
+func (d pipeDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.conn, nil
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+// headerStrategy overrides the selection strategy per request. Consumed by roprox and never relayed.
+const headerStrategy = "X-Roprox-Strategy"
+
+// selectionStrategy picks one backend proxy from the non-empty list of candidates.
+type selectionStrategy func(candidates []*types.ProxyServer) *types.ProxyServer
+
+// strategies maps strategy names to the implementations.
+var strategies = map[string]selectionStrategy{
+	"random":      pickRandom,
+	"weighted":    pickWeighted,
+	"lru":         pickLeastRecentlyUsed,
+	"round_robin": pickRoundRobin,
+	"latency":     pickLowestLatency,
+	"p2c":         pickPowerOfTwo,
+}
+
+// strategyFor returns the strategy of the specified name, falling back to the global setting
+// and then to random selection.
+func strategyFor(name string) selectionStrategy {
+	if s, ok := strategies[strings.ToLower(name)]; ok {
+		return s
+	}
+	if s, ok := strategies[strings.ToLower(conf.Args.Proxy.SelectionStrategy)]; ok {
+		return s
+	}
+	return pickRandom
+}
+
+func pickRandom(candidates []*types.ProxyServer) *types.ProxyServer {
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// pickWeighted picks randomly with probability proportional to the score.
+func pickWeighted(candidates []*types.ProxyServer) *types.ProxyServer {
+	// a minimal weight keeps zero-scored proxies selectable
+	const minWeight = 0.01
+	total := 0.0
+	for _, ps := range candidates {
+		total += max(ps.Score, minWeight)
+	}
+	r := rand.Float64() * total
+	for _, ps := range candidates {
+		if r -= max(ps.Score, minWeight); r < 0 {
+			return ps
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickLeastRecentlyUsed picks the proxy that has been idle for the longest time.
+// Proxies that have never been used come first.
+func pickLeastRecentlyUsed(candidates []*types.ProxyServer) *types.ProxyServer {
+	var picked *types.ProxyServer
+	var oldest time.Time
+	for _, ps := range candidates {
+		lastUsed := usage.get(ps.ID).lastUsed
+		if picked == nil || lastUsed.Before(oldest) {
+			picked, oldest = ps, lastUsed
+		}
+	}
+	return picked
+}
+
+var roundRobinCounter atomic.Uint64
+
+func pickRoundRobin(candidates []*types.ProxyServer) *types.ProxyServer {
+	return candidates[(roundRobinCounter.Add(1)-1)%uint64(len(candidates))]
+}
+
+// pickLowestLatency picks the proxy with the lowest measured latency.
+// Proxies without measurement come first so that they get measured.
+func pickLowestLatency(candidates []*types.ProxyServer) *types.ProxyServer {
+	var picked *types.ProxyServer
+	var lowest time.Duration
+	for _, ps := range candidates {
+		latency := usage.get(ps.ID).latency
+		if picked == nil || latency < lowest {
+			picked, lowest = ps, latency
+		}
+	}
+	return picked
+}
+
+// pickPowerOfTwo picks two proxies randomly and chooses the one with fewer in-flight requests.
+func pickPowerOfTwo(candidates []*types.ProxyServer) *types.ProxyServer {
+	a := candidates[rand.Intn(len(candidates))]
+	b := candidates[rand.Intn(len(candidates))]
+	if usage.get(b.ID).inFlight < usage.get(a.ID).inFlight {
+		return b
+	}
+	return a
+}
+
+// proxyUsage is the runtime usage of a backend proxy.
+type proxyUsage struct {
+	lastUsed time.Time
+	inFlight int
+	// latency is the exponentially weighted moving average of the time to first response.
+	latency time.Duration
+}
+
+type usageStore struct {
+	sync.RWMutex
+	usages map[uint]*proxyUsage
+}
+
+var usage = &usageStore{
+	usages: make(map[uint]*proxyUsage),
+}
+
+// get returns a copy of the usage of the proxy.
+func (s *usageStore) get(id uint) proxyUsage {
+	s.RLock()
+	defer s.RUnlock()
+	if u, ok := s.usages[id]; ok {
+		return *u
+	}
+	return proxyUsage{}
+}
+
+func (s *usageStore) entry(id uint) *proxyUsage {
+	u, ok := s.usages[id]
+	if !ok {
+		u = &proxyUsage{}
+		s.usages[id] = u
+	}
+	return u
+}
+
+// begin records the start of a request via the proxy. The returned function must be called when it's done.
+func (s *usageStore) begin(ps *types.ProxyServer) (end func()) {
+	if ps == nil || ps.ID <= 0 {
+		return func() {}
+	}
+	s.Lock()
+	u := s.entry(ps.ID)
+	u.lastUsed = time.Now()
+	u.inFlight++
+	s.Unlock()
+	return func() {
+		s.Lock()
+		s.entry(ps.ID).inFlight--
+		s.Unlock()
+	}
+}
+
+// observeLatency records the time it took the proxy to respond.
+func (s *usageStore) observeLatency(ps *types.ProxyServer, latency time.Duration) {
+	if ps == nil || ps.ID <= 0 {
+		return
+	}
+	// weight of the latest observation in the moving average
+	const alpha = 0.3
+	s.Lock()
+	defer s.Unlock()
+	u := s.entry(ps.ID)
+	if u.latency == 0 {
+		u.latency = latency
+	} else {
+		u.latency = time.Duration(alpha*float64(latency) + (1-alpha)*float64(u.latency))
+	}
+}
+
+// evict forgets usage of proxies no longer in the cache.
+func (s *usageStore) evict(servers []types.ProxyServer) {
+	ids := make(map[uint]bool, len(servers))
+	for _, ps := range servers {
+		ids[ps.ID] = true
+	}
+	s.Lock()
+	defer s.Unlock()
+	for id, u := range s.usages {
+		if !ids[id] && u.inFlight <= 0 {
+			delete(s.usages, id)
+		}
+	}
+}
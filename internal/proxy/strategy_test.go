@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/agux/roprox/internal/types"
+)
+
+func testCandidates(scores ...float64) []*types.ProxyServer {
+	var candidates []*types.ProxyServer
+	for i, s := range scores {
+		ps := &types.ProxyServer{Host: "10.0.0.1", Port: "8080", Score: s}
+		ps.ID = uint(1000 + i)
+		candidates = append(candidates, ps)
+	}
+	return candidates
+}
+
+func TestPickWeighted(t *testing.T) {
+	candidates := testCandidates(0, 100)
+	counts := map[uint]int{}
+	for i := 0; i < 1000; i++ {
+		counts[pickWeighted(candidates).ID]++
+	}
+	if counts[candidates[1].ID] < 950 {
+		t.Errorf("high-scored proxy picked %d of 1000 times", counts[candidates[1].ID])
+	}
+}
+
+func TestPickRoundRobin(t *testing.T) {
+	candidates := testCandidates(1, 2, 3)
+	first := pickRoundRobin(candidates)
+	seen := map[uint]bool{first.ID: true}
+	for i := 0; i < 2; i++ {
+		seen[pickRoundRobin(candidates).ID] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("round robin picked %d distinct proxies, want 3", len(seen))
+	}
+	if pickRoundRobin(candidates) != first {
+		t.Error("round robin shall cycle back to the first pick")
+	}
+}
+
+func TestPickByUsage(t *testing.T) {
+	candidates := testCandidates(1, 2)
+	a, b := candidates[0], candidates[1]
+	defer usage.evict(nil)
+
+	endA := usage.begin(a)
+	time.Sleep(time.Millisecond)
+	endB := usage.begin(b)
+	if got := pickLeastRecentlyUsed(candidates); got != a {
+		t.Errorf("pickLeastRecentlyUsed() = %d, want %d", got.ID, a.ID)
+	}
+
+	endA2 := usage.begin(a)
+	// a is picked only if drawn twice, i.e. about a quarter of the time
+	picksB := 0
+	for i := 0; i < 1000; i++ {
+		if pickPowerOfTwo(candidates) == b {
+			picksB++
+		}
+	}
+	if picksB < 600 {
+		t.Errorf("proxy with fewer in-flight requests picked %d of 1000 times", picksB)
+	}
+	endA()
+	endA2()
+	endB()
+	if n := usage.get(a.ID).inFlight; n != 0 {
+		t.Errorf("in-flight = %d after end, want 0", n)
+	}
+
+	usage.observeLatency(a, 300*time.Millisecond)
+	usage.observeLatency(b, 100*time.Millisecond)
+	if got := pickLowestLatency(candidates); got != b {
+		t.Errorf("pickLowestLatency() = %d, want %d", got.ID, b.ID)
+	}
+	usage.observeLatency(b, 1000*time.Millisecond)
+	if got := usage.get(b.ID).latency; got != 370*time.Millisecond {
+		t.Errorf("latency = %v, want moving average 370ms", got)
+	}
+	if got := pickLowestLatency(candidates); got != a {
+		t.Errorf("pickLowestLatency() = %d, want %d", got.ID, a.ID)
+	}
+}
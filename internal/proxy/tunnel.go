@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/network"
+	"github.com/avast/retry-go"
+)
+
+const (
+	connectModeIntercept = "intercept"
+	connectModeTunnel    = "tunnel"
+)
+
+// shouldIntercept returns whether the CONNECT request to the specified host
+// shall be decrypted (MITM) rather than relayed as an opaque tunnel.
+func shouldIntercept(host string) bool {
+	if !strings.EqualFold(conf.Args.Proxy.ConnectMode, connectModeTunnel) {
+		return true
+	}
+	return hostMatches(host, conf.Args.Proxy.MITMHosts)
+}
+
+// tunnel relays the CONNECT request as a raw byte stream through the selected backend proxy.
+// Dialing the backend proxy is retried within the configured MaxRetryDuration.
+// Bytes already buffered by reader are forwarded to the upstream before relaying.
+func tunnel(cw *ConnResponseWriter, req *http.Request, reader *bufio.Reader, rt route) {
+	addr := req.Host
+	if _, _, e := net.SplitHostPort(addr); e != nil {
+		addr = net.JoinHostPort(addr, "443")
+	}
+	upstream, end, e := dialUpstream(addr, rt)
+	if e != nil {
+		http.Error(cw, e.Error(), upstreamErrorStatus(e, http.StatusBadGateway))
+		return
+	}
+	defer end()
+	defer upstream.Close()
+
+	// Inform the original client that the tunnel is established
+	if _, e := cw.conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); e != nil {
+		log.Warnf("failed to acknowledge tunnel to %s: %+v", addr, e)
+		return
+	}
+
+	if e = flushBuffered(reader, upstream, nil); e != nil {
+		log.Warnf("failed to forward buffered data to %s: %+v", addr, e)
+		return
+	}
+
+	relay(cw.conn, upstream)
+}
+
+// dialUpstream opens a raw connection to addr through a backend proxy chosen per the route,
+// retrying with another proxy within the configured MaxRetryDuration.
+// The proxy counts as in use until the caller calls end, once done relaying over the connection.
+func dialUpstream(addr string, rt route) (upstream net.Conn, end func(), e error) {
+	timeout := time.Duration(conf.Args.Proxy.BackendProxyTimeout) * time.Second
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		rt.host = strings.ToLower(host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Duration(conf.Args.Proxy.MaxRetryDuration)*time.Second)
+	defer cancel()
+	op := func() (e error) {
+		ps, e := proxyFor(rt)
+		if e != nil {
+			return retry.Unrecoverable(e)
+		}
+		if proxyLimited, e := throttle(ctx, rt.host, ps); e != nil {
+			if proxyLimited {
+				return e
+			}
+			return retry.Unrecoverable(e)
+		}
+		end = usage.begin(ps)
+		start := time.Now()
+		upstream, e = network.DialThrough(ps, addr, timeout)
+		if e == nil {
+			usage.observeLatency(ps, time.Since(start))
+		} else {
+			end()
+		}
+		network.UpdateProxyScore(ps, e == nil)
+		reputation.record(ps, rt.host, e)
+		if e != nil {
+			log.Warn(e)
+			if rt.session != "" {
+				sessions.fail(rt.session, ps)
+			}
+		}
+		return
+	}
+
+	e = retry.Do(
+		op,
+		retry.Delay(0),
+		retry.LastErrorOnly(true),
+		retry.Context(ctx),
+	)
+	return
+}
+
+// relay copies data between the two connections in both directions until either side is done.
+func relay(client, upstream net.Conn) {
+	relayTee(client, upstream, nil, nil)
+}
+
+// relayTee works like relay, additionally copying the client-to-upstream stream to up
+// and the upstream-to-client stream to down if they're not nil.
+// The observers must not fail, otherwise relaying stops in that direction.
+func relayTee(client, upstream net.Conn, up, down io.Writer) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn, observer io.Writer) {
+		defer wg.Done()
+		var r io.Reader = src
+		if observer != nil {
+			r = io.TeeReader(src, observer)
+		}
+		io.Copy(dst, r)
+		// unblock the opposite direction
+		if tc, ok := dst.(interface{ CloseWrite() error }); ok {
+			tc.CloseWrite()
+		} else {
+			dst.SetReadDeadline(time.Now())
+		}
+	}
+	go pipe(upstream, client, up)
+	go pipe(client, upstream, down)
+	wg.Wait()
+}
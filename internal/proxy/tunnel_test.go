@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+)
+
+func TestShouldIntercept(t *testing.T) {
+	mode, hosts := conf.Args.Proxy.ConnectMode, conf.Args.Proxy.MITMHosts
+	defer func() {
+		conf.Args.Proxy.ConnectMode, conf.Args.Proxy.MITMHosts = mode, hosts
+	}()
+
+	conf.Args.Proxy.ConnectMode = "intercept"
+	if !shouldIntercept("example.com") {
+		t.Error("intercept mode shall decrypt every host")
+	}
+
+	conf.Args.Proxy.ConnectMode = "tunnel"
+	conf.Args.Proxy.MITMHosts = []string{"example.com", ".test.org"}
+	cases := map[string]bool{
+		"example.com":     true,
+		"www.example.com": true,
+		"badexample.com":  false,
+		"a.test.org":      true,
+		"test.org":        true,
+		"golang.org":      false,
+	}
+	for host, want := range cases {
+		if got := shouldIntercept(host); got != want {
+			t.Errorf("shouldIntercept(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
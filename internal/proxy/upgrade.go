@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/agux/roprox/internal/conf"
+)
+
+// isUpgrade returns whether the request asks to switch protocols, e.g. WebSocket handshake.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, f := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(f), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// handleUpgrade relays the upgrade handshake through the backend proxy selected per the route.
+// Once the server switches protocols, data is relayed in both directions until either side closes.
+// The client connection can't be reused afterwards.
+func handleUpgrade(conn net.Conn, reader *bufio.Reader, req *http.Request, user *proxyUser, rt route) {
+	cw := NewConnResponseWriter(conn)
+	cw.close = true
+
+	// intercepted requests carry no scheme, see handleHttpRequest
+	scheme := strings.ToLower(req.URL.Scheme)
+	secure := scheme == "" || scheme == "https" || scheme == "wss"
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	addr := host
+	if _, _, e := net.SplitHostPort(addr); e != nil {
+		if secure {
+			addr = net.JoinHostPort(addr, "443")
+		} else {
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	upstream, end, e := dialUpstream(addr, rt)
+	if e != nil {
+		http.Error(cw, e.Error(), upstreamErrorStatus(e, http.StatusBadGateway))
+		return
+	}
+	defer end()
+	defer upstream.Close()
+
+	if secure {
+		hostName, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(upstream, &tls.Config{
+			ServerName:         hostName,
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"http/1.1"},
+		})
+		if e = tlsConn.Handshake(); e != nil {
+			log.Warnf("TLS handshake with %s failed: %+v", addr, e)
+			http.Error(cw, e.Error(), http.StatusBadGateway)
+			return
+		}
+		upstream = tlsConn
+	}
+
+	req.Header.Del("Proxy-Connection")
+	if e = req.Write(upstream); e != nil {
+		log.Warnf("failed to relay upgrade request to %s: %+v", addr, e)
+		http.Error(cw, e.Error(), http.StatusBadGateway)
+		return
+	}
+	upReader := bufio.NewReader(upstream)
+	res, e := http.ReadResponse(upReader, req)
+	if e != nil {
+		log.Warnf("failed to read upgrade response from %s: %+v", addr, e)
+		http.Error(cw, e.Error(), http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		// the server declined to switch protocols, relay its response as is
+		res.Close = true
+		if e = res.Write(conn); e != nil {
+			log.Warnf("failed to relay response from %s: %+v", addr, e)
+		}
+		return
+	}
+	if e = res.Write(conn); e != nil {
+		log.Warnf("failed to relay upgrade response from %s: %+v", addr, e)
+		return
+	}
+
+	var up, down io.Writer
+	if captured, _ := inspections.accepts(req, res); user.inspect() && captured {
+		if nt, e := saveNetworkTraffic(req, nil, res, nil); e != nil {
+			log.Warn("failed to save traffic inspection to database: ", e)
+		} else if conf.Args.Proxy.RecordWebSocketFrames &&
+			strings.EqualFold(res.Header.Get("Upgrade"), "websocket") {
+			recorder := newWSRecorder(nt.ID)
+			defer recorder.close()
+			up, down = recorder.observer("client"), recorder.observer("server")
+		}
+	}
+
+	// forward data read ahead of the protocol switch on both sides
+	if e = flushBuffered(reader, upstream, up); e != nil {
+		log.Warnf("failed to forward buffered data to %s: %+v", addr, e)
+		return
+	}
+	if e = flushBuffered(upReader, conn, down); e != nil {
+		log.Warnf("failed to forward buffered data from %s: %+v", addr, e)
+		return
+	}
+
+	relayTee(conn, upstream, up, down)
+}
+
+// flushBuffered writes the data buffered in reader to dst, and to the observer if not nil.
+func flushBuffered(reader *bufio.Reader, dst io.Writer, observer io.Writer) (e error) {
+	n := reader.Buffered()
+	if n == 0 {
+		return
+	}
+	buffered, _ := reader.Peek(n)
+	if observer != nil {
+		observer.Write(buffered)
+	}
+	_, e = dst.Write(buffered)
+	return
+}
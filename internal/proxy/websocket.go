@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/data"
+	"github.com/agux/roprox/internal/types"
+)
+
+// wsRecorder persists WebSocket frames relayed over an upgraded connection.
+// Frames are handed over to a background writer so that relaying is never blocked by the database.
+// Frames are dropped if the writer falls behind.
+type wsRecorder struct {
+	trafficID uint
+	frames    chan *types.WebSocketFrame
+	done      chan struct{}
+	dropped   atomic.Int64
+}
+
+func newWSRecorder(trafficID uint) *wsRecorder {
+	r := &wsRecorder{
+		trafficID: trafficID,
+		frames:    make(chan *types.WebSocketFrame, 256),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		for f := range r.frames {
+			if e := data.GormDB.Create(f).Error; e != nil {
+				log.Warn("failed to save websocket frame to database: ", e)
+			}
+		}
+	}()
+	return r
+}
+
+// observer returns an io.Writer parsing the byte stream of the specified direction into frames.
+func (r *wsRecorder) observer(direction string) *wsFrameParser {
+	return &wsFrameParser{
+		direction: direction,
+		limit:     conf.Args.Proxy.InspectionMaxBodySize,
+		redactor:  loadRedactor(),
+		emit:      r.record,
+	}
+}
+
+func (r *wsRecorder) record(f *types.WebSocketFrame) {
+	f.NetworkTrafficID = r.trafficID
+	select {
+	case r.frames <- f:
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// close waits for pending frames to be saved. It must be called after relaying is done.
+func (r *wsRecorder) close() {
+	close(r.frames)
+	<-r.done
+	if dropped := r.dropped.Load(); dropped > 0 {
+		log.Warnf("%d websocket frames of traffic #%d were not recorded", dropped, r.trafficID)
+	}
+}
+
+// wsFrameParser incrementally decodes WebSocket frames (RFC 6455 section 5.2) from a byte stream.
+// At most limit bytes of each payload are kept, unmasked. A non-positive limit means unlimited.
+// Payloads of text messages are redacted by the redactor, if any, before being emitted.
+type wsFrameParser struct {
+	direction string
+	limit     int
+	redactor  *redactor
+	emit      func(f *types.WebSocketFrame)
+
+	// text and compressed describe the data message the current frame belongs to.
+	text       bool
+	compressed bool
+
+	header    []byte
+	frame     *types.WebSocketFrame
+	maskKey   []byte
+	offset    uint64
+	remaining uint64
+}
+
+// wsHeaderLen returns the length of the frame header given its leading bytes.
+func wsHeaderLen(b []byte) int {
+	if len(b) < 2 {
+		return 2
+	}
+	l := 2
+	switch b[1] & 0x7f {
+	case 126:
+		l += 2
+	case 127:
+		l += 8
+	}
+	if b[1]&0x80 != 0 {
+		l += 4
+	}
+	return l
+}
+
+// Write consumes the stream. It never fails.
+func (p *wsFrameParser) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if p.frame == nil {
+			need := wsHeaderLen(p.header)
+			for len(p.header) < need && len(b) > 0 {
+				take := min(need-len(p.header), len(b))
+				p.header = append(p.header, b[:take]...)
+				b = b[take:]
+				need = wsHeaderLen(p.header)
+			}
+			if len(p.header) < need {
+				break
+			}
+			p.begin()
+			if p.remaining == 0 {
+				p.end()
+			}
+			continue
+		}
+		take := min(uint64(len(b)), p.remaining)
+		for i, c := range b[:take] {
+			if p.limit > 0 && len(p.frame.Payload) >= p.limit {
+				break
+			}
+			if p.maskKey != nil {
+				c ^= p.maskKey[(p.offset+uint64(i))%4]
+			}
+			p.frame.Payload = append(p.frame.Payload, c)
+		}
+		p.offset += take
+		p.remaining -= take
+		b = b[take:]
+		if p.remaining == 0 {
+			p.end()
+		}
+	}
+	return n, nil
+}
+
+func (p *wsFrameParser) begin() {
+	h := p.header
+	p.frame = &types.WebSocketFrame{
+		Timestamp: time.Now(),
+		Direction: p.direction,
+		Fin:       h[0]&0x80 != 0,
+		Opcode:    h[0] & 0x0f,
+	}
+	pos := 2
+	switch h[1] & 0x7f {
+	case 126:
+		p.remaining = uint64(binary.BigEndian.Uint16(h[2:4]))
+		pos += 2
+	case 127:
+		p.remaining = binary.BigEndian.Uint64(h[2:10])
+		pos += 8
+	default:
+		p.remaining = uint64(h[1] & 0x7f)
+	}
+	p.maskKey = nil
+	if h[1]&0x80 != 0 {
+		p.maskKey = append([]byte(nil), h[pos:pos+4]...)
+	}
+	if op := p.frame.Opcode; op != 0 && op < 8 {
+		p.text = op == 1
+		p.compressed = h[0]&0x40 != 0
+	}
+	p.frame.Length = p.remaining
+	p.offset = 0
+	p.header = p.header[:0]
+}
+
+func (p *wsFrameParser) end() {
+	if p.redactor != nil && p.text && p.frame.Opcode < 8 {
+		p.redactor.frame(p.frame, p.compressed)
+	}
+	p.emit(p.frame)
+	p.frame = nil
+}
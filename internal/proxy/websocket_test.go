@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/agux/roprox/internal/conf"
+	"github.com/agux/roprox/internal/types"
+)
+
+// encodeFrame builds a single websocket frame, masked if maskKey is not nil.
+func encodeFrame(opcode byte, payload, maskKey []byte) []byte {
+	var b bytes.Buffer
+	b.WriteByte(0x80 | opcode)
+	var maskBit byte
+	if maskKey != nil {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b.WriteByte(maskBit | byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b.WriteByte(maskBit | 126)
+		binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	default:
+		b.WriteByte(maskBit | 127)
+		binary.Write(&b, binary.BigEndian, uint64(len(payload)))
+	}
+	if maskKey != nil {
+		b.Write(maskKey)
+		for i, c := range payload {
+			b.WriteByte(c ^ maskKey[i%4])
+		}
+	} else {
+		b.Write(payload)
+	}
+	return b.Bytes()
+}
+
+func TestWSFrameParser(t *testing.T) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	payloads := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte("a"), 300),
+		bytes.Repeat([]byte("b"), 70000),
+	}
+	var stream []byte
+	for i, p := range payloads {
+		var key []byte
+		if i%2 == 0 {
+			key = mask
+		}
+		stream = append(stream, encodeFrame(0x1, p, key)...)
+	}
+
+	for _, chunk := range []int{1, 7, len(stream)} {
+		var frames []*types.WebSocketFrame
+		parser := &wsFrameParser{
+			direction: "client",
+			limit:     1024,
+			emit:      func(f *types.WebSocketFrame) { frames = append(frames, f) },
+		}
+		for i := 0; i < len(stream); i += chunk {
+			parser.Write(stream[i:min(i+chunk, len(stream))])
+		}
+		if len(frames) != len(payloads) {
+			t.Fatalf("chunk size %d: parsed %d frames, want %d", chunk, len(frames), len(payloads))
+		}
+		for i, f := range frames {
+			want := payloads[i][:min(len(payloads[i]), 1024)]
+			if f.Length != uint64(len(payloads[i])) {
+				t.Errorf("chunk size %d, frame #%d: length = %d, want %d", chunk, i, f.Length, len(payloads[i]))
+			}
+			if !bytes.Equal(f.Payload, want) {
+				t.Errorf("chunk size %d, frame #%d: unexpected payload", chunk, i)
+			}
+			if !f.Fin || f.Opcode != 0x1 || f.Direction != "client" {
+				t.Errorf("chunk size %d, frame #%d: unexpected frame %+v", chunk, i, f)
+			}
+		}
+	}
+}
+
+func TestWSFrameParserRedacts(t *testing.T) {
+	r, _ := compileRedactor(conf.RedactionArgs{Defaults: true, Replacement: "[REDACTED]"})
+	var stream []byte
+	stream = append(stream, encodeFrame(0x1, []byte(`{"token":"t1","n":1}`), nil)...)
+	stream = append(stream, encodeFrame(0x2, []byte(`{"token":"t2"}`), nil)...)
+	stream = append(stream, encodeFrame(0x1|0x40, []byte(`{"token":"t3"}`), nil)...)
+	var frames []*types.WebSocketFrame
+	parser := &wsFrameParser{
+		direction: "server",
+		redactor:  r,
+		emit:      func(f *types.WebSocketFrame) { frames = append(frames, f) },
+	}
+	parser.Write(stream)
+	if len(frames) != 3 {
+		t.Fatalf("parsed %d frames, want 3", len(frames))
+	}
+	if got := string(frames[0].Payload); got != `{"n":1,"token":"[REDACTED]"}` {
+		t.Errorf("text frame payload = %s", got)
+	}
+	if got := string(frames[1].Payload); got != `{"token":"t2"}` {
+		t.Errorf("binary frame payload = %s, want it untouched", got)
+	}
+	if frames[2].Payload != nil {
+		t.Errorf("compressed text frame payload = %s, want it dropped", frames[2].Payload)
+	}
+}
@@ -1,6 +1,7 @@
 package scanner
 
 import (
+	"context"
 	"math/rand"
 	"sync"
 	"time"
@@ -15,7 +16,9 @@ import (
 
 var log = logging.Logger
 
-func Scan(wg *sync.WaitGroup) {
+// Scan fetches proxy servers from the sources until the context is done.
+// In-flight fetches are completed and collected proxy servers are saved before it returns.
+func Scan(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	chpx := make(chan *t.ProxyServer, 128)
@@ -24,28 +27,39 @@ func Scan(wg *sync.WaitGroup) {
 	var wgs sync.WaitGroup
 	wgs.Add(1)
 	go collectProxyServer(&wgs, chpx)
-	launchScanners(chjobs, chpx)
-	launchDispatcher(chjobs)
+	var wgScanners sync.WaitGroup
+	launchScanners(ctx, &wgScanners, chjobs, chpx)
+	launchDispatcher(ctx, chjobs)
 
-	wgs.Wait()
+	<-ctx.Done()
+	log.Info("stopping scanner...")
+	wgScanners.Wait()
+	// the collector saves the remaining bucket once the channel is closed
 	close(chpx)
-	close(chjobs)
+	wgs.Wait()
 }
 
-func launchDispatcher(chjobs chan<- string) {
+func launchDispatcher(ctx context.Context, chjobs chan<- string) {
 	for _, fs := range fetcher.FetcherList {
 		//kick start refreshing at once
-		chjobs <- fs.UID()
+		select {
+		case chjobs <- fs.UID():
+		case <-ctx.Done():
+			return
+		}
 		ticker := time.NewTicker(time.Duration(fs.RefreshInterval()) * time.Minute)
-		quit := make(chan struct{})
 		go func(fs t.FetcherSpec) {
+			defer ticker.Stop()
 			for {
 				select {
 				case <-ticker.C:
 					log.Debugf("refreshing list from source %s", fs.UID())
-					chjobs <- fs.UID()
-				case <-quit:
-					ticker.Stop()
+					select {
+					case chjobs <- fs.UID():
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
 					return
 				}
 			}
@@ -53,14 +67,25 @@ func launchDispatcher(chjobs chan<- string) {
 	}
 }
 
-func launchScanners(chjobs <-chan string, chpx chan<- *t.ProxyServer) {
+func launchScanners(ctx context.Context, wgs *sync.WaitGroup, chjobs <-chan string, chpx chan<- *t.ProxyServer) {
 	for i := 0; i < conf.Args.Scanner.PoolSize; i++ {
+		wgs.Add(1)
 		go func() {
-			for uid := range chjobs {
-				fetcher.Fetch(chpx, fetcher.FetcherMap[uid])
+			defer wgs.Done()
+			for {
+				select {
+				case uid := <-chjobs:
+					fetcher.Fetch(ctx, chpx, fetcher.FetcherMap[uid])
+				case <-ctx.Done():
+					return
+				}
 			}
 		}()
-		time.Sleep(time.Millisecond * time.Duration(5000+rand.Intn(20000)))
+		select {
+		case <-time.After(time.Millisecond * time.Duration(5000+rand.Intn(20000))):
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
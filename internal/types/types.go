@@ -164,9 +164,9 @@ func (ua *UserAgent) String() string {
 
 type NetworkTraffic struct {
 	ID                    uint      `gorm:"primaryKey;autoIncrement"`
-	Timestamp             time.Time `gorm:"not null"`
+	Timestamp             time.Time `gorm:"not null;index"`
 	SourceIP              string    `gorm:"not null"`
-	DestinationIP         string    `gorm:"not null"`
+	DestinationIP         string    `gorm:"not null;size:255;index"`
 	SourcePort            int       `gorm:"size:16"`
 	DestinationPort       int       `gorm:"size:16"`
 	Protocol              string    `gorm:"size:10"`
@@ -179,5 +179,88 @@ type NetworkTraffic struct {
 	StatusCode            uint      `gorm:"size:16"`
 	ResponseContentLength uint      `gorm:"size:32"`
 	MIMEType              string    `gorm:"size:50"`
+	// Size is the bytes of the captured bodies.
+	Size int64
+	// RequestTruncated and ResponseTruncated denote the captured bodies were cut at the inspection size limit.
+	RequestTruncated  bool
+	ResponseTruncated bool
+	// RequestBodyHash and ResponseBodyHash address the bodies in the filesystem body store if they're offloaded.
+	RequestBodyHash  string `gorm:"size:64;index"`
+	ResponseBodyHash string `gorm:"size:64;index"`
+	// Redacted lists the masked fields in JSON, e.g. ["request.header.Authorization","response.body.token"].
+	Redacted string `gorm:"type:text"`
 	gorm.Model
 }
+
+// ProxyUser is a model mapping for database table proxy_users,
+// defining credentials and usage policy for clients of the inbound proxy listeners.
+type ProxyUser struct {
+	gorm.Model
+
+	Name string `gorm:"uniqueIndex"`
+	// Password is the bcrypt hash of the password. Plaintext values are hashed in place when users are loaded.
+	Password string `gorm:"not null"`
+	// Modes is a comma-separated list of allowed proxy modes (direct, master, rotate).
+	// Empty value allows all modes.
+	Modes string
+	// MaxConns limits concurrent client connections. 0 means unlimited.
+	MaxConns int
+	// Inspection overrides the global traffic inspection setting if not null.
+	Inspection *bool
+	// Admin grants access to the API endpoints exporting or replaying captured traffic.
+	Admin bool
+}
+
+// WebSocketFrame is a model mapping for database table web_socket_frames,
+// recording frames relayed over an upgraded connection whose handshake is saved in NetworkTraffic.
+type WebSocketFrame struct {
+	NetworkTrafficID uint      `gorm:"index;not null"`
+	Timestamp        time.Time `gorm:"not null"`
+	// Direction is either "client" (client to server) or "server" (server to client).
+	Direction string `gorm:"size:10"`
+	Opcode    uint8
+	Fin       bool
+	Length    uint64
+	Payload   []byte `gorm:"type:blob"`
+	gorm.Model
+}
+
+// ProxyDomainStat is a model mapping for database table proxy_domain_stats,
+// recording the reputation of a backend proxy on a target domain.
+type ProxyDomainStat struct {
+	gorm.Model
+
+	ProxyID  uint   `gorm:"uniqueIndex:idx_proxy_domain;not null"`
+	Domain   string `gorm:"uniqueIndex:idx_proxy_domain;not null"`
+	Suc      int
+	Fail     int
+	Bans     int
+	LastUsed time.Time
+	// BannedUntil is when the ban by the domain expires. The proxy is not selected for the domain until then.
+	BannedUntil time.Time `gorm:"index"`
+	// CooldownUntil is when the cooldown after a failure expires.
+	CooldownUntil time.Time
+	// LastReason describes the last ban.
+	LastReason string
+}
+
+// CachedResponse is a model mapping for database table cached_responses,
+// storing a response of the shared HTTP cache keyed by request URL.
+type CachedResponse struct {
+	gorm.Model
+
+	URL        string `gorm:"uniqueIndex;not null"`
+	Domain     string `gorm:"index"`
+	StatusCode int
+	// Header is the JSON encoded response header.
+	Header string `gorm:"type:text"`
+	// Vary is the JSON encoded request header values selected by the Vary response header.
+	Vary string `gorm:"type:text"`
+	Body []byte `gorm:"type:blob"`
+	Size int64
+	// StoredAt is when the response was generated by the origin server, taking its Age into account.
+	StoredAt time.Time
+	// FreshUntil is when the response becomes stale and needs revalidation.
+	FreshUntil time.Time
+	LastAccess time.Time `gorm:"index"`
+}